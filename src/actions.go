@@ -2,15 +2,13 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
-	"github.com/jackc/pgtype"
 	"go.uber.org/zap"
 )
 
@@ -93,48 +91,76 @@ func deviceAction(c context.Context, requestID string, token string, body []byte
 
 	devices := make([]deviceSmartHome, 0)
 
-	rows, err := db.QueryContext(ctx, `SELECT name, password, uri FROM controllers WHERE user_id = (SELECT id FROM users WHERE yandex_token = $1)`, token)
+	user, err := store.userByAccessToken(ctx, token, time.Now())
+	if err == errNotFound {
+		return "", errors.New("account_linking_error")
+	}
 	if err != nil {
 		return "", err
 	}
-	defer rows.Close()
-	count := 0
-	for rows.Next() {
-		var name, password, uri pgtype.Varchar
 
-		if err = rows.Scan(&name, &password, &uri); err != nil {
-			return "", err
+	controllers, err := store.userControllers(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+
+	for _, cntl := range controllers {
+		driver, err := cntl.driver()
+		if err != nil {
+			msu.Error(ctx, err, zap.String("controller", cntl.URI))
+			continue
 		}
 
-		temp, err := getUserDevicesFromSmartHome(ctx, name.String, password.String, uri.String)
+		temp, err := driver.devices(ctx)
 		if err != nil {
 			msu.Error(ctx, err)
 			// return "", err
+
+			// Команды недоступному контроллеру ставятся в очередь по последнему известному списку устройств
+			if controllerPoller != nil {
+				temp = controllerPoller.lastDevices(cntl.ID)
+			}
 		}
 
-		devices = append(devices, temp...)
-		count++
-	}
+		for index := range temp {
+			temp[index].controllerID = cntl.ID
+		}
 
-	if count == 0 {
-		var id int
-		if err = db.QueryRowContext(ctx, `SELECT id FROM users WHERE yandex_token = $1`, token).Scan(&id); err != nil {
-			if err == sql.ErrNoRows {
-				return "", errors.New("account_linking_error")
-			}
+		if err = assignDeviceIDs(ctx, cntl.ID, temp); err != nil {
+			return "", err
 		}
+
+		devices = append(devices, temp...)
 	}
 
 	for _, val := range request.Payload.Devices {
 		ds := make([]deviceSmartHome, 0)
 		for _, device := range devices {
-			if val.ID == device.Guid {
+			if val.ID == device.externalID {
 				ds = append(ds, device)
 			}
 		}
 
 		if len(ds) != 0 {
-			if err := actionToSmartHome(ctx, ds, ds[0].host, ds[0].username, ds[0].password, val); err != nil {
+			err := actionToSmartHome(ctx, ds, val)
+			if err != nil {
+				errorCode := ""
+				errorMessage := ""
+				// Команда из очереди еще не выполнена и может не выполниться: устройство недоступно,
+				// DONE получают только выполненные команды
+				if errors.Is(err, errCommandQueued) {
+					errorCode = "DEVICE_UNREACHABLE"
+					errorMessage = errCommandQueued.Error()
+				} else if errors.Is(err, errDispatchTimeout) {
+					errorCode = "DEVICE_BUSY"
+					errorMessage = errDispatchTimeout.Error()
+				} else if errors.Is(err, errControllerUnreachable) {
+					errorCode = "DEVICE_UNREACHABLE"
+				} else if errors.Is(err, errActionNotApplied) {
+					errorCode = "INTERNAL_ERROR"
+					errorMessage = err.Error()
+				}
+				msu.Warn(ctx, err, zap.String("device", val.ID))
 				response.Payload.Devices = append(response.Payload.Devices,
 					deviceActionResponseYandex{
 						ID: val.ID,
@@ -143,10 +169,13 @@ func deviceAction(c context.Context, requestID string, token string, body []byte
 							ErrorCode    string "json:\"error_code,omitempty\""
 							ErrorMessage string "json:\"error_message,omitempty\""
 						}{
-							Status: "ERROR",
+							Status:       "ERROR",
+							ErrorCode:    errorCode,
+							ErrorMessage: errorMessage,
 						},
 					},
 				)
+				continue
 			}
 
 			var caps []struct {
@@ -352,7 +381,7 @@ func transformActions(devices []deviceSmartHome, action deviceActionRequestYande
 	return actions, nil
 }
 
-func actionToSmartHome(c context.Context, devices []deviceSmartHome, host string, username string, password string, action deviceActionRequestYandex) error {
+func actionToSmartHome(c context.Context, devices []deviceSmartHome, action deviceActionRequestYandex) error {
 	ctx := c
 
 	actions, err := transformActions(devices, action)
@@ -360,60 +389,148 @@ func actionToSmartHome(c context.Context, devices []deviceSmartHome, host string
 		return err
 	}
 
-	for _, act := range actions {
-		act := act
-		act.Login = username
-		act.Password = password
-		var b []byte
-		var err error
-		if b, err = json.Marshal(act); err != nil {
-			return err
-		}
+	host := devices[0].host
+	driver := devices[0].driver
+	controllerID := devices[0].controllerID
 
-		fmt.Println(string(b))
+	// Яндекс ждет ответ ограниченное время, неотправленные команды остаются в очереди контроллера.
+	// Дедлайн ограничивает только отправку: список устройств ограничен автоматом контроллера
+	sendCtx, cancel := context.WithTimeout(ctx, actionDeadline)
+	failed, err := requestActionToSmartHome(sendCtx, actions, controllerID, host, driver)
+	cancel()
 
-		if debug {
-			msu.Info(ctx,
-				zap.String("request", "controller"),
-				zap.Any("uri", host+"?setcommandalice="+encode(encryptKey, string(b))),
-				zap.Any("req.object", act))
+	if controllerID != 0 {
+		if e := dropQueuedCommands(ctx, controllerID, delivered(actions, failed)); e != nil {
+			msu.Error(ctx, e, zap.Int("controller", controllerID))
 		}
+	}
 
-		msu.Info(ctx,
-			zap.String("request", "controller"),
-			zap.Any("uri", host+"?"+encode(encryptKey, string(b))))
-
-		req, err := http.NewRequest("GET", host+"?setcommandalice="+encode(encryptKey, string(b)), nil)
-		if err != nil {
+	if err != nil {
+		if controllerID == 0 || !isTransportError(err) {
 			return err
 		}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
+		// В очередь ставятся только недоставленные команды: доставленные повторять нельзя
+		if e := enqueueCommands(ctx, controllerID, failed, err); e != nil {
+			msu.Error(ctx, e, zap.Int("controller", controllerID))
 			return err
 		}
-		defer resp.Body.Close()
 
-		var body []byte
-		if body, err = ioutil.ReadAll(resp.Body); err != nil {
-			return err
+		return queuedError{err: err}
+	}
+
+	if !verifyActions {
+		return nil
+	}
+
+	return verifyActionsApplied(ctx, actions, driver)
+}
+
+// requestActionToSmartHome отправляет команды через очередь контроллера host. Все команды ставятся
+// в очередь сразу, чтобы пара команд шторы не разделилась по дедлайну.
+// Возвращает команды, которые точно не дошли до контроллера, и первую ошибку
+func requestActionToSmartHome(c context.Context, actions []deviceActionSmartHome, controllerID int, host string, driver controllerDriver) ([]deviceActionSmartHome, error) {
+	ctx := c
+	dispatcher := dispatchers.get(host)
+
+	results := make([]<-chan error, 0, len(actions))
+	for _, act := range actions {
+		results = append(results, dispatcher.enqueue(act, func(ctx context.Context, act deviceActionSmartHome) error {
+			return breakers.call(ctx, controllerID, func(ctx context.Context) error {
+				return driver.execute(ctx, act)
+			})
+		}))
+	}
+
+	var failed []deviceActionSmartHome
+	var first error
+	for index, done := range results {
+		err := waitDispatch(ctx, done)
+		if err != nil && first == nil {
+			first = err
 		}
-		defer resp.Body.Close()
-
-		if debug {
-			msu.Info(ctx,
-				zap.String("response", "controller"),
-				zap.Any("uri", host+"?setcommandalice="+encode(encryptKey, string(b))),
-				zap.Any("body", string(body)),
-				zap.Any("resp.object", decode(encryptKey, strings.TrimSpace(string(body)))))
+		if err != nil && isTransportError(err) {
+			failed = append(failed, actions[index])
 		}
+	}
+
+	return failed, first
+}
+
+// delivered возвращает команды, не вошедшие в failed
+func delivered(actions []deviceActionSmartHome, failed []deviceActionSmartHome) []deviceActionSmartHome {
+	result := make([]deviceActionSmartHome, 0, len(actions))
+	for _, act := range actions {
+		ok := true
+		for _, f := range failed {
+			if f.ID == act.ID {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			result = append(result, act)
+		}
+	}
+
+	return result
+}
+
+func sendActionToSmartHome(c context.Context, host string, codec controllerCodec, act deviceActionSmartHome) error {
+	ctx := c
+
+	var b []byte
+	var err error
+	if b, err = json.Marshal(act); err != nil {
+		return err
+	}
+
+	request, err := controllerQuery(codec, "setcommandalice", string(b))
+	if err != nil {
+		return err
+	}
 
+	if debug {
+		msu.Info(ctx,
+			zap.String("request", "controller"),
+			zap.Any("uri", host+"?"+request),
+			zap.Any("req.object", act))
+	}
+
+	msu.Info(ctx,
+		zap.String("request", "controller"),
+		zap.Any("uri", host+"?"+request))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", host+"?"+request, nil)
+	if err != nil {
+		return err
+	}
+
+	client := controllerClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body []byte
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return err
+	}
+
+	if debug {
+		decoded, _ := codec.decode(strings.TrimSpace(string(body)))
 		msu.Info(ctx,
 			zap.String("response", "controller"),
-			zap.Any("uri", host+"?setcommandalice="+encode(encryptKey, string(b))),
-			zap.Any("body", string(body)))
+			zap.Any("uri", host+"?"+request),
+			zap.Any("body", string(body)),
+			zap.Any("resp.object", decoded))
 	}
 
+	msu.Info(ctx,
+		zap.String("response", "controller"),
+		zap.Any("uri", host+"?"+request),
+		zap.Any("body", string(body)))
+
 	return nil
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	agentBackoff    = time.Second
+	agentMaxBackoff = time.Minute
+)
+
+// runAgent запускает агента туннеля в локальной сети клиента:
+// bsh-backend agent -server wss://backend:8443/tunnel -id 5 -token ... -controller http://192.168.10.17:9010
+func runAgent(args []string) error {
+	ctx := context.Background()
+
+	flags := flag.NewFlagSet("agent", flag.ContinueOnError)
+	server := flags.String("server", "", "backend tunnel url, e.g. wss://backend:8443/tunnel")
+	id := flags.Int("id", 0, "controller id")
+	token := flags.String("token", "", "tunnel token from POST /controllers/{id}/tunnel")
+	controllerURI := flags.String("controller", "", "controller uri in the local network")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *server == "" || *id == 0 || *token == "" || *controllerURI == "" {
+		return errors.New("server, id, token and controller are required")
+	}
+
+	backoff := agentBackoff
+	for {
+		started := time.Now()
+		err := serveAgent(ctx, *server, *id, *token, *controllerURI)
+		msu.Warn(ctx, err, zap.String("agent", "disconnected"), zap.String("server", *server))
+
+		// Соединение, продержавшееся дольше максимальной паузы, считаем удачным
+		if time.Since(started) > agentMaxBackoff {
+			backoff = agentBackoff
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > agentMaxBackoff {
+			backoff = agentMaxBackoff
+		}
+	}
+}
+
+// serveAgent держит одно соединение с backend и выполняет его запросы к контроллеру
+func serveAgent(c context.Context, server string, id int, token string, controllerURI string) error {
+	ctx := c
+
+	u, err := url.Parse(server)
+	if err != nil {
+		return err
+	}
+
+	origin := "http://" + u.Host
+	if u.Scheme == "wss" {
+		origin = "https://" + u.Host
+	}
+
+	config, err := websocket.NewConfig(server, origin)
+	if err != nil {
+		return err
+	}
+	config.Header.Set("Authorization", "Bearer "+token)
+	config.Header.Set("X-Controller-Id", strconv.Itoa(id))
+
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msu.Info(ctx, zap.String("agent", "connected"), zap.String("server", server), zap.Int("controller", id))
+
+	client := &http.Client{Timeout: timeout}
+	sendMutex := sync.Mutex{}
+
+	for {
+		var req tunnelRequest
+		if err = websocket.JSON.Receive(conn, &req); err != nil {
+			return err
+		}
+
+		go func(req tunnelRequest) {
+			resp := forwardToController(client, controllerURI, req)
+
+			sendMutex.Lock()
+			defer sendMutex.Unlock()
+			if err := websocket.JSON.Send(conn, resp); err != nil {
+				msu.Error(ctx, err, zap.Uint64("request", req.ID))
+			}
+		}(req)
+	}
+}
+
+func forwardToController(client *http.Client, controllerURI string, req tunnelRequest) tunnelResponse {
+	resp, err := client.Get(controllerURI + "?" + req.Query)
+	if err != nil {
+		return tunnelResponse{ID: req.ID, Error: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return tunnelResponse{ID: req.ID, Error: err.Error()}
+	}
+
+	header := make(map[string]string)
+	if server := resp.Header.Get("Server"); server != "" {
+		header["Server"] = server
+	}
+
+	return tunnelResponse{
+		ID:     req.ID,
+		Status: resp.StatusCode,
+		Header: header,
+		Body:   string(body),
+	}
+}
@@ -1 +1,71 @@
 package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var (
+	// authRequestTTL - сколько действует запрос авторизации со страницы входа
+	authRequestTTL = 10 * time.Minute
+	// authCodeTTL - сколько клиент может обменивать выданный код на токен
+	authCodeTTL = 10 * time.Minute
+	// authJanitorInterval - период удаления просроченных запросов, кодов и токенов
+	authJanitorInterval = time.Minute
+
+	authRequestsExpired prometheus.Counter
+	authCodesExpired    prometheus.Counter
+)
+
+// expireAuthorizations удаляет просроченные запросы авторизации, коды и токены.
+// Каждое удаление учитывается в метриках сразу, даже если следующее завершится ошибкой
+func expireAuthorizations(c context.Context, now time.Time) (requests int, codes int, tokens int, err error) {
+	ctx := c
+
+	if requests, err = store.expireAuthRequests(ctx, now.Add(-authRequestTTL)); err != nil {
+		return 0, 0, 0, err
+	}
+	addExpired(authRequestsExpired, requests)
+	if codes, err = store.expireAuthCodes(ctx, now.Add(-authCodeTTL)); err != nil {
+		return requests, 0, 0, err
+	}
+	addExpired(authCodesExpired, codes)
+	if tokens, err = store.expireTokens(ctx, now); err != nil {
+		return requests, codes, 0, err
+	}
+	addExpired(tokensExpired, tokens)
+
+	return requests, codes, tokens, nil
+}
+
+// addExpired добавляет удаленные строки к метрике, если метрики зарегистрированы
+func addExpired(counter prometheus.Counter, count int) {
+	if counter != nil {
+		counter.Add(float64(count))
+	}
+}
+
+// runAuthJanitor периодически удаляет просроченные запросы авторизации, коды и токены
+func runAuthJanitor(c context.Context, interval time.Duration) {
+	ctx := c
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		requests, codes, tokens, err := expireAuthorizations(ctx, time.Now())
+		if err != nil {
+			msu.Error(ctx, err)
+		} else if requests > 0 || codes > 0 || tokens > 0 {
+			msu.Info(ctx, zap.String("janitor", "auth"), zap.Int("requests", requests), zap.Int("codes", codes), zap.Int("tokens", tokens))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
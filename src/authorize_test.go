@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+)
+
+func TestAuthRequestExpiry(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	for name, newStore := range testStorages() {
+		t.Run(name, func(t *testing.T) {
+			store = newStore(t)
+			ctx := context.Background()
+			router := handlers()
+
+			request := func(uri string, body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodPost, uri, strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, req)
+				return recorder
+			}
+
+			_, err := store.createUser(ctx, "user", fmt.Sprintf("%x", md5.Sum([]byte("secret"))))
+			require.NoError(t, err)
+			registerTestClient(t)
+
+			now := time.Now()
+			query := "response_type=code&client_id=yandex&state="
+			require.NoError(t, store.createAuthRequest(ctx, "old", query+"old", now.Add(-authRequestTTL-time.Minute)))
+			require.NoError(t, store.createAuthRequest(ctx, "fresh", query+"fresh", now))
+
+			// Просроченный запрос не принимается при входе
+			assert.Equal(t, http.StatusBadRequest, request("/auth/login", "username=user&password=secret&rid=old").Code)
+
+			recorder := request("/auth/login", "username=user&password=secret&rid=fresh")
+			require.Equal(t, http.StatusFound, recorder.Code)
+			location, err := url.Parse(recorder.Header().Get("Location"))
+			require.NoError(t, err)
+			code := location.Query().Get("code")
+
+			requests, codes, _, err := expireAuthorizations(ctx, now)
+			require.NoError(t, err)
+			assert.Equal(t, 1, requests)
+			assert.Equal(t, 0, codes)
+
+			_, _, err = store.authRequest(ctx, "old")
+			assert.Equal(t, errNotFound, err)
+
+			requests, codes, _, err = expireAuthorizations(ctx, now.Add(authCodeTTL+time.Minute))
+			require.NoError(t, err)
+			assert.Equal(t, 0, requests)
+			assert.Equal(t, 1, codes)
+
+			recorder = request("/auth/token", "grant_type=authorization_code&code="+code+"&client_id=yandex&client_secret="+testClientSecret)
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+			assert.JSONEq(t, `{"error":"invalid_grant","error_description":"unknown or used authorization code"}`, recorder.Body.String())
+		})
+	}
+}
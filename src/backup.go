@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// backupTimeLayout - время в имени файла копии, имена сортируются по времени
+const backupTimeLayout = "20060102T150405.000Z"
+
+var (
+	// backupDirectory - каталог копий базы, по умолчанию <databaseDirectory>/backups.
+	// Каталог должен быть на томе, который переживает пересоздание контейнера
+	backupDirectory = ""
+	// backupInterval - период плановых копий, 0 отключает плановые копии
+	backupInterval = 24 * time.Hour
+	// backupRetain - сколько последних копий хранить, 0 - хранить все
+	backupRetain = 7
+)
+
+type backupFile struct {
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+func backupDir() string {
+	if backupDirectory != "" {
+		return backupDirectory
+	}
+
+	return databaseDirectory + "/backups"
+}
+
+// snapshotDatabase сохраняет согласованную копию открытой базы в path, не останавливая запись
+func snapshotDatabase(c context.Context, database *sql.DB, path string) error {
+	ctx := c
+
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	_, err := database.ExecContext(ctx, `VACUUM INTO $1`, path)
+	return err
+}
+
+// createBackup сохраняет копию базы в dir с контрольной суммой рядом и удаляет копии сверх retain
+func createBackup(c context.Context, database *sql.DB, dir string, retain int) (backupFile, error) {
+	ctx := c
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return backupFile{}, err
+	}
+
+	created := time.Now().UTC()
+	name := "users-" + created.Format(backupTimeLayout) + ".db"
+	path := filepath.Join(dir, name)
+	if err := snapshotDatabase(ctx, database, path); err != nil {
+		return backupFile{}, err
+	}
+
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return backupFile{}, err
+	}
+	if err = ioutil.WriteFile(path+".sha256", []byte(sum+"  "+name+"\n"), 0600); err != nil {
+		return backupFile{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return backupFile{}, err
+	}
+
+	if err = pruneBackups(dir, retain); err != nil {
+		return backupFile{}, err
+	}
+
+	return backupFile{Name: name, Path: path, CreatedAt: created.Truncate(time.Millisecond), Size: info.Size()}, nil
+}
+
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// listBackups возвращает копии из dir от старых к новым
+func listBackups(dir string) ([]backupFile, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []backupFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]backupFile, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, "users-") || !strings.HasSuffix(name, ".db") {
+			continue
+		}
+
+		created, err := time.Parse(backupTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, "users-"), ".db"))
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, backupFile{Name: name, Path: filepath.Join(dir, name), CreatedAt: created, Size: entry.Size()})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.Before(backups[j].CreatedAt) })
+
+	return backups, nil
+}
+
+// pruneBackups удаляет самые старые копии, оставляя retain последних
+func pruneBackups(dir string, retain int) error {
+	if retain <= 0 {
+		return nil
+	}
+
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+
+	for len(backups) > retain {
+		if err = os.Remove(backups[0].Path); err != nil {
+			return err
+		}
+		if err = os.Remove(backups[0].Path + ".sha256"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// backupAt возвращает последнюю копию, сделанную не позже at
+func backupAt(backups []backupFile, at time.Time) (backupFile, error) {
+	for i := len(backups) - 1; i >= 0; i-- {
+		if !backups[i].CreatedAt.After(at) {
+			return backups[i], nil
+		}
+	}
+
+	return backupFile{}, fmt.Errorf("no backup at or before %s", at.Format(time.RFC3339))
+}
+
+// verifyBackup проверяет контрольную сумму копии, целостность файла SQLite и то,
+// что схема копии не новее этой версии сервера
+func verifyBackup(c context.Context, path string) error {
+	ctx := c
+
+	expected, err := ioutil.ReadFile(path + ".sha256")
+	if err != nil {
+		return fmt.Errorf("checksum: %w", err)
+	}
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	if fields := strings.Fields(string(expected)); len(fields) == 0 || fields[0] != sum {
+		return errors.New("checksum mismatch")
+	}
+
+	database, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	integrity := ""
+	if err = database.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&integrity); err != nil {
+		return err
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("integrity check: %s", integrity)
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	_, err = migrationStatus(ctx, database, migrations)
+	return err
+}
+
+// restoreDatabase заменяет файл базы проверенной копией. Пока сервер работает, он держит
+// блокировку базы, и восстановление отказывается с errDatabaseLocked.
+// Текущая база перед заменой сохраняется рядом, путь к ней возвращается
+func restoreDatabase(c context.Context, backupPath string, dbPath string) (string, error) {
+	ctx := c
+
+	if err := verifyBackup(ctx, backupPath); err != nil {
+		return "", fmt.Errorf("backup %s: %w", backupPath, err)
+	}
+
+	unlock, err := lockDatabase(dbPath)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	previous := ""
+	if _, err := os.Stat(dbPath); err == nil {
+		database, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			return "", err
+		}
+		previous = fmt.Sprintf("%s.pre-restore-%s", dbPath, time.Now().UTC().Format(backupTimeLayout))
+		err = snapshotDatabase(ctx, database, previous)
+		database.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Копия пишется рядом и переименовывается, чтобы база не осталась наполовину записанной
+	temp := dbPath + ".restore"
+	if err := copyFile(backupPath, temp); err != nil {
+		os.Remove(temp)
+		return previous, err
+	}
+	// Журнал старой базы SQLite применил бы к восстановленной
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			os.Remove(temp)
+			return previous, err
+		}
+	}
+	if err := os.Rename(temp, dbPath); err != nil {
+		return previous, err
+	}
+
+	return previous, nil
+}
+
+func copyFile(from string, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(target, source); err != nil {
+		target.Close()
+		return err
+	}
+	if err = target.Sync(); err != nil {
+		target.Close()
+		return err
+	}
+
+	return target.Close()
+}
+
+// runBackups делает копию базы при запуске и затем каждые interval
+func runBackups(c context.Context, interval time.Duration) {
+	ctx := c
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		backup, err := createBackup(ctx, db, backupDir(), backupRetain)
+		if err != nil {
+			msu.Error(ctx, err, zap.String("backup", backupDir()))
+		} else {
+			msu.Info(ctx, zap.String("backup", backup.Path), zap.Int64("size", backup.Size))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runBackup управляет копиями базы:
+// bsh-backend backup [-db /tmp/users.db] [-dir каталог] [-retain N] create | list | verify <копия> |
+// restore <копия> | restore -at <RFC3339> | export -out <файл> [-at <RFC3339>]
+// export без -at сохраняет согласованный снимок текущей базы, с -at - ближайшую копию,
+// сделанную не позже указанного момента. restore отказывается, пока работает сервер
+func runBackup(args []string) error {
+	ctx := context.Background()
+
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	dbPath := flags.String("db", databaseDirectory+"/users.db", "database file")
+	dir := flags.String("dir", backupDir(), "backup directory")
+	retain := flags.Int("retain", backupRetain, "number of backups to keep, 0 keeps all")
+	at := flags.String("at", "", "restore or export the nearest backup taken at or before this time, RFC3339")
+	out := flags.String("out", "", "export file")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// Флаги допускаются и до, и после действия
+	action := "list"
+	name := ""
+	if flags.NArg() > 0 {
+		action = flags.Arg(0)
+		rest := flags.Args()[1:]
+		if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+			name = rest[0]
+			rest = rest[1:]
+		}
+		if err := flags.Parse(rest); err != nil {
+			return err
+		}
+	}
+
+	// chosen возвращает копию по имени или по моменту времени -at
+	chosen := func() (backupFile, error) {
+		backups, err := listBackups(*dir)
+		if err != nil {
+			return backupFile{}, err
+		}
+		if name != "" {
+			for _, backup := range backups {
+				if backup.Name == name || backup.Path == name {
+					return backup, nil
+				}
+			}
+			return backupFile{}, fmt.Errorf("backup %s not found in %s", name, *dir)
+		}
+		if *at == "" {
+			return backupFile{}, errors.New("backup name or -at is required")
+		}
+		moment, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return backupFile{}, err
+		}
+		return backupAt(backups, moment)
+	}
+
+	switch action {
+	case "list":
+		backups, err := listBackups(*dir)
+		for _, backup := range backups {
+			fmt.Printf("%s %s %d\n", backup.Name, backup.CreatedAt.Format(time.RFC3339), backup.Size)
+		}
+		return err
+	case "create":
+		database, err := sql.Open("sqlite3", *dbPath)
+		if err != nil {
+			return err
+		}
+		defer database.Close()
+
+		backup, err := createBackup(ctx, database, *dir, *retain)
+		if err != nil {
+			return err
+		}
+		fmt.Println(backup.Path)
+		return nil
+	case "verify":
+		backup, err := chosen()
+		if err != nil {
+			return err
+		}
+		return verifyBackup(ctx, backup.Path)
+	case "restore":
+		backup, err := chosen()
+		if err != nil {
+			return err
+		}
+		previous, err := restoreDatabase(ctx, backup.Path, *dbPath)
+		if err != nil {
+			return err
+		}
+		msu.Info(ctx, zap.String("restored", backup.Path), zap.String("database", *dbPath), zap.String("previous", previous))
+		return nil
+	case "export":
+		if *out == "" {
+			return errors.New("-out is required")
+		}
+		if *at == "" && name == "" {
+			database, err := sql.Open("sqlite3", *dbPath)
+			if err != nil {
+				return err
+			}
+			defer database.Close()
+			return snapshotDatabase(ctx, database, *out)
+		}
+		backup, err := chosen()
+		if err != nil {
+			return err
+		}
+		if err = verifyBackup(ctx, backup.Path); err != nil {
+			return fmt.Errorf("backup %s: %w", backup.Path, err)
+		}
+		return copyFile(backup.Path, *out)
+	}
+
+	return fmt.Errorf("unknown backup action %s", action)
+}
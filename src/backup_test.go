@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+)
+
+func TestBackupRestore(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	path := t.TempDir() + "/users.db"
+	dir := t.TempDir() + "/backups"
+	require.NoError(t, initializeDB(context.Background(), path))
+
+	database, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer database.Close()
+
+	users := func(database *sql.DB) int {
+		count := 0
+		require.NoError(t, database.QueryRow(`SELECT count(*) FROM users`).Scan(&count))
+		return count
+	}
+
+	backups := make([]backupFile, 0)
+	for i := 0; i < 3; i++ {
+		_, err = database.Exec(`INSERT INTO users (name, password) VALUES ($1, '')`, "user"+string(rune('a'+i)))
+		require.NoError(t, err)
+
+		backup, err := createBackup(context.Background(), database, dir, 2)
+		require.NoError(t, err)
+		backups = append(backups, backup)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Старые копии сверх retain удаляются вместе с контрольной суммой
+	listed, err := listBackups(dir)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(listed))
+	assert.Equal(t, backups[1].Name, listed[0].Name)
+	assert.Equal(t, backups[2].Name, listed[1].Name)
+	_, err = os.Stat(backups[0].Path + ".sha256")
+	assert.True(t, os.IsNotExist(err))
+
+	for _, backup := range listed {
+		assert.NoError(t, verifyBackup(context.Background(), backup.Path))
+	}
+
+	chosen, err := backupAt(listed, backups[1].CreatedAt.Add(time.Millisecond))
+	require.NoError(t, err)
+	assert.Equal(t, backups[1].Name, chosen.Name)
+	_, err = backupAt(listed, backups[0].CreatedAt)
+	assert.Error(t, err)
+
+	_, err = database.Exec(`INSERT INTO users (name, password) VALUES ('late', '')`)
+	require.NoError(t, err)
+	require.NoError(t, database.Close())
+
+	// Пока сервер держит блокировку, база не заменяется
+	unlock, err := lockDatabase(path)
+	require.NoError(t, err)
+	_, err = restoreDatabase(context.Background(), chosen.Path, path)
+	assert.Equal(t, errDatabaseLocked, err)
+	unlock()
+
+	// Журнал старой базы удаляется вместе с ней
+	require.NoError(t, ioutil.WriteFile(path+"-wal", []byte("stale"), 0600))
+	previous, err := restoreDatabase(context.Background(), chosen.Path, path)
+	require.NoError(t, err)
+	_, err = os.Stat(path + "-wal")
+	assert.True(t, os.IsNotExist(err))
+
+	restored, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer restored.Close()
+	assert.Equal(t, 2, users(restored))
+
+	// Текущая база сохраняется перед заменой
+	saved, err := sql.Open("sqlite3", previous)
+	require.NoError(t, err)
+	defer saved.Close()
+	assert.Equal(t, 4, users(saved))
+
+	// Поврежденная копия не восстанавливается
+	data, err := ioutil.ReadFile(listed[1].Path)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(listed[1].Path, data, 0600))
+	assert.Error(t, verifyBackup(context.Background(), listed[1].Path))
+	_, err = restoreDatabase(context.Background(), listed[1].Path, path)
+	assert.Error(t, err)
+	assert.Equal(t, 2, users(restored))
+}
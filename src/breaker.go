@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errControllerUnreachable = errors.New("controller unreachable")
+	// errControllerTimeout - контроллер не ответил за timeout
+	errControllerTimeout = errors.New("controller timeout")
+)
+
+var (
+	breakerThreshold  = 3
+	breakerBackoff    = 5 * time.Second
+	breakerMaxBackoff = 5 * time.Minute
+
+	breakers = newBreakerRegistry()
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+
+	return ""
+}
+
+// circuitBreaker перестает ходить на контроллер после нескольких ошибок подряд.
+// В открытом состоянии запросы сразу завершаются ошибкой, пробный запрос пропускается
+// через экспоненциально растущий интервал
+type circuitBreaker struct {
+	mutex    sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	backoff  time.Duration
+	probing  bool
+	now      func() time.Time
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{
+		state:   breakerClosed,
+		backoff: breakerBackoff,
+		now:     time.Now,
+	}
+}
+
+func (b *circuitBreaker) allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Before(b.openedAt.Add(b.backoff)) {
+			return errControllerUnreachable
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		// Пока идет пробный запрос, остальные не ждут
+		if b.probing {
+			return errControllerUnreachable
+		}
+		b.probing = true
+		return nil
+	}
+
+	return nil
+}
+
+func (b *circuitBreaker) success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.state = breakerClosed
+	b.failures = 0
+	b.backoff = breakerBackoff
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	switch b.state {
+	case breakerClosed:
+		if b.failures >= breakerThreshold {
+			b.state = breakerOpen
+			b.openedAt = b.now()
+			b.backoff = breakerBackoff
+		}
+	case breakerHalfOpen:
+		b.state = breakerOpen
+		b.openedAt = b.now()
+		b.probing = false
+		b.backoff *= 2
+		if b.backoff > breakerMaxBackoff {
+			b.backoff = breakerMaxBackoff
+		}
+	}
+}
+
+// release завершает запрос, который ничего не говорит о связи с контроллером
+func (b *circuitBreaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+}
+
+func (b *circuitBreaker) current() breakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state
+}
+
+// call выполняет запрос к контроллеру через автомат, ограничивая его временем timeout.
+// Отказом считаются только ошибки связи. Ошибки в ответе контроллера и отмена запроса
+// вызывающим состояние автомата не меняют
+func (b *circuitBreaker) call(c context.Context, fn func(ctx context.Context) error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+
+	err := fn(ctx)
+	switch {
+	case err == nil:
+		b.success()
+	case c.Err() != nil:
+		b.release()
+	case ctx.Err() != nil:
+		err = fmt.Errorf("%w: %v", errControllerTimeout, err)
+		b.failure()
+	case isTransportError(err):
+		b.failure()
+	default:
+		b.release()
+	}
+
+	return err
+}
+
+type breakerRegistry struct {
+	mutex    sync.Mutex
+	breakers map[int]*circuitBreaker
+}
+
+func newBreakerRegistry() *breakerRegistry {
+	return &breakerRegistry{breakers: make(map[int]*circuitBreaker)}
+}
+
+// get возвращает автомат контроллера по его id. У контроллеров с общим uri автоматы разные
+func (r *breakerRegistry) get(id int) *circuitBreaker {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	b, ok := r.breakers[id]
+	if !ok {
+		b = newCircuitBreaker()
+		r.breakers[id] = b
+	}
+
+	return b
+}
+
+func (r *breakerRegistry) state(id int) breakerState {
+	r.mutex.Lock()
+	b, ok := r.breakers[id]
+	r.mutex.Unlock()
+
+	if !ok {
+		return breakerClosed
+	}
+
+	return b.current()
+}
+
+// reset закрывает автомат после успешной проверки контроллера
+func (r *breakerRegistry) reset(id int) {
+	r.get(id).success()
+
+	if breakerStates != nil {
+		breakerStates.WithLabelValues(strconv.Itoa(id)).Set(float64(breakerClosed))
+	}
+}
+
+// remove забывает автомат удаленного контроллера
+func (r *breakerRegistry) remove(id int) {
+	r.mutex.Lock()
+	delete(r.breakers, id)
+	r.mutex.Unlock()
+
+	if breakerStates != nil {
+		breakerStates.DeleteLabelValues(strconv.Itoa(id))
+	}
+}
+
+func (r *breakerRegistry) call(ctx context.Context, id int, fn func(ctx context.Context) error) error {
+	b := r.get(id)
+	err := b.call(ctx, fn)
+
+	if breakerStates != nil {
+		breakerStates.WithLabelValues(strconv.Itoa(id)).Set(float64(b.current()))
+	}
+
+	return err
+}
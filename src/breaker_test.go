@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker()
+	b.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	failing := func(ctx context.Context) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	succeeding := func(ctx context.Context) error { return nil }
+
+	for i := 0; i < breakerThreshold; i++ {
+		assert.Error(t, b.call(ctx, failing))
+	}
+	assert.Equal(t, breakerOpen, b.current())
+
+	// Открыт - запрос не выполняется
+	called := false
+	err := b.call(ctx, func(ctx context.Context) error { called = true; return nil })
+	assert.True(t, errors.Is(err, errControllerUnreachable))
+	assert.False(t, called)
+
+	// Пробный запрос неудачен - интервал удваивается
+	now = now.Add(breakerBackoff)
+	assert.Error(t, b.call(ctx, failing))
+	assert.Equal(t, breakerOpen, b.current())
+	assert.Equal(t, 2*breakerBackoff, b.backoff)
+
+	now = now.Add(breakerBackoff)
+	assert.True(t, errors.Is(b.call(ctx, failing), errControllerUnreachable))
+
+	now = now.Add(breakerBackoff)
+	assert.NoError(t, b.call(ctx, succeeding))
+	assert.Equal(t, breakerClosed, b.current())
+	assert.Equal(t, breakerBackoff, b.backoff)
+}
+
+func TestCircuitBreakerIgnoresNonTransportErrors(t *testing.T) {
+	b := newCircuitBreaker()
+
+	// Контроллер ответил, но с ошибкой: неверный пароль или неразборчивый ответ
+	for i := 0; i < 2*breakerThreshold; i++ {
+		assert.Error(t, b.call(context.Background(), func(ctx context.Context) error { return errControllerResponse }))
+	}
+	assert.Equal(t, breakerClosed, b.current())
+
+	// Вызывающий сам отменил запрос
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 2*breakerThreshold; i++ {
+		assert.Error(t, b.call(ctx, func(ctx context.Context) error {
+			<-ctx.Done()
+			return &net.OpError{Op: "dial", Net: "tcp", Err: ctx.Err()}
+		}))
+	}
+	assert.Equal(t, breakerClosed, b.current())
+
+	// Контроллер не ответил за timeout
+	defer func(previous time.Duration) { timeout = previous }(timeout)
+	timeout = 0
+	for i := 0; i < breakerThreshold; i++ {
+		err := b.call(context.Background(), func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		assert.ErrorIs(t, err, errControllerTimeout)
+	}
+	assert.Equal(t, breakerOpen, b.current())
+}
+
+func TestBreakerRegistry(t *testing.T) {
+	registry := newBreakerRegistry()
+	failing := func(ctx context.Context) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+
+	// Контроллеры с общим uri не делят автомат
+	for i := 0; i < breakerThreshold; i++ {
+		registry.call(context.Background(), 1, failing)
+	}
+	assert.Equal(t, breakerOpen, registry.state(1))
+	assert.Equal(t, breakerClosed, registry.state(2))
+
+	registry.reset(1)
+	assert.Equal(t, breakerClosed, registry.state(1))
+
+	// Автомат удаленного контроллера не остается в реестре
+	registry.remove(1)
+	assert.Empty(t, registry.breakers)
+
+	records := newHealthRegistry()
+	records.record(1, time.Millisecond, 2, "", nil)
+	records.remove(1)
+	assert.Nil(t, records.get(1))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errClientExists - клиент OAuth с таким id уже зарегистрирован
+var errClientExists = errors.New("oauth client already exists")
+
+// yandexClientID - id клиента OAuth умного дома Яндекса, к нему привязаны токены до появления клиентов
+const yandexClientID = "yandex"
+
+var (
+	// yandexClientSecret - секрет клиента yandex из настроек навыка, с ним клиент создается при запуске
+	yandexClientSecret = ""
+	yandexRedirectURI  = "https://social.yandex.net/broker/redirect"
+)
+
+// oauthClient - платформа, которая связывает аккаунты пользователей через /auth/authorize и /auth/token
+type oauthClient struct {
+	ID   string
+	Name string
+	// SecretHash - sha256 секрета клиента в hex, сам секрет не хранится
+	SecretHash   string
+	RedirectURIs []string
+	CreatedAt    time.Time
+}
+
+func hashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSecret сравнивает секрет с хэшем за постоянное время
+func (client oauthClient) checkSecret(secret string) bool {
+	return secret != "" && subtle.ConstantTimeCompare([]byte(hashClientSecret(secret)), []byte(client.SecretHash)) == 1
+}
+
+// allowsRedirect - redirect_uri совпадает с одним из зарегистрированных адресов посимвольно
+func (client oauthClient) allowsRedirect(uri string) bool {
+	for _, allowed := range client.RedirectURIs {
+		if uri == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateRedirectURI проверяет адрес возврата при регистрации клиента: абсолютный, без фрагмента,
+// https или http только для локальной отладки
+func validateRedirectURI(uri string) error {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if !parsed.IsAbs() || parsed.Host == "" {
+		return fmt.Errorf("redirect uri %s is not absolute", uri)
+	}
+	if parsed.Fragment != "" || strings.Contains(uri, "#") {
+		return fmt.Errorf("redirect uri %s contains a fragment", uri)
+	}
+
+	switch parsed.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if ip := net.ParseIP(parsed.Hostname()); parsed.Hostname() == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("redirect uri %s must use https", uri)
+}
+
+func generateClientSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// seedYandexClient регистрирует клиента yandex с секретом из настроек или обновляет секрет
+// и адрес возврата уже зарегистрированного клиента. Без секрета клиенты не меняются
+func seedYandexClient(c context.Context, clients storage, secret string, redirectURI string) error {
+	ctx := c
+
+	if secret == "" {
+		return nil
+	}
+
+	client, err := clients.oauthClient(ctx, yandexClientID)
+	if err == errNotFound {
+		client = oauthClient{ID: yandexClientID, Name: "Яндекс", SecretHash: hashClientSecret(secret), RedirectURIs: []string{redirectURI}, CreatedAt: time.Now()}
+		if err = clients.createOAuthClient(ctx, client); err != nil {
+			return err
+		}
+		msu.Info(ctx, zap.String("client", client.ID), zap.String("seeded", "created"))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if client.checkSecret(secret) && client.allowsRedirect(redirectURI) {
+		return nil
+	}
+	client.SecretHash = hashClientSecret(secret)
+	if !client.allowsRedirect(redirectURI) {
+		client.RedirectURIs = append(client.RedirectURIs, redirectURI)
+	}
+	if err = clients.updateOAuthClient(ctx, client); err != nil {
+		return err
+	}
+	msu.Info(ctx, zap.String("client", client.ID), zap.String("seeded", "updated"))
+
+	return nil
+}
+
+// runClients управляет клиентами OAuth:
+// bsh-backend clients [-db /tmp/users.db] list | add -id <id> -name <название> -redirect-uri <адрес> [-redirect-uri ...] [-secret <секрет>] |
+// revoke <id> | remove <id>
+// add без -secret создает случайный секрет и печатает его: в базе остается только хэш.
+// revoke отзывает все токены клиента, remove удаляет клиента вместе с токенами
+func runClients(args []string) error {
+	ctx := context.Background()
+
+	flags := flag.NewFlagSet("clients", flag.ContinueOnError)
+	dbPath := flags.String("db", databaseDirectory+"/users.db", "database file")
+	id := flags.String("id", "", "client id")
+	name := flags.String("name", "", "client name shown on the login page")
+	secret := flags.String("secret", "", "client secret, generated if empty")
+	redirectURIs := make([]string, 0)
+	flags.Func("redirect-uri", "allowed redirect uri, repeatable", func(value string) error {
+		if err := validateRedirectURI(value); err != nil {
+			return err
+		}
+		redirectURIs = append(redirectURIs, value)
+		return nil
+	})
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// Флаги допускаются и до, и после действия
+	action := "list"
+	target := ""
+	if flags.NArg() > 0 {
+		action = flags.Arg(0)
+		rest := flags.Args()[1:]
+		if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+			target = rest[0]
+			rest = rest[1:]
+		}
+		if err := flags.Parse(rest); err != nil {
+			return err
+		}
+	}
+
+	// initializeDB может применить миграции и снять копию: под работающим сервером это запрещено
+	unlock, err := lockDatabase(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := initializeDB(ctx, *dbPath); err != nil {
+		return err
+	}
+	database, err := sql.Open("sqlite3", *dbPath)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	clients := newSQLiteStorage(database, nil, nil)
+
+	switch action {
+	case "list":
+		list, err := clients.oauthClients(ctx)
+		for _, client := range list {
+			fmt.Printf("%s\t%s\t%s\n", client.ID, client.Name, strings.Join(client.RedirectURIs, " "))
+		}
+		return err
+	case "add":
+		if *id == "" || *name == "" || len(redirectURIs) == 0 {
+			return errors.New("usage: clients add -id <id> -name <name> -redirect-uri <uri> [-secret <secret>]")
+		}
+		generated := *secret == ""
+		if generated {
+			if *secret, err = generateClientSecret(); err != nil {
+				return err
+			}
+		}
+		client := oauthClient{ID: *id, Name: *name, SecretHash: hashClientSecret(*secret), RedirectURIs: redirectURIs, CreatedAt: time.Now()}
+		if err = clients.createOAuthClient(ctx, client); err != nil {
+			return err
+		}
+		msu.Info(ctx, zap.String("client", client.ID), zap.Strings("redirect_uris", client.RedirectURIs))
+		if generated {
+			fmt.Printf("client_id: %s\nclient_secret: %s\n", client.ID, *secret)
+		}
+		return nil
+	case "revoke":
+		if target == "" {
+			return errors.New("usage: clients revoke <id>")
+		}
+		revoked, err := clients.revokeClientTokens(ctx, target, time.Now())
+		if err != nil {
+			return err
+		}
+		msu.Info(ctx, zap.String("client", target), zap.Int("revoked", revoked))
+		return nil
+	case "remove":
+		if target == "" {
+			return errors.New("usage: clients remove <id>")
+		}
+		return clients.deleteOAuthClient(ctx, target)
+	}
+
+	return fmt.Errorf("unknown clients action %s", action)
+}
@@ -2,7 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
 	"strings"
 
 	"go.uber.org/zap"
@@ -46,3 +53,135 @@ func decode(key string, source string) string {
 	}
 	return string(decoded)
 }
+
+const (
+	// codecLegacy XOR по шестнадцатеричной строке, ключ по умолчанию encryptKey
+	codecLegacy = 1
+	// codecAESGCM AES-256-GCM с ключом контроллера, шифротекст передается в hex вместе с nonce
+	codecAESGCM = 2
+)
+
+var errCodecDecode = errors.New("unable to decode controller payload")
+
+// controllerCodec шифрует запросы к контроллеру и расшифровывает его ответы
+type controllerCodec interface {
+	version() int
+	encode(source string) (string, error)
+	decode(source string) (string, error)
+}
+
+// newCodec возвращает кодек версии version. Для AES-GCM ключ задается в hex,
+// legacy без ключа контроллера использует общий encryptKey
+func newCodec(version int, key string) (controllerCodec, error) {
+	switch version {
+	case codecLegacy:
+		if key == "" {
+			key = encryptKey
+		}
+		return legacyCodec{key: key}, nil
+	case codecAESGCM:
+		raw, err := hex.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid codec key: %v", err)
+		}
+		if len(raw) != 32 {
+			return nil, errors.New("invalid codec key: must be 32 bytes")
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		return aesgcmCodec{aead: aead}, nil
+	}
+
+	return nil, fmt.Errorf("unknown codec version %d", version)
+}
+
+// controllerQuery собирает параметры запроса к контроллеру. Для legacy запрос не меняется,
+// для остальных версий добавляется codec, по которому прошивка выбирает кодек
+func controllerQuery(codec controllerCodec, command string, payload string) (string, error) {
+	encoded, err := codec.encode(payload)
+	if err != nil {
+		return "", err
+	}
+
+	if codec.version() == codecLegacy {
+		return command + "=" + encoded, nil
+	}
+
+	return command + "=" + encoded + "&codec=" + strconv.Itoa(codec.version()), nil
+}
+
+type legacyCodec struct {
+	key string
+}
+
+func (c legacyCodec) version() int {
+	return codecLegacy
+}
+
+func (c legacyCodec) encode(source string) (string, error) {
+	result := strings.Builder{}
+	result.Grow(4 * len(source))
+
+	if _, err := newLegacyEncoder(&result, c.key).Write([]byte(source)); err != nil {
+		return "", err
+	}
+
+	return result.String(), nil
+}
+
+func (c legacyCodec) decode(source string) (string, error) {
+	result := strings.Builder{}
+	result.Grow(len(source) / 4)
+
+	if _, err := io.Copy(&result, newLegacyDecoder(strings.NewReader(source), c.key)); err != nil {
+		return "", err
+	}
+
+	if result.Len() == 0 && source != "" {
+		return "", errCodecDecode
+	}
+
+	return result.String(), nil
+}
+
+type aesgcmCodec struct {
+	aead cipher.AEAD
+}
+
+func (c aesgcmCodec) version() int {
+	return codecAESGCM
+}
+
+func (c aesgcmCodec) encode(source string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(c.aead.Seal(nonce, nonce, []byte(source), nil)), nil
+}
+
+func (c aesgcmCodec) decode(source string) (string, error) {
+	raw, err := hex.DecodeString(source)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errCodecDecode, err)
+	}
+
+	if len(raw) < c.aead.NonceSize() {
+		return "", errCodecDecode
+	}
+
+	nonce, ciphertext := raw[:c.aead.NonceSize()], raw[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errCodecDecode, err)
+	}
+
+	return string(plaintext), nil
+}
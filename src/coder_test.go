@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -33,3 +38,145 @@ func TestDecode(t *testing.T) {
 func TestDecode2(t *testing.T) {
 	fmt.Println(decode(encryptKey, "5620510104725724550404085727510101705350500201005350517000035652550205025651540404775650550700035223510101005253510100725350550a04055350507201085321510104085756570504725724557505035350507201005321510104085756560104775724557700035223500200725350550a04055521550a04745757510101705251517000035721550a04745757510101705254500300725350550a04745756550605095521550a0474575751010170525051700003575b550707025656550205055657540000035223500200725350550004095753557604065757570704085726557704085727550400035223500300725350550704085726557704085727550400035223500300725350550704085726557704085727550407075753557005045757510101705252517000035751557504725724540106055650550205065350507200035252540b0407575450030100525250030101525251010072535055000477572155750503555654010400565557750407575451010170535050030509575455050101525250030101525250030003532151010502575754070701575354000502565555750503575651010170535051010072535055000477572155750503545655060509565651010170535051010575"))
 }
+
+func TestCodecs(t *testing.T) {
+	legacy, err := newCodec(codecLegacy, "")
+	assert.NoError(t, err)
+
+	encoded, err := legacy.encode(`{"auth":"true"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "562051010400565754070409535050720003565654010504575751010575", encoded)
+
+	query, err := controllerQuery(legacy, "getalldevices", `{"auth":"true"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "getalldevices=562051010400565754070409535050720003565654010504575751010575", query)
+
+	_, err = newCodec(codecAESGCM, "abc321")
+	assert.Error(t, err)
+
+	key := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	aead, err := newCodec(codecAESGCM, key)
+	assert.NoError(t, err)
+
+	encoded, err = aead.encode(`{"login":"11","password":"11"}`)
+	assert.NoError(t, err)
+
+	decoded, err := aead.decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"login":"11","password":"11"}`, decoded)
+
+	// Подмененный шифротекст не расшифровывается
+	tampered := []byte(encoded)
+	tampered[len(tampered)-1] ^= 1
+	_, err = aead.decode(string(tampered))
+	assert.Error(t, err)
+
+	query, err = controllerQuery(aead, "getalldevices", "{}")
+	assert.NoError(t, err)
+	assert.Contains(t, query, "&codec=2")
+}
+
+func TestLegacyStream(t *testing.T) {
+	sources := []string{
+		"",
+		`{"auth":"true"}`,
+		`{"auth":"true", "admin":true, "name":"Мамлеев Д.М"}`,
+		string(benchmarkPayload(20)),
+	}
+
+	for _, key := range []string{encryptKey, "0123456789abcdef", ""} {
+		for _, source := range sources {
+			encoded := bytes.Buffer{}
+			_, err := newLegacyEncoder(&encoded, key).Write([]byte(source))
+			assert.NoError(t, err)
+			assert.Equal(t, encode(key, source), encoded.String())
+
+			if key == "" {
+				continue
+			}
+
+			decoded, err := ioutil.ReadAll(newLegacyDecoder(iotest.OneByteReader(strings.NewReader(encoded.String()+"\r\n")), key))
+			assert.NoError(t, err)
+			assert.Equal(t, decode(key, encoded.String()), string(decoded))
+		}
+	}
+
+	_, err := ioutil.ReadAll(newLegacyDecoder(strings.NewReader("56205101zz"), encryptKey))
+	assert.ErrorIs(t, err, errCodecDecode)
+
+	_, err = ioutil.ReadAll(newLegacyDecoder(strings.NewReader("562051"), encryptKey))
+	assert.ErrorIs(t, err, errCodecDecode)
+
+	devices := make([]deviceSmartHome, 0)
+	reader, err := decodeStream(legacyCodec{key: encryptKey}, strings.NewReader(encode(encryptKey, string(benchmarkPayload(10)))))
+	assert.NoError(t, err)
+	assert.NoError(t, json.NewDecoder(reader).Decode(&devices))
+	assert.Equal(t, 10, len(devices))
+}
+
+// benchmarkPayload - ответ getalldevices с count устройствами
+func benchmarkPayload(count int) []byte {
+	devices := make([]deviceSmartHome, count)
+	for i := range devices {
+		devices[i].ID = i
+		devices[i].Guid = fmt.Sprintf("{96BFEAAC-57F3-490A-B47A-%012d}", i)
+		devices[i].Name = fmt.Sprintf("Свет %d", i)
+		devices[i].RoomName = "Гостиная"
+		devices[i].DeviceTypeName = "Свет"
+		devices[i].Active = 1
+		devices[i].Dimming = 1
+		devices[i].DimmingValue = i % 100
+	}
+
+	payload, _ := json.Marshal(devices)
+	return payload
+}
+
+func BenchmarkEncode(b *testing.B) {
+	source := string(benchmarkPayload(100))
+	b.SetBytes(int64(len(source)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		encode(encryptKey, source)
+	}
+}
+
+func BenchmarkLegacyEncoder(b *testing.B) {
+	source := benchmarkPayload(100)
+	encoded := bytes.Buffer{}
+	encoded.Grow(4 * len(source))
+	b.SetBytes(int64(len(source)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		encoded.Reset()
+		newLegacyEncoder(&encoded, encryptKey).Write(source)
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	source := encode(encryptKey, string(benchmarkPayload(100)))
+	b.SetBytes(int64(len(source)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		devices := make([]deviceSmartHome, 0)
+		json.Unmarshal([]byte(decode(encryptKey, source)), &devices)
+	}
+}
+
+func BenchmarkLegacyDecoder(b *testing.B) {
+	source := encode(encryptKey, string(benchmarkPayload(100)))
+	b.SetBytes(int64(len(source)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		devices := make([]deviceSmartHome, 0)
+		json.NewDecoder(newLegacyDecoder(strings.NewReader(source), encryptKey)).Decode(&devices)
+	}
+}
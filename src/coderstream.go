@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	hexUpper = "0123456789ABCDEF"
+	hexLower = "0123456789abcdef"
+)
+
+// legacyEncoder - потоковый encode: шифрует записанные байты и пишет результат в w.
+// На каждый байт исходника приходится 4 байта результата, вывод совпадает с encode побайтно
+type legacyEncoder struct {
+	w   io.Writer
+	key string
+	pos int
+	buf [1024]byte
+}
+
+func newLegacyEncoder(w io.Writer, key string) *legacyEncoder {
+	return &legacyEncoder{w: w, key: key}
+}
+
+func (e *legacyEncoder) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > len(e.buf)/4 {
+			chunk = chunk[:len(e.buf)/4]
+		}
+
+		j := 0
+		for _, b := range chunk {
+			j = e.put(j, hexUpper[b>>4])
+			j = e.put(j, hexUpper[b&0x0f])
+		}
+
+		if _, err := e.w.Write(e.buf[:j]); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// put шифрует одну шестнадцатеричную цифру исходника и кладет ее в буфер двумя символами
+func (e *legacyEncoder) put(j int, c byte) int {
+	if len(e.key) > 0 {
+		c ^= e.key[e.pos%len(e.key)]
+	}
+	e.pos++
+
+	e.buf[j] = hexLower[c>>4]
+	e.buf[j+1] = hexLower[c&0x0f]
+	return j + 2
+}
+
+// hexValues переводит шестнадцатеричную цифру в число, для остальных байт 0xff
+var hexValues = func() [256]byte {
+	var values [256]byte
+	for i := range values {
+		values[i] = 0xff
+	}
+	for i := 0; i < 16; i++ {
+		values[hexLower[i]] = byte(i)
+		values[hexUpper[i]] = byte(i)
+	}
+	return values
+}()
+
+// legacyDecoder - потоковый decode: читает шифровку из r и отдает исходные байты.
+// Пробельные символы в шифровке пропускаются, как после strings.TrimSpace
+type legacyDecoder struct {
+	r   io.Reader
+	key string
+	pos int
+	err error
+
+	// buf[start:end] - прочитанная, но еще не расшифрованная шифровка без пробелов
+	buf        [4096]byte
+	start, end int
+}
+
+func newLegacyDecoder(r io.Reader, key string) *legacyDecoder {
+	return &legacyDecoder{r: r, key: key}
+}
+
+func (d *legacyDecoder) Read(p []byte) (int, error) {
+	// Как и decode, без ключа ничего не расшифровывается
+	if len(d.key) == 0 {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) {
+		// Каждый байт исходника зашифрован четырьмя символами
+		for n < len(p) && d.end-d.start >= 4 {
+			hi, ok := d.digit(d.buf[d.start], d.buf[d.start+1])
+			if !ok {
+				return n, d.invalid()
+			}
+			lo, ok := d.digit(d.buf[d.start+2], d.buf[d.start+3])
+			if !ok {
+				return n, d.invalid()
+			}
+
+			p[n] = hi<<4 | lo
+			n++
+			d.start += 4
+		}
+
+		if n == len(p) {
+			break
+		}
+
+		if d.err != nil {
+			if d.err == io.EOF && d.end > d.start {
+				d.err = fmt.Errorf("%w: %v", errCodecDecode, io.ErrUnexpectedEOF)
+			}
+			return n, d.err
+		}
+
+		d.fill()
+	}
+
+	return n, nil
+}
+
+// digit расшифровывает одну шестнадцатеричную цифру исходника из двух символов шифровки
+func (d *legacyDecoder) digit(a byte, b byte) (byte, bool) {
+	hi, lo := hexValues[a], hexValues[b]
+	if hi == 0xff || lo == 0xff {
+		return 0, false
+	}
+
+	value := hexValues[(hi<<4|lo)^d.key[d.pos%len(d.key)]]
+	d.pos++
+
+	return value, value != 0xff
+}
+
+func (d *legacyDecoder) invalid() error {
+	d.err = errCodecDecode
+	d.start, d.end = 0, 0
+	return d.err
+}
+
+// fill дочитывает шифровку в буфер, выбрасывая пробельные символы
+func (d *legacyDecoder) fill() {
+	d.end = copy(d.buf[:], d.buf[d.start:d.end])
+	d.start = 0
+
+	read, err := d.r.Read(d.buf[d.end:])
+	for _, c := range d.buf[d.end : d.end+read] {
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		d.buf[d.end] = c
+		d.end++
+	}
+
+	d.err = err
+}
+
+// streamCodec - кодек, который расшифровывает ответ контроллера по мере чтения
+type streamCodec interface {
+	decoder(r io.Reader) io.Reader
+}
+
+func (c legacyCodec) decoder(r io.Reader) io.Reader {
+	return newLegacyDecoder(r, c.key)
+}
+
+// decodeStream возвращает расшифрованный ответ контроллера для json.Decoder.
+// Кодеки без потоковой расшифровки (AES-GCM проверяет тег только по всему сообщению)
+// читают ответ целиком
+func decodeStream(codec controllerCodec, r io.Reader) (io.Reader, error) {
+	if stream, ok := codec.(streamCodec); ok {
+		return stream.decoder(r), nil
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := codec.decode(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.NewReader(decoded), nil
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// config - настройки сервера. Источники по возрастанию приоритета: значения по умолчанию,
+// YAML файл (-config или CONFIG_FILE), переменные окружения, флаги командной строки
+type config struct {
+	Debug       bool              `yaml:"debug"`
+	Database    databaseConfig    `yaml:"database"`
+	HTTP        httpConfig        `yaml:"http"`
+	Controllers controllersConfig `yaml:"controllers"`
+	Poll        pollConfig        `yaml:"poll"`
+	Auth        authConfig        `yaml:"auth"`
+	Yandex      yandexConfig      `yaml:"yandex"`
+}
+
+type databaseConfig struct {
+	Directory      string        `yaml:"directory"`
+	BackupDir      string        `yaml:"backup_dir"`
+	BackupInterval time.Duration `yaml:"backup_interval"`
+	BackupRetain   int           `yaml:"backup_retain"`
+}
+
+type httpConfig struct {
+	Addr          string `yaml:"addr"`
+	HTTPS         bool   `yaml:"https"`
+	HTTPSAddr     string `yaml:"https_addr"`
+	CertDir       string `yaml:"cert_dir"`
+	AutocertEmail string `yaml:"autocert_email"`
+}
+
+type controllersConfig struct {
+	Timeout             time.Duration `yaml:"timeout"`
+	Rate                float64       `yaml:"rate"`
+	Concurrency         int           `yaml:"concurrency"`
+	ActionDeadline      time.Duration `yaml:"action_deadline"`
+	CommandTTL          time.Duration `yaml:"command_ttl"`
+	VerifyActions       bool          `yaml:"verify_actions"`
+	VerifyWindow        time.Duration `yaml:"verify_window"`
+	KeyGracePeriod      time.Duration `yaml:"key_grace_period"`
+	SecretsKey          string        `yaml:"secrets_key"`
+	SecretsPreviousKeys []string      `yaml:"secrets_previous_keys"`
+}
+
+type pollConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	Interval    time.Duration `yaml:"interval"`
+	Concurrency int           `yaml:"concurrency"`
+}
+
+type authConfig struct {
+	RequestTTL      time.Duration `yaml:"request_ttl"`
+	CodeTTL         time.Duration `yaml:"code_ttl"`
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl"`
+	TokenKey        string        `yaml:"token_key"`
+}
+
+type yandexConfig struct {
+	SkillID      string `yaml:"skill_id"`
+	SkillToken   string `yaml:"skill_token"`
+	ClientSecret string `yaml:"client_secret"`
+	RedirectURI  string `yaml:"redirect_uri"`
+}
+
+var (
+	httpAddr      = ":8080"
+	httpsAddr     = ":8443"
+	certDirectory = "/opt/certs"
+	autocertEmail = "info@msural.ru"
+	pollEnabled   = true
+
+	// secretsKey и secretsPreviousKeys - мастер-ключи секретов контроллеров, см. loadSecretKeyring
+	secretsKey          = ""
+	secretsPreviousKeys []string
+)
+
+// defaultConfig - значения по умолчанию, это начальные значения глобальных настроек
+func defaultConfig() config {
+	return config{
+		Debug: debug,
+		Database: databaseConfig{
+			Directory:      databaseDirectory,
+			BackupDir:      backupDirectory,
+			BackupInterval: backupInterval,
+			BackupRetain:   backupRetain,
+		},
+		HTTP: httpConfig{
+			Addr:          httpAddr,
+			HTTPS:         httpsEnabled,
+			HTTPSAddr:     httpsAddr,
+			CertDir:       certDirectory,
+			AutocertEmail: autocertEmail,
+		},
+		Controllers: controllersConfig{
+			Timeout:        timeout,
+			Rate:           dispatchRate,
+			Concurrency:    dispatchConcurrency,
+			ActionDeadline: actionDeadline,
+			CommandTTL:     commandTTL,
+			VerifyActions:  verifyActions,
+			VerifyWindow:   verifyWindow,
+			KeyGracePeriod: keyGracePeriod,
+		},
+		Poll: pollConfig{
+			Enabled:     pollEnabled,
+			Interval:    pollInterval,
+			Concurrency: pollConcurrency,
+		},
+		Auth: authConfig{
+			RequestTTL:      authRequestTTL,
+			CodeTTL:         authCodeTTL,
+			AccessTokenTTL:  accessTokenTTL,
+			RefreshTokenTTL: refreshTokenTTL,
+			TokenKey:        tokenHashKey,
+		},
+		Yandex: yandexConfig{
+			SkillID:      yandexSkillID,
+			SkillToken:   yandexSkillToken,
+			ClientSecret: yandexClientSecret,
+			RedirectURI:  yandexRedirectURI,
+		},
+	}
+}
+
+// setting - настройка, которую можно задать флагом и переменной окружения.
+// Пустое имя флага или переменной - источник не поддерживается
+type setting struct {
+	flag    string
+	env     string
+	usage   string
+	boolean bool
+	set     func(value string) error
+}
+
+func stringSetting(p *string) func(string) error {
+	return func(value string) error {
+		*p = value
+		return nil
+	}
+}
+
+func listSetting(p *[]string) func(string) error {
+	return func(value string) error {
+		*p = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*p = append(*p, item)
+			}
+		}
+		return nil
+	}
+}
+
+func intSetting(p *int) func(string) error {
+	return func(value string) (err error) {
+		*p, err = strconv.Atoi(value)
+		return err
+	}
+}
+
+func floatSetting(p *float64) func(string) error {
+	return func(value string) (err error) {
+		*p, err = strconv.ParseFloat(value, 64)
+		return err
+	}
+}
+
+func durationSetting(p *time.Duration) func(string) error {
+	return func(value string) (err error) {
+		*p, err = time.ParseDuration(value)
+		return err
+	}
+}
+
+// boolSetting - пустое значение означает true, как у флага без значения
+func boolSetting(p *bool, inverted bool) func(string) error {
+	return func(value string) error {
+		if value == "" {
+			value = "true"
+		}
+		parsed, err := strconv.ParseBool(value)
+		*p = parsed != inverted
+		return err
+	}
+}
+
+// presenceSetting - переменная окружения действует самим наличием, значение не важно:
+// HTTPS_DISABLED=false, как и раньше, отключает HTTPS
+func presenceSetting(p *bool, value bool) func(string) error {
+	return func(string) error {
+		*p = value
+		return nil
+	}
+}
+
+func (cfg *config) settings() []setting {
+	return []setting{
+		{"debug", "DEBUG", "log request and response bodies", true, boolSetting(&cfg.Debug, false)},
+		{"database-dir", "DATABASE_DIR", "directory of users.db", false, stringSetting(&cfg.Database.Directory)},
+		{"backup-dir", "BACKUP_DIR", "database backup directory, default <database-dir>/backups", false, stringSetting(&cfg.Database.BackupDir)},
+		{"backup-interval", "BACKUP_INTERVAL", "scheduled backup period, 0 disables", false, durationSetting(&cfg.Database.BackupInterval)},
+		{"backup-retain", "BACKUP_RETAIN", "number of backups to keep, 0 keeps all", false, intSetting(&cfg.Database.BackupRetain)},
+		{"http-addr", "HTTP_ADDR", "HTTP listen address", false, stringSetting(&cfg.HTTP.Addr)},
+		{"https", "", "serve HTTPS with autocert certificates", true, boolSetting(&cfg.HTTP.HTTPS, false)},
+		{"", "HTTPS_DISABLED", "", true, presenceSetting(&cfg.HTTP.HTTPS, false)},
+		{"https-addr", "HTTPS_ADDR", "HTTPS listen address", false, stringSetting(&cfg.HTTP.HTTPSAddr)},
+		{"cert-dir", "CERT_DIR", "autocert certificate cache directory", false, stringSetting(&cfg.HTTP.CertDir)},
+		{"autocert-email", "AUTOCERT_EMAIL", "contact email for the certificate authority", false, stringSetting(&cfg.HTTP.AutocertEmail)},
+		{"controller-timeout", "CONTROLLER_TIMEOUT", "controller request timeout", false, durationSetting(&cfg.Controllers.Timeout)},
+		{"controller-rate", "CONTROLLER_RATE", "commands per second per controller", false, floatSetting(&cfg.Controllers.Rate)},
+		{"controller-concurrency", "CONTROLLER_CONCURRENCY", "concurrent commands per controller", false, intSetting(&cfg.Controllers.Concurrency)},
+		{"action-deadline", "ACTION_DEADLINE", "deadline for actions before they are queued", false, durationSetting(&cfg.Controllers.ActionDeadline)},
+		{"command-ttl", "COMMAND_TTL", "lifetime of queued commands", false, durationSetting(&cfg.Controllers.CommandTTL)},
+		{"verify-actions", "", "read device state back after actions", true, boolSetting(&cfg.Controllers.VerifyActions, false)},
+		{"", "VERIFY_ACTIONS", "", true, presenceSetting(&cfg.Controllers.VerifyActions, true)},
+		{"verify-window", "VERIFY_WINDOW", "how long to wait for action verification", false, durationSetting(&cfg.Controllers.VerifyWindow)},
+		{"key-grace-period", "KEY_GRACE_PERIOD", "how long the previous controller key is accepted", false, durationSetting(&cfg.Controllers.KeyGracePeriod)},
+		{"", "CONTROLLER_SECRETS_KEY", "", false, stringSetting(&cfg.Controllers.SecretsKey)},
+		{"", "CONTROLLER_SECRETS_PREVIOUS_KEYS", "", false, listSetting(&cfg.Controllers.SecretsPreviousKeys)},
+		{"poll", "", "poll controller state in the background", true, boolSetting(&cfg.Poll.Enabled, false)},
+		{"", "POLL_DISABLED", "", true, presenceSetting(&cfg.Poll.Enabled, false)},
+		{"poll-interval", "POLL_INTERVAL", "controller poll period", false, durationSetting(&cfg.Poll.Interval)},
+		{"poll-concurrency", "POLL_CONCURRENCY", "controllers polled at once", false, intSetting(&cfg.Poll.Concurrency)},
+		{"auth-request-ttl", "AUTH_REQUEST_TTL", "lifetime of authorization requests", false, durationSetting(&cfg.Auth.RequestTTL)},
+		{"auth-code-ttl", "AUTH_CODE_TTL", "lifetime of authorization codes", false, durationSetting(&cfg.Auth.CodeTTL)},
+		{"access-token-ttl", "ACCESS_TOKEN_TTL", "lifetime of access tokens", false, durationSetting(&cfg.Auth.AccessTokenTTL)},
+		{"refresh-token-ttl", "REFRESH_TOKEN_TTL", "lifetime of refresh tokens", false, durationSetting(&cfg.Auth.RefreshTokenTTL)},
+		{"", "TOKEN_HASH_KEY", "", false, stringSetting(&cfg.Auth.TokenKey)},
+		{"yandex-skill-id", "YANDEX_SKILL_ID", "Yandex smart home skill id for state notifications", false, stringSetting(&cfg.Yandex.SkillID)},
+		{"", "YANDEX_SKILL_TOKEN", "", false, stringSetting(&cfg.Yandex.SkillToken)},
+		{"", "YANDEX_CLIENT_SECRET", "", false, stringSetting(&cfg.Yandex.ClientSecret)},
+		{"yandex-redirect-uri", "YANDEX_REDIRECT_URI", "redirect uri of the yandex OAuth client", false, stringSetting(&cfg.Yandex.RedirectURI)},
+	}
+}
+
+// flagValue откладывает значение флага, чтобы применить его после файла и окружения
+type flagValue struct {
+	value   *string
+	boolean bool
+}
+
+func (v flagValue) String() string {
+	if v.value == nil {
+		return ""
+	}
+	return *v.value
+}
+
+func (v flagValue) Set(value string) error {
+	*v.value = value
+	return nil
+}
+
+func (v flagValue) IsBoolFlag() bool {
+	return v.boolean
+}
+
+// loadConfig собирает настройки из файла, окружения и флагов args.
+// printConfig = true, если передан флаг -print-config
+func loadConfig(args []string) (cfg config, printConfig bool, err error) {
+	cfg = defaultConfig()
+	settings := cfg.settings()
+
+	flags := flag.NewFlagSet("bsh-backend", flag.ContinueOnError)
+	path := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	flags.BoolVar(&printConfig, "print-config", false, "print the effective configuration and exit")
+
+	values := make(map[int]*string)
+	for index, s := range settings {
+		if s.flag == "" {
+			continue
+		}
+		values[index] = new(string)
+		flags.Var(flagValue{value: values[index], boolean: s.boolean}, s.flag, s.usage)
+	}
+
+	if err = flags.Parse(args); err != nil {
+		return cfg, false, err
+	}
+	if flags.NArg() > 0 {
+		return cfg, false, fmt.Errorf("unexpected argument %s", flags.Arg(0))
+	}
+
+	if *path != "" {
+		data, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return cfg, false, err
+		}
+		if err = yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return cfg, false, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+
+	for _, s := range settings {
+		if s.env == "" {
+			continue
+		}
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err = s.set(value); err != nil {
+				return cfg, false, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for index, s := range settings {
+		if s.flag == "" || !set[s.flag] {
+			continue
+		}
+		if err = s.set(*values[index]); err != nil {
+			return cfg, false, fmt.Errorf("-%s: %w", s.flag, err)
+		}
+	}
+
+	return cfg, printConfig, cfg.validate()
+}
+
+func (cfg config) validate() error {
+	problems := make([]string, 0)
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	check(cfg.Database.Directory != "", "database.directory is empty")
+	check(cfg.Database.BackupInterval >= 0, "database.backup_interval is negative")
+	check(cfg.Database.BackupRetain >= 0, "database.backup_retain is negative")
+	check(cfg.HTTP.Addr != "", "http.addr is empty")
+	if cfg.HTTP.HTTPS {
+		check(cfg.HTTP.HTTPSAddr != "", "http.https_addr is empty")
+		check(cfg.HTTP.CertDir != "", "http.cert_dir is empty")
+		check(strings.Contains(cfg.HTTP.AutocertEmail, "@"), "http.autocert_email is not an email")
+	}
+	check(cfg.Controllers.Timeout >= time.Second, "controllers.timeout is less than 1s")
+	check(cfg.Controllers.Rate > 0, "controllers.rate must be positive")
+	check(cfg.Controllers.Concurrency > 0, "controllers.concurrency must be positive")
+	check(cfg.Controllers.ActionDeadline > 0, "controllers.action_deadline must be positive")
+	check(cfg.Controllers.CommandTTL > 0, "controllers.command_ttl must be positive")
+	check(cfg.Controllers.VerifyWindow > 0, "controllers.verify_window must be positive")
+	check(cfg.Controllers.KeyGracePeriod >= 0, "controllers.key_grace_period is negative")
+	if cfg.Controllers.SecretsKey != "" {
+		_, err := newSecretKeyring(cfg.Controllers.SecretsKey, cfg.Controllers.SecretsPreviousKeys)
+		check(err == nil, fmt.Sprintf("controllers.secrets_key: %v", err))
+	}
+	check(cfg.Poll.Interval > 0, "poll.interval must be positive")
+	check(cfg.Poll.Concurrency > 0, "poll.concurrency must be positive")
+	check(cfg.Auth.RequestTTL > 0, "auth.request_ttl must be positive")
+	check(cfg.Auth.CodeTTL > 0, "auth.code_ttl must be positive")
+	check(cfg.Auth.AccessTokenTTL >= time.Second, "auth.access_token_ttl must be at least 1s")
+	check(cfg.Auth.RefreshTokenTTL > cfg.Auth.AccessTokenTTL, "auth.refresh_token_ttl must be longer than auth.access_token_ttl")
+	if cfg.Auth.TokenKey != "" {
+		_, err := parseTokenKey(cfg.Auth.TokenKey)
+		check(err == nil, fmt.Sprintf("auth.token_key: %v", err))
+	}
+	check(cfg.Yandex.SkillID == "" || cfg.Yandex.SkillToken != "", "yandex.skill_token is required with yandex.skill_id")
+	if cfg.Yandex.ClientSecret != "" {
+		err := validateRedirectURI(cfg.Yandex.RedirectURI)
+		check(err == nil, fmt.Sprintf("yandex.redirect_uri: %v", err))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// apply переносит настройки в глобальные переменные, которыми пользуются обработчики
+func (cfg config) apply() {
+	debug = cfg.Debug
+	databaseDirectory = cfg.Database.Directory
+	backupDirectory = cfg.Database.BackupDir
+	backupInterval = cfg.Database.BackupInterval
+	backupRetain = cfg.Database.BackupRetain
+	httpAddr = cfg.HTTP.Addr
+	httpsEnabled = cfg.HTTP.HTTPS
+	httpsAddr = cfg.HTTP.HTTPSAddr
+	certDirectory = cfg.HTTP.CertDir
+	autocertEmail = cfg.HTTP.AutocertEmail
+	timeout = cfg.Controllers.Timeout
+	dispatchRate = cfg.Controllers.Rate
+	dispatchConcurrency = cfg.Controllers.Concurrency
+	actionDeadline = cfg.Controllers.ActionDeadline
+	commandTTL = cfg.Controllers.CommandTTL
+	verifyActions = cfg.Controllers.VerifyActions
+	verifyWindow = cfg.Controllers.VerifyWindow
+	keyGracePeriod = cfg.Controllers.KeyGracePeriod
+	secretsKey = cfg.Controllers.SecretsKey
+	secretsPreviousKeys = cfg.Controllers.SecretsPreviousKeys
+	pollEnabled = cfg.Poll.Enabled
+	pollInterval = cfg.Poll.Interval
+	pollConcurrency = cfg.Poll.Concurrency
+	authRequestTTL = cfg.Auth.RequestTTL
+	authCodeTTL = cfg.Auth.CodeTTL
+	accessTokenTTL = cfg.Auth.AccessTokenTTL
+	refreshTokenTTL = cfg.Auth.RefreshTokenTTL
+	tokenHashKey = cfg.Auth.TokenKey
+	yandexSkillID = cfg.Yandex.SkillID
+	yandexSkillToken = cfg.Yandex.SkillToken
+	yandexClientSecret = cfg.Yandex.ClientSecret
+	yandexRedirectURI = cfg.Yandex.RedirectURI
+}
+
+// print возвращает настройки в YAML, ключи секретов скрыты
+func (cfg config) print() (string, error) {
+	if cfg.Controllers.SecretsKey != "" {
+		cfg.Controllers.SecretsKey = "***"
+	}
+	previous := make([]string, len(cfg.Controllers.SecretsPreviousKeys))
+	for index := range previous {
+		previous[index] = "***"
+	}
+	cfg.Controllers.SecretsPreviousKeys = previous
+	if cfg.Auth.TokenKey != "" {
+		cfg.Auth.TokenKey = "***"
+	}
+	if cfg.Yandex.SkillToken != "" {
+		cfg.Yandex.SkillToken = "***"
+	}
+	if cfg.Yandex.ClientSecret != "" {
+		cfg.Yandex.ClientSecret = "***"
+	}
+
+	data, err := yaml.Marshal(cfg)
+	return string(data), err
+}
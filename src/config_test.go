@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := t.TempDir() + "/config.yaml"
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+database:
+  directory: /data
+  backup_retain: 3
+http:
+  addr: ":9090"
+poll:
+  interval: 1m
+  concurrency: 2
+`), 0600))
+
+	os.Setenv("CONFIG_FILE", path)
+	os.Setenv("POLL_INTERVAL", "45s")
+	os.Setenv("HTTPS_DISABLED", "false")
+	os.Setenv("VERIFY_ACTIONS", "0")
+	defer os.Unsetenv("CONFIG_FILE")
+	defer os.Unsetenv("POLL_INTERVAL")
+	defer os.Unsetenv("HTTPS_DISABLED")
+	defer os.Unsetenv("VERIFY_ACTIONS")
+
+	// Файл < окружение < флаги
+	cfg, printConfig, err := loadConfig([]string{"-poll-concurrency", "8", "-debug=false"})
+	require.NoError(t, err)
+	assert.False(t, printConfig)
+	assert.Equal(t, "/data", cfg.Database.Directory)
+	assert.Equal(t, 3, cfg.Database.BackupRetain)
+	assert.Equal(t, ":9090", cfg.HTTP.Addr)
+	assert.Equal(t, 45*time.Second, cfg.Poll.Interval)
+	assert.Equal(t, 8, cfg.Poll.Concurrency)
+	// Переменные HTTPS_DISABLED и VERIFY_ACTIONS действуют наличием, как до появления настроек
+	assert.False(t, cfg.HTTP.HTTPS)
+	assert.True(t, cfg.Controllers.VerifyActions)
+	assert.False(t, cfg.Debug)
+	assert.Equal(t, defaultConfig().Controllers.Timeout, cfg.Controllers.Timeout)
+
+	// Время ожидания контроллера не округляется до секунд
+	cfg, _, err = loadConfig([]string{"-controller-timeout", "2500ms"})
+	require.NoError(t, err)
+	previous := defaultConfig()
+	cfg.apply()
+	assert.Equal(t, 2500*time.Millisecond, timeout)
+	previous.apply()
+
+	_, printConfig, err = loadConfig([]string{"--print-config", "-https"})
+	require.NoError(t, err)
+	assert.True(t, printConfig)
+
+	_, _, err = loadConfig([]string{"-poll-interval", "soon"})
+	assert.Error(t, err)
+
+	_, _, err = loadConfig([]string{"-controller-timeout", "100ms", "-poll-concurrency", "0"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "controllers.timeout")
+	assert.Contains(t, err.Error(), "poll.concurrency")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("database:\n  dir: /data\n"), 0600))
+	_, _, err = loadConfig(nil)
+	assert.Error(t, err)
+}
+
+func TestPrintConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Controllers.SecretsKey = testMasterKey
+	cfg.Controllers.SecretsPreviousKeys = []string{testNewMasterKey}
+	cfg.Auth.TokenKey = testMasterKey
+	require.NoError(t, cfg.validate())
+
+	out, err := cfg.print()
+	require.NoError(t, err)
+	assert.NotContains(t, out, testMasterKey)
+	assert.NotContains(t, out, testNewMasterKey)
+
+	// Напечатанные настройки читаются обратно как файл настроек
+	var printed config
+	require.NoError(t, yaml.UnmarshalStrict([]byte(out), &printed))
+	assert.Equal(t, cfg.Poll, printed.Poll)
+	assert.Equal(t, "***", printed.Auth.TokenKey)
+	printed.Auth.TokenKey = cfg.Auth.TokenKey
+	assert.Equal(t, cfg.Auth, printed.Auth)
+	assert.Equal(t, testMasterKey, cfg.Controllers.SecretsKey)
+}
@@ -1,24 +1,161 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 )
 
 type controller struct {
-	ID       int    `json:"id"`
-	Name     string `json:"name"`
-	Password string `json:"password"`
-	URI      string `json:"uri"`
+	ID           int               `json:"id"`
+	Name         string            `json:"name"`
+	Password     string            `json:"password,omitempty"`
+	URI          string            `json:"uri"`
+	CodecVersion int               `json:"codec_version"`
+	CodecKey     string            `json:"codec_key,omitempty"`
+	PasswordSet  bool              `json:"password_set"`
+	CodecKeySet  bool              `json:"codec_key_set"`
+	Driver       string            `json:"driver,omitempty"`
+	DriverConfig json.RawMessage   `json:"driver_config,omitempty"`
+	Verified     bool              `json:"verified"`
+	Breaker      string            `json:"breaker,omitempty"`
+	Health       *controllerHealth `json:"health,omitempty"`
+}
+
+// MarshalJSON не выводит пароль и ключ кодека: они только принимаются в запросах
+func (c controller) MarshalJSON() ([]byte, error) {
+	type plain controller
+	out := plain(c)
+	out.Password = ""
+	out.CodecKey = ""
+	return json.Marshal(out)
+}
+
+// validateControllerURI проверяет, что uri контроллера - абсолютный http адрес без параметров
+// или modbus://host[:port]. tunnel:// задается только переводом контроллера на туннель
+func validateControllerURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("invalid uri: %v", err)
+	}
+
+	if u.Scheme == driverModbus {
+		if u.Host == "" {
+			return errors.New("invalid uri: host is empty")
+		}
+		return nil
+	}
+
+	if u.Scheme == tunnelScheme {
+		return errors.New("invalid uri: tunnel uri is set by POST /controllers/{id}/tunnel")
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("invalid uri: scheme must be http, https or modbus")
+	}
+
+	if u.Host == "" {
+		return errors.New("invalid uri: host is empty")
+	}
+
+	if u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("invalid uri: query and fragment are not allowed")
+	}
+
+	return nil
+}
+
+// validateControllerCodec проверяет версию кодека и ключ. Версия 0 означает автоматический выбор
+func validateControllerCodec(version int, key string) error {
+	switch version {
+	case 0:
+		if key == "" {
+			return nil
+		}
+		_, err := newCodec(codecAESGCM, key)
+		return err
+	case codecLegacy:
+		return nil
+	case codecAESGCM:
+		if key == "" {
+			return errors.New("codec_key is required for codec_version 2")
+		}
+		_, err := newCodec(codecAESGCM, key)
+		return err
+	}
+
+	return fmt.Errorf("unknown codec_version %d", version)
+}
+
+// verifyController проверяет uri и доступность контроллера с переданными учетными данными.
+// Если проверка не прошла, пишет ответ с описанием ошибки и возвращает ok = false.
+// С параметром unverified=true недоступный контроллер сохраняется непроверенным.
+// При автоматическом выборе кодека в cntl записывается версия, на которую ответил контроллер,
+// переход с переданным ключом на legacy только с параметром allow_legacy=true.
+// Контроллеры с другим драйвером проверяются чтением состояния через драйвер.
+// current - сохраненный uri контроллера: tunnel:// принимается, только если он не меняется
+func verifyController(w http.ResponseWriter, r *http.Request, cntl *controller, current string) (verified bool, ok bool) {
+	ctx := r.Context()
+
+	if cntl.Driver == "" {
+		cntl.Driver = driverHTTP
+	}
+
+	var driver controllerDriver
+	var err error
+	if cntl.ID == 0 || cntl.URI != tunnelURI(cntl.ID) || current != cntl.URI {
+		err = validateControllerURI(cntl.URI)
+	}
+	if err == nil && cntl.Driver == driverHTTP {
+		err = validateControllerCodec(cntl.CodecVersion, cntl.CodecKey)
+	} else if err == nil {
+		driver, err = controllerRow{ID: cntl.ID, URI: cntl.URI, Driver: cntl.Driver, DriverConfig: string(cntl.DriverConfig)}.driver()
+	}
+	if err != nil {
+		msu.Warn(ctx, err, zap.Any("uri", r.RequestURI), zap.String("controller", cntl.URI))
+		result, _ := json.Marshal(struct {
+			Error string `json:"error"`
+		}{Error: err.Error()})
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, string(result))
+		return false, false
+	}
+
+	var probe controllerTestResult
+	if driver != nil {
+		cntl.CodecVersion = codecLegacy
+		cntl.CodecKey = ""
+		probe = probeDriver(ctx, cntl.ID, driver, cntl.URI)
+	} else {
+		var version int
+		version, probe = negotiateCodec(ctx, cntl.ID, cntl.Name, cntl.Password, cntl.URI, cntl.CodecVersion, cntl.CodecKey,
+			r.URL.Query().Get("allow_legacy") == "true")
+		if cntl.CodecVersion == 0 && version == codecLegacy {
+			cntl.CodecKey = ""
+		}
+		cntl.CodecVersion = version
+	}
+	if probe.OK {
+		return true, true
+	}
+
+	msu.Warn(ctx, errors.New(probe.Error), zap.Any("uri", r.RequestURI), zap.String("controller", cntl.URI))
+	if r.URL.Query().Get("unverified") == "true" {
+		return false, true
+	}
+
+	result, _ := json.Marshal(probe)
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	fmt.Fprint(w, string(result))
+	return false, false
 }
 
 func getControllers(w http.ResponseWriter, r *http.Request) {
@@ -35,11 +172,12 @@ func getControllers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var rows *sql.Rows
-	var err error
-
-	cnt := 0
-	if err := db.QueryRowContext(ctx, `SELECT count(id) FROM users WHERE app_token = $1`, token).Scan(&cnt); err != nil {
+	user, err := store.userByAppToken(ctx, token)
+	if err == errNotFound {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
@@ -49,16 +187,8 @@ func getControllers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if cnt == 0 {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	controllers := make([]controller, 0)
-
-	if rows, err = db.QueryContext(ctx,
-		`SELECT id, name, password, uri FROM controllers WHERE user_id IN (SELECT id FROM users WHERE app_token = $1)`,
-		token); err != nil {
+	rows, err := store.userControllers(ctx, user.ID)
+	if err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
@@ -67,28 +197,10 @@ func getControllers(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var id int
-		var name, password, uri string
 
-		if err = rows.Scan(&id, &name, &password, &uri); err != nil {
-			msu.Error(ctx,
-				err,
-				zap.Any("uri", r.RequestURI),
-				zap.Any("query", r.URL.Query()),
-				zap.Any("AuthHeader", r.Header.Get("Authorization")))
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		controllers = append(controllers, controller{
-			ID:       id,
-			Name:     name,
-			Password: password,
-			URI:      uri,
-		})
+	controllers := make([]controller, 0, len(rows))
+	for _, row := range rows {
+		controllers = append(controllers, controllerResponse(row))
 	}
 
 	var result []byte
@@ -121,8 +233,12 @@ func getController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cnt := 0
-	if err := db.QueryRowContext(ctx, `SELECT count(id) FROM users WHERE app_token = $1`, token).Scan(&cnt); err != nil {
+	user, err := store.userByAppToken(ctx, token)
+	if err == errNotFound {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
@@ -132,11 +248,6 @@ func getController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if cnt == 0 {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
 	vars := mux.Vars(r)
 
 	id, err := toInt(vars, "id")
@@ -146,13 +257,12 @@ func getController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var rows *sql.Rows
-
-	cntl := controller{}
-
-	if rows, err = db.QueryContext(ctx,
-		`SELECT id, name, password, uri FROM controllers WHERE user_id IN (SELECT id FROM users WHERE app_token = $1) AND id = $2`,
-		token, id); err != nil {
+	row, err := store.userController(ctx, user.ID, id)
+	if err == errNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
@@ -161,32 +271,7 @@ func getController(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	if rows.Next() {
-		var id int
-		var name, password, uri string
-
-		if err = rows.Scan(&id, &name, &password, &uri); err != nil {
-			msu.Error(ctx,
-				err,
-				zap.Any("uri", r.RequestURI),
-				zap.Any("query", r.URL.Query()),
-				zap.Any("AuthHeader", r.Header.Get("Authorization")))
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		cntl = controller{
-			ID:       id,
-			Name:     name,
-			Password: password,
-			URI:      uri,
-		}
-	} else {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
+	cntl := controllerResponse(row)
 
 	var result []byte
 
@@ -218,8 +303,8 @@ func createController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user_id := 0
-	if err := db.QueryRowContext(ctx, `SELECT id FROM users WHERE app_token = $1`, token).Scan(&user_id); err != nil {
+	user, err := store.userByAppToken(ctx, token)
+	if err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
@@ -229,7 +314,6 @@ func createController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var err error
 	var body []byte
 	if body, err = ioutil.ReadAll(r.Body); err != nil {
 		msu.Error(ctx,
@@ -253,26 +337,99 @@ func createController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mutex := sync.Mutex{}
+	cntl.ID = 0
+	verified, ok := verifyController(w, r, &cntl, "")
+	if !ok {
+		return
+	}
+	cntl.Verified = verified
 
-	mutex.Lock()
-	defer mutex.Unlock()
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{})
-	if err != nil {
+	if _, err = store.createController(ctx, controllerRow{
+		UserID:       user.ID,
+		Name:         cntl.Name,
+		Password:     cntl.Password,
+		URI:          cntl.URI,
+		CodecVersion: cntl.CodecVersion,
+		CodecKey:     cntl.CodecKey,
+		Driver:       cntl.Driver,
+		DriverConfig: string(cntl.DriverConfig),
+		Verified:     cntl.Verified,
+	}); err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
 			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	defer tx.Rollback()
 
-	if _, err = tx.ExecContext(ctx,
-		`INSERT INTO controllers (user_id, name, password, uri) VALUES ($1, $2, $3, $4)`,
-		user_id, cntl.Name, cntl.Password, cntl.URI); err != nil {
+	w.WriteHeader(http.StatusCreated)
+}
+
+func updateController(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var token string
+	tokenInfo := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(tokenInfo) == 2 {
+		token = tokenInfo[1]
+	} else {
+		msu.Error(ctx,
+			errors.New("invalid AuthHeader len"),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := store.userByAppToken(ctx, token)
+	if err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	id, err := toInt(vars, "id")
+	if err != nil {
+		msu.Warn(ctx, err, zap.Any("vars", vars))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var body []byte
+	if body, err = ioutil.ReadAll(r.Body); err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	cntl := controller{}
+	if err = json.Unmarshal(body, &cntl); err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	existing, err := store.userController(ctx, user.ID, id)
+	if err == errNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
@@ -282,7 +439,37 @@ func createController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = tx.Commit(); err != nil {
+	// Пароль и ключ только заменяются: не переданные остаются прежними
+	if cntl.Password == "" {
+		cntl.Password = existing.Password
+	}
+	if cntl.CodecKey == "" {
+		cntl.CodecKey = existing.CodecKey
+	}
+
+	cntl.ID = id
+	verified, ok := verifyController(w, r, &cntl, existing.URI)
+	if !ok {
+		return
+	}
+	cntl.Verified = verified
+
+	if err = store.updateController(ctx, controllerRow{
+		ID:           id,
+		UserID:       user.ID,
+		Name:         cntl.Name,
+		Password:     cntl.Password,
+		URI:          cntl.URI,
+		CodecVersion: cntl.CodecVersion,
+		CodecKey:     cntl.CodecKey,
+		Driver:       cntl.Driver,
+		DriverConfig: string(cntl.DriverConfig),
+		Verified:     cntl.Verified,
+	}); err != nil {
+		if err == errNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
@@ -292,10 +479,10 @@ func createController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(http.StatusOK)
 }
 
-func updateController(w http.ResponseWriter, r *http.Request) {
+func deleteController(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	var token string
 	tokenInfo := strings.Split(r.Header.Get("Authorization"), " ")
@@ -309,8 +496,8 @@ func updateController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user_id := 0
-	if err := db.QueryRowContext(ctx, `SELECT id FROM users WHERE app_token = $1`, token).Scan(&user_id); err != nil {
+	user, err := store.userByAppToken(ctx, token)
+	if err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
@@ -328,50 +515,69 @@ func updateController(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-
-	var body []byte
-	if body, err = ioutil.ReadAll(r.Body); err != nil {
+	if err = store.deleteController(ctx, user.ID, id); err != nil {
+		if err == errNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
 			zap.Any("query", r.URL.Query()),
 			zap.Any("AuthHeader", r.Header.Get("Authorization")))
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	defer r.Body.Close()
+	breakers.remove(id)
+	health.remove(id)
 
-	cntl := controller{}
-	if err = json.Unmarshal(body, &cntl); err != nil {
+	w.WriteHeader(http.StatusOK)
+}
+
+func testController(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var token string
+	tokenInfo := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(tokenInfo) == 2 {
+		token = tokenInfo[1]
+	} else {
 		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
+			errors.New("invalid AuthHeader len"),
 			zap.Any("AuthHeader", r.Header.Get("Authorization")))
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	mutex := sync.Mutex{}
-
-	mutex.Lock()
-	defer mutex.Unlock()
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{})
+	user, err := store.userByAppToken(ctx, token)
+	if err == errNotFound {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 	if err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
 			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	defer tx.Rollback()
 
-	if _, err = tx.ExecContext(ctx,
-		`UPDATE controllers SET name = $1, password = $2, uri = $3 WHERE id = $4`,
-		cntl.Name, cntl.Password, cntl.URI, id); err != nil {
+	vars := mux.Vars(r)
+
+	id, err := toInt(vars, "id")
+	if err != nil {
+		msu.Warn(ctx, err, zap.Any("vars", vars))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	cntl, err := store.userController(ctx, user.ID, id)
+	if err == errNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
@@ -381,7 +587,28 @@ func updateController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = tx.Commit(); err != nil {
+	var probe controllerTestResult
+	if cntl.Driver == driverHTTP {
+		_, probe = negotiateCodec(ctx, cntl.ID, cntl.Name, cntl.Password, cntl.URI, cntl.CodecVersion, cntl.CodecKey, false)
+	} else if d, err := cntl.driver(); err != nil {
+		probe = controllerTestResult{Stage: "connection", Error: err.Error()}
+	} else {
+		probe = probeDriver(ctx, cntl.ID, d, cntl.URI)
+	}
+
+	if probe.OK {
+		if err = store.setControllerVerified(ctx, id, true); err != nil {
+			msu.Error(ctx,
+				err,
+				zap.Any("uri", r.RequestURI),
+				zap.Any("query", r.URL.Query()),
+				zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		}
+	}
+
+	var result []byte
+
+	if result, err = json.Marshal(probe); err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
@@ -392,9 +619,10 @@ func updateController(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(result))
 }
 
-func deleteController(w http.ResponseWriter, r *http.Request) {
+func rotateControllerKey(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	var token string
 	tokenInfo := strings.Split(r.Header.Get("Authorization"), " ")
@@ -408,14 +636,18 @@ func deleteController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user_id := 0
-	if err := db.QueryRowContext(ctx, `SELECT id FROM users WHERE app_token = $1`, token).Scan(&user_id); err != nil {
+	user, err := store.userByAppToken(ctx, token)
+	if err == errNotFound {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
 			zap.Any("query", r.URL.Query()),
 			zap.Any("AuthHeader", r.Header.Get("Authorization")))
-		w.WriteHeader(http.StatusUnauthorized)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
@@ -427,11 +659,12 @@ func deleteController(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	mutex := sync.Mutex{}
 
-	mutex.Lock()
-	defer mutex.Unlock()
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{})
+	cntl, err := store.userController(ctx, user.ID, id)
+	if err == errNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		msu.Error(ctx,
 			err,
@@ -441,9 +674,154 @@ func deleteController(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	defer tx.Rollback()
 
-	if _, err = tx.ExecContext(ctx, `DELETE FROM controllers WHERE id = $1`, id); err != nil {
+	// Прошлая смена могла дойти до контроллера без подтверждения: если он уже отвечает
+	// ожидающим ключом, смена просто завершается
+	rotated := time.Now()
+	committed := false
+	if cntl.PendingKey != "" {
+		if pending, err := newCodec(cntl.CodecVersion, cntl.PendingKey); err == nil {
+			committed = probeController(ctx, cntl.ID, cntl.Name, cntl.Password, cntl.URI, pending).OK
+		}
+	}
+
+	if !committed {
+		if until, ok := keyGraceUntil(cntl.RotatedAt); ok && time.Now().Before(until) {
+			result, _ := json.Marshal(struct {
+				Error string `json:"error"`
+			}{Error: fmt.Sprintf("previous key is still accepted until %s, rotate after it expires", until.Format(time.RFC3339))})
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, string(result))
+			return
+		}
+
+		codec, err := controllerCodecFor(cntl.CodecVersion, cntl.CodecKey, cntl.PreviousKey, cntl.RotatedAt)
+		if err != nil {
+			msu.Error(ctx, err, zap.Any("uri", r.RequestURI))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if usesSharedKey(codec) {
+			result, _ := json.Marshal(struct {
+				Error string `json:"error"`
+			}{Error: errSharedKeyRotation.Error()})
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, string(result))
+			return
+		}
+
+		key, err := generateCodecKey(cntl.CodecVersion)
+		if err != nil {
+			msu.Error(ctx, err, zap.Any("uri", r.RequestURI))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Ключ сохраняется до отправки: если контроллер примет его, а ответ потеряется,
+		// ключ не пропадет и повторный запрос завершит смену
+		if err = store.setPendingControllerKey(ctx, id, key); err != nil {
+			msu.Error(ctx,
+				err,
+				zap.Any("uri", r.RequestURI),
+				zap.Any("query", r.URL.Query()),
+				zap.Any("AuthHeader", r.Header.Get("Authorization")))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if err = requestKeyRotation(ctx, cntl.Name, cntl.Password, cntl.URI, codec, key); err != nil {
+			msu.Warn(ctx, err, zap.Any("uri", r.RequestURI), zap.String("controller", cntl.URI))
+			if errors.Is(err, errKeyRejected) {
+				if err := store.setPendingControllerKey(ctx, id, ""); err != nil {
+					msu.Error(ctx, err, zap.Any("uri", r.RequestURI))
+				}
+			}
+			result, _ := json.Marshal(struct {
+				Error string `json:"error"`
+			}{Error: err.Error()})
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(w, string(result))
+			return
+		}
+	}
+
+	if err = store.commitControllerKey(ctx, id, rotated); err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var result []byte
+
+	if result, err = json.Marshal(struct {
+		CodecVersion       int       `json:"codec_version"`
+		PreviousValidUntil time.Time `json:"previous_key_valid_until"`
+	}{
+		CodecVersion:       cntl.CodecVersion,
+		PreviousValidUntil: rotated.Add(keyGracePeriod),
+	}); err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(result))
+}
+
+// enableControllerTunnel переводит контроллер на связь через агента: uri становится tunnel://<id>,
+// а в ответе возвращается токен, с которым агент подключается к /tunnel
+func enableControllerTunnel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var token string
+	tokenInfo := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(tokenInfo) == 2 {
+		token = tokenInfo[1]
+	} else {
+		msu.Error(ctx,
+			errors.New("invalid AuthHeader len"),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := store.userByAppToken(ctx, token)
+	if err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	id, err := toInt(vars, "id")
+	if err != nil {
+		msu.Warn(ctx, err, zap.Any("vars", vars))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	uri := tunnelURI(id)
+	tunnelToken := generateUUID()
+
+	if err = store.setControllerTunnel(ctx, user.ID, id, uri, tunnelToken); err != nil {
+		if err == errNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
@@ -453,7 +831,15 @@ func deleteController(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = tx.Commit(); err != nil {
+	var result []byte
+
+	if result, err = json.Marshal(struct {
+		URI         string `json:"uri"`
+		TunnelToken string `json:"tunnel_token"`
+	}{
+		URI:         uri,
+		TunnelToken: tunnelToken,
+	}); err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
@@ -464,4 +850,32 @@ func deleteController(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(result))
+}
+
+// controllerResponse собирает ответ API по строке контроллера с текущим состоянием связи.
+// Пароль и ключ не возвращаются, в ответе только признак, что они заданы
+func controllerResponse(cntl controllerRow) controller {
+	return controller{
+		ID:           cntl.ID,
+		Name:         cntl.Name,
+		URI:          cntl.URI,
+		CodecVersion: cntl.CodecVersion,
+		PasswordSet:  cntl.Password != "",
+		CodecKeySet:  cntl.CodecKey != "",
+		Driver:       cntl.Driver,
+		DriverConfig: rawConfig(cntl.DriverConfig),
+		Verified:     cntl.Verified,
+		Breaker:      breakers.state(cntl.ID).String(),
+		Health:       health.get(cntl.ID),
+	}
+}
+
+// rawConfig возвращает driver_config из базы как JSON для ответа
+func rawConfig(config string) json.RawMessage {
+	if config == "" {
+		return nil
+	}
+
+	return json.RawMessage(config)
 }
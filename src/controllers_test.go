@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateControllerURI(t *testing.T) {
+	assert.NoError(t, validateControllerURI("http://188.226.37.223:9010"))
+	assert.NoError(t, validateControllerURI("https://home.example.com"))
+	assert.NoError(t, validateControllerURI("modbus://192.168.1.20"))
+
+	assert.Error(t, validateControllerURI(""))
+	assert.Error(t, validateControllerURI("188.226.37.223:9010"))
+	assert.Error(t, validateControllerURI("ftp://188.226.37.223"))
+	assert.Error(t, validateControllerURI("http://"))
+	assert.Error(t, validateControllerURI("tunnel://home"))
+	assert.Error(t, validateControllerURI("tunnel://5"))
+	assert.Error(t, validateControllerURI("modbus://"))
+	assert.Error(t, validateControllerURI("http://188.226.37.223:9010?getalldevices=1"))
+}
+
+func TestControllerSecretsNotSerialized(t *testing.T) {
+	result, err := json.Marshal(controller{ID: 1, Password: "secret", CodecKey: "00ff", PasswordSet: true, CodecKeySet: true})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(result), "secret")
+	assert.NotContains(t, string(result), "codec_key\"")
+	assert.Contains(t, string(result), `"codec_key_set":true`)
+
+	// Во входящих запросах пароль и ключ по-прежнему принимаются
+	var cntl controller
+	assert.NoError(t, json.Unmarshal([]byte(`{"password":"secret","codec_key":"00ff"}`), &cntl))
+	assert.Equal(t, "secret", cntl.Password)
+	assert.Equal(t, "00ff", cntl.CodecKey)
+}
@@ -3,61 +3,93 @@ package main
 import (
 	"context"
 	"database/sql"
-	"os"
 
 	"go.uber.org/zap"
 )
 
+// initializeDB создает базу или доводит ее схему до последней миграции.
+// Перед любым изменением существующей базы, включая принятие базы без миграций,
+// ее копия сохраняется в каталог копий
 func initializeDB(c context.Context, path string) error {
 	ctx := c
 	msu.Info(ctx, zap.Any("initializeDB", path))
-	// If file exists than ok - exit without errors
-	if _, err := os.Stat(path); err == nil {
-		return nil
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
 	}
+	defer db.Close()
 
-	msu.Info(ctx, zap.Any("database", "creating new"))
-	if _, err := os.Create(path); err != nil {
+	migrations, err := loadMigrations()
+	if err != nil {
 		return err
 	}
 
-	// Initialize database
-	db, err := sql.Open("sqlite3", path)
+	applied, legacy, err := inspectDatabase(ctx, db)
 	if err != nil {
-		msu.Fatal(context.Background(), err)
+		return err
+	}
+	if legacy || (len(applied) > 0 && len(applied) != len(migrations)) {
+		backup, err := backupDatabase(ctx, db)
+		if err != nil {
+			return err
+		}
+		msu.Info(ctx, zap.Any("database", "backup"), zap.Int("version", schemaVersion(applied)), zap.String("path", backup))
+	}
+
+	if err = ensureMigrationsTable(ctx, db); err != nil {
+		return err
+	}
+	if err = adoptLegacyDatabase(ctx, db); err != nil {
+		return err
 	}
-	defer db.Close()
 
-	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS users (
-		id             INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
-		name           TEXT    NOT NULL,
-		password       TEXT NOT NULL,
-		yandex_code    TEXT,
-		yandex_token   TEXT, 
-		app_token      TEXT)`); err != nil {
-		os.Remove(path)
+	if _, err = migrationStatus(ctx, db, migrations); err != nil {
 		return err
 	}
 
-	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS controllers (
-		id             INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
-		user_id        INTEGER NOT NULL, 
-		name           TEXT    NOT NULL,
-		password       TEXT NOT NULL,
-		uri            TEXT, 
-		FOREIGN KEY(user_id) REFERENCES users(id))`); err != nil {
-		os.Remove(path)
+	applied, err = appliedMigrations(ctx, db)
+	if err != nil {
 		return err
 	}
 
-	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS auth_requests (
-		id TEXT NOT NULL, 
-		request TEXT NOT NULL, 
-		dt TEXT NOT NULL)`); err != nil {
-		os.Remove(path)
+	version := schemaVersion(applied)
+	if len(applied) == len(migrations) {
+		return nil
+	}
+
+	if err = migrateUp(ctx, db, migrations, len(migrations)); err != nil {
 		return err
 	}
 
-	msu.Info(ctx, zap.Any("database", "created"))
+	msu.Info(ctx, zap.Any("database", "migrated"), zap.Int("from", version), zap.Int("to", len(migrations)))
 	return nil
 }
+
+func addColumn(c context.Context, db *sql.DB, table string, column string, definition string) error {
+	ctx := c
+
+	rows, err := db.QueryContext(ctx, `SELECT name FROM pragma_table_info($1)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	msu.Info(ctx, zap.Any("database", "add column "+table+"."+column))
+	_, err = db.ExecContext(ctx, `ALTER TABLE `+table+` ADD COLUMN `+column+` `+definition)
+	return err
+}
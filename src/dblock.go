@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errDatabaseLocked = errors.New("database is in use, stop the server first")
+
+// lockDatabase берет исключительную блокировку <база>.lock. Сервер держит ее все время работы,
+// команды, заменяющие файл базы или меняющие схему, без нее не выполняются.
+// Блокировка снимается и при падении процесса
+func lockDatabase(dbPath string) (func(), error) {
+	file, err := os.OpenFile(dbPath+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errDatabaseLocked
+		}
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+type deviceID struct {
+	ID           string `json:"id"`
+	ControllerID int    `json:"controller_id"`
+	Guid         string `json:"guid"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// assignDeviceIDs проставляет устройствам контроллера внешние id. Незнакомый guid получает id, равный guid:
+// так Яндекс видел устройства раньше, и связанные устройства сохраняют id. Случайный id выдается,
+// только если guid уже занят другим контроллером, например с клонированным конфигом
+func assignDeviceIDs(c context.Context, controllerID int, devices []deviceSmartHome) error {
+	ctx := c
+
+	known, err := store.deviceIDs(ctx, controllerID)
+	if err != nil {
+		return err
+	}
+
+	ids := make(map[string]string, len(known))
+	for _, device := range known {
+		ids[device.Guid] = device.ID
+	}
+
+	for index := range devices {
+		guid := devices[index].Guid
+		if _, ok := ids[guid]; !ok && guid != "" {
+			id, err := store.assignDeviceID(ctx, controllerID, guid, guid)
+			if err == errDeviceIDTaken {
+				id, err = store.assignDeviceID(ctx, controllerID, guid, generateUUID())
+			}
+			if err != nil {
+				return err
+			}
+			ids[guid] = id
+		}
+
+		devices[index].externalID = ids[guid]
+	}
+
+	return nil
+}
+
+// getDeviceIDs возвращает внешние id устройств контроллера, включая id guid, которых больше нет на контроллере
+func getDeviceIDs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var token string
+	tokenInfo := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(tokenInfo) == 2 {
+		token = tokenInfo[1]
+	} else {
+		msu.Error(ctx,
+			errors.New("invalid AuthHeader len"),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := store.userByAppToken(ctx, token)
+	if err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	id, err := toInt(vars, "id")
+	if err != nil {
+		msu.Warn(ctx, err, zap.Any("vars", vars))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, err = store.userController(ctx, user.ID, id); err != nil {
+		if err == errNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ids, err := store.deviceIDs(ctx, id)
+	if err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var result []byte
+
+	if result, err = json.Marshal(ids); err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(result))
+}
+
+// rebindDeviceID привязывает внешний id к другому guid того же контроллера, например после перепрошивки.
+// id, выданный новому guid автоматически, удаляется
+func rebindDeviceID(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var token string
+	tokenInfo := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(tokenInfo) == 2 {
+		token = tokenInfo[1]
+	} else {
+		msu.Error(ctx,
+			errors.New("invalid AuthHeader len"),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := store.userByAppToken(ctx, token)
+	if err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	id, err := toInt(vars, "id")
+	if err != nil {
+		msu.Warn(ctx, err, zap.Any("vars", vars))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	externalID := vars["device_id"]
+
+	var binding struct {
+		Guid string `json:"guid"`
+	}
+	if err = json.NewDecoder(r.Body).Decode(&binding); err != nil || binding.Guid == "" {
+		if err == nil {
+			err = errors.New("guid is empty")
+		}
+		msu.Warn(ctx, err, zap.Any("uri", r.RequestURI))
+		result, _ := json.Marshal(struct {
+			Error string `json:"error"`
+		}{Error: err.Error()})
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, string(result))
+		return
+	}
+
+	device, err := store.rebindDeviceID(ctx, user.ID, id, externalID, binding.Guid)
+	if err != nil {
+		if err == errNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var result []byte
+
+	if result, err = json.Marshal(device); err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(result))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+)
+
+func TestDeviceIDs(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	path := t.TempDir() + "/users.db"
+	require.NoError(t, initializeDB(context.Background(), path))
+
+	var err error
+	db, err = sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer db.Close()
+	store = newSQLiteStorage(db, nil, []byte(testTokenKey))
+
+	_, err = db.Exec(`INSERT INTO users (id, name, password) VALUES (1, 'user', '')`)
+	require.NoError(t, err)
+	require.NoError(t, store.setAppToken(context.Background(), 1, "token"))
+	_, err = db.Exec(`INSERT INTO controllers (id, user_id, name, password, uri) VALUES (1, 1, '11', '11', 'http://127.0.0.1:1'), (2, 1, '11', '11', 'http://127.0.0.1:2')`)
+	require.NoError(t, err)
+
+	// Клонированный конфиг: одинаковые guid на двух контроллерах, у штор guid общий на две линии
+	first := []deviceSmartHome{{ID: 1, Guid: "{A}"}, {ID: 2, Guid: "{B}"}, {ID: 3, Guid: "{B}"}}
+	second := []deviceSmartHome{{ID: 1, Guid: "{A}"}}
+	require.NoError(t, assignDeviceIDs(context.Background(), 1, first))
+	require.NoError(t, assignDeviceIDs(context.Background(), 2, second))
+
+	// Первый контроллер сохраняет guid как id, повтор guid на втором получает случайный id
+	assert.Equal(t, "{A}", first[0].externalID)
+	assert.Equal(t, "{B}", first[1].externalID)
+	assert.Equal(t, first[1].externalID, first[2].externalID)
+	assert.NotEmpty(t, second[0].externalID)
+	assert.NotEqual(t, first[0].externalID, second[0].externalID)
+
+	again := []deviceSmartHome{{ID: 1, Guid: "{A}"}}
+	require.NoError(t, assignDeviceIDs(context.Background(), 1, again))
+	assert.Equal(t, first[0].externalID, again[0].externalID)
+
+	// Перепрошивка: guid сменился, старый id привязывается к новому guid
+	flashed := []deviceSmartHome{{ID: 1, Guid: "{A2}"}}
+	require.NoError(t, assignDeviceIDs(context.Background(), 1, flashed))
+	assert.NotEqual(t, first[0].externalID, flashed[0].externalID)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/controllers/{id}/devices", getDeviceIDs).Methods(http.MethodGet)
+	router.HandleFunc("/controllers/{id}/devices/{device_id}", rebindDeviceID).Methods(http.MethodPut)
+
+	request := func(method string, uri string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, uri, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusNotFound, request(http.MethodPut, "/controllers/2/devices/"+first[0].externalID, `{"guid":"{A2}"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPut, "/controllers/1/devices/"+first[0].externalID, `{}`).Code)
+	assert.Equal(t, http.StatusOK, request(http.MethodPut, "/controllers/1/devices/"+first[0].externalID, `{"guid":"{A2}"}`).Code)
+
+	require.NoError(t, assignDeviceIDs(context.Background(), 1, flashed))
+	assert.Equal(t, first[0].externalID, flashed[0].externalID)
+
+	recorder := request(http.MethodGet, "/controllers/1/devices", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var ids []deviceID
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &ids))
+	assert.Equal(t, 2, len(ids))
+}
+
+func TestAssignDeviceIDTaken(t *testing.T) {
+	for name, newStore := range testStorages() {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			ctx := context.Background()
+
+			userID, err := s.createUser(ctx, "user", "secret")
+			require.NoError(t, err)
+			for _, uri := range []string{"http://127.0.0.1:1", "http://127.0.0.1:2"} {
+				_, err = s.createController(ctx, controllerRow{UserID: userID, Name: "11", Password: "11", URI: uri})
+				require.NoError(t, err)
+			}
+
+			id, err := s.assignDeviceID(ctx, 1, "{A}", "{A}")
+			require.NoError(t, err)
+			assert.Equal(t, "{A}", id)
+
+			_, err = s.assignDeviceID(ctx, 2, "{A}", "{A}")
+			assert.Equal(t, errDeviceIDTaken, err)
+
+			// Пара уже есть: возвращается ее id, а не переданный
+			id, err = s.assignDeviceID(ctx, 1, "{A}", "other")
+			require.NoError(t, err)
+			assert.Equal(t, "{A}", id)
+		})
+	}
+}
@@ -1,15 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"net/http"
-	"strings"
+	"time"
 
-	"github.com/jackc/pgtype"
 	"go.uber.org/zap"
 )
 
@@ -58,6 +58,10 @@ type deviceSmartHome struct {
 	host           string
 	username       string
 	password       string
+	codec          controllerCodec
+	driver         controllerDriver
+	controllerID   int
+	externalID     string
 }
 
 func getUserDevices(c context.Context, requestID string, token string) (string, error) {
@@ -67,9 +71,6 @@ func getUserDevices(c context.Context, requestID string, token string) (string,
 	response := deviceResponseYandex{}
 	response.RequestID = requestID
 
-	// TODO
-	response.Payload.UserID = "user"
-
 	// http://192.168.10.17:9010
 	// http://188.226.37.223:9010
 
@@ -77,37 +78,38 @@ func getUserDevices(c context.Context, requestID string, token string) (string,
 
 	devices := make([]deviceSmartHome, 0)
 
-	rows, err := db.QueryContext(ctx, `SELECT name, password, uri FROM controllers WHERE user_id = (SELECT id FROM users WHERE yandex_token = $1)`, token)
+	user, err := store.userByAccessToken(ctx, token, time.Now())
+	if err == errNotFound {
+		return "", errors.New("account_linking_error")
+	}
 	if err != nil {
 		return "", err
 	}
-	defer rows.Close()
+	response.Payload.UserID = yandexUserID(user.ID)
 
-	count := 0
-	for rows.Next() {
-		var name, password, uri pgtype.Varchar
+	controllers, err := store.userControllers(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
 
-		if err = rows.Scan(&name, &password, &uri); err != nil {
-			return "", err
+	for _, cntl := range controllers {
+		driver, err := cntl.driver()
+		if err != nil {
+			msu.Error(ctx, err, zap.String("controller", cntl.URI))
+			continue
 		}
 
-		temp, err := getUserDevicesFromSmartHome(ctx, name.String, password.String, uri.String)
+		temp, err := driver.devices(ctx)
 		if err != nil {
 			msu.Error(ctx, err)
 			// return "", err
 		}
 
-		devices = append(devices, temp...)
-		count++
-	}
-
-	if count == 0 {
-		var id int
-		if err = db.QueryRowContext(ctx, `SELECT id FROM users WHERE yandex_token = $1`, token).Scan(&id); err != nil {
-			if err == sql.ErrNoRows {
-				return "", errors.New("account_linking_error")
-			}
+		if err = assignDeviceIDs(ctx, cntl.ID, temp); err != nil {
+			return "", err
 		}
+
+		devices = append(devices, temp...)
 	}
 
 	// temp, err := getUserDevicesFromSmartHome(ctx, "", "", "http://188.226.37.223:9010")
@@ -148,7 +150,7 @@ func toYandexDevices(c context.Context, devices []deviceSmartHome) ([]deviceYand
 
 		devicesYandex = append(devicesYandex,
 			deviceYandex{
-				ID:          val.Guid,
+				ID:          val.externalID,
 				Name:        val.Name,
 				Description: "",
 				Room:        val.RoomName,
@@ -173,10 +175,21 @@ func toYandexDevices(c context.Context, devices []deviceSmartHome) ([]deviceYand
 	return devicesYandex, nil
 }
 
-func getUserDevicesFromSmartHome(c context.Context, username string, password, host string) ([]deviceSmartHome, error) {
+func getUserDevicesFromSmartHome(c context.Context, controllerID int, username string, password, host string, codec controllerCodec) ([]deviceSmartHome, error) {
+	return readControllerDevices(c, controllerID, func(ctx context.Context) ([]deviceSmartHome, string, error) {
+		return requestUserDevicesFromSmartHome(ctx, controllerID, username, password, host, codec)
+	})
+}
+
+// requestUserDevicesFromSmartHome запрашивает устройства контроллера. Вторым значением возвращается
+// версия прошивки из заголовка Server, если контроллер ее отдает
+func requestUserDevicesFromSmartHome(c context.Context, controllerID int, username string, password, host string, codec controllerCodec) ([]deviceSmartHome, string, error) {
 	ctx := c
 
-	request := `getalldevices=` + encode(encryptKey, `{"login":"`+username+`","password":"`+password+`"}`)
+	request, err := controllerQuery(codec, `getalldevices`, `{"login":"`+username+`","password":"`+password+`"}`)
+	if err != nil {
+		return nil, "", err
+	}
 
 	if debug {
 		msu.Info(ctx,
@@ -189,44 +202,55 @@ func getUserDevicesFromSmartHome(c context.Context, username string, password, h
 	// 	zap.String("request", "controller"),
 	// 	zap.Any("uri", host+"?"+request))
 
-	// TODO сделать контекст с дедлайном, чтобы дропать соединения
-	req, err := http.NewRequest("GET", host+"?"+request, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", host+"?"+request, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	client := &http.Client{}
+	client := controllerClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer resp.Body.Close()
 
-	var body []byte
-	if body, err = ioutil.ReadAll(resp.Body); err != nil {
-		return nil, err
+	firmware := resp.Header.Get("Server")
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, firmware, fmt.Errorf("%w: status %d", errControllerResponse, resp.StatusCode)
+	}
+
+	// Ответ расшифровывается по мере чтения, тело целиком хранится только для отладки
+	var body bytes.Buffer
+	var source io.Reader = resp.Body
+	if debug {
+		source = io.TeeReader(resp.Body, &body)
 	}
-	defer resp.Body.Close()
 
 	devices := make([]deviceSmartHome, 0)
 
-	// msu.Info(ctx, zap.Any("object", strings.TrimSpace(string(body))))
-	// msu.Info(ctx, zap.Any("object", decode(encryptKey, strings.TrimSpace(string(body)))))
+	reader, err := decodeStream(codec, source)
+	if err != nil {
+		return nil, firmware, fmt.Errorf("%w: %v", errControllerResponse, err)
+	}
 
-	if err = json.Unmarshal([]byte(decode(encryptKey, strings.TrimSpace(string(body)))), &devices); err != nil {
-		return nil, err
+	if err = json.NewDecoder(reader).Decode(&devices); err != nil {
+		return nil, firmware, fmt.Errorf("%w: %v", errControllerResponse, err)
 	}
 
 	for index, _ := range devices {
 		devices[index].host = host
 		devices[index].username = username
 		devices[index].password = password
+		devices[index].codec = codec
+		devices[index].controllerID = controllerID
+		devices[index].driver = httpDriver{id: controllerID, name: username, password: password, uri: host, codec: codec}
 	}
 
 	if debug {
 		msu.Info(ctx,
 			zap.String("response", "controller"),
-			zap.Any("body", string(body)),
+			zap.Any("body", body.String()),
 			zap.Any("resp.object", devices))
 	}
 
@@ -234,7 +258,7 @@ func getUserDevicesFromSmartHome(c context.Context, username string, password, h
 	// 	zap.String("response", "controller"),
 	// 	zap.Any("body", string(body)))
 
-	return devices, nil
+	return devices, firmware, nil
 }
 
 func capabilitiesYandex(yandexTypeID string, dimming int) []interface{} {
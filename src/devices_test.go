@@ -39,7 +39,7 @@ func TestGetdevicesFromSmartHome(t *testing.T) {
 	// if _, err = getUserDevicesFromSmartHome("http://192.168.10.17:9010"); err != nil {
 	// 	msu.Error(context.TODO(), err)
 	// }
-	if _, err = getUserDevicesFromSmartHome(context.Background(), "11", "11", "http://188.226.37.223:9010"); err != nil {
+	if _, err = getUserDevicesFromSmartHome(context.Background(), 0, "11", "11", "http://188.226.37.223:9010", legacyCodec{key: encryptKey}); err != nil {
 		msu.Error(context.TODO(), err)
 	}
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// dispatchRate - сколько команд в секунду отправляется одному контроллеру, 0 - без ограничения
+	dispatchRate = 5.0
+	// dispatchConcurrency - сколько команд одному контроллеру выполняется одновременно
+	dispatchConcurrency = 1
+	// actionDeadline - сколько обработчик команды Яндекса ждет отправки команд контроллеру
+	actionDeadline = 2500 * time.Millisecond
+	// dispatcherIdleTTL - через сколько простоя очередь контроллера удаляется
+	dispatcherIdleTTL = 10 * time.Minute
+)
+
+// errDispatchTimeout - команда не успела уйти до дедлайна вызывающего, но осталась в очереди контроллера
+var errDispatchTimeout = errors.New("command is still waiting in the controller queue")
+
+var dispatchers = newDispatcherRegistry()
+
+type dispatchJob struct {
+	act     deviceActionSmartHome
+	send    func(context.Context, deviceActionSmartHome) error
+	waiters []chan error
+}
+
+// controllerDispatcher выполняет команды одного контроллера по очереди, не чаще rate в секунду
+// и не больше concurrency одновременно. Ждущая команда тому же устройству заменяется новой
+type controllerDispatcher struct {
+	interval    time.Duration
+	concurrency int
+
+	mutex    sync.Mutex
+	pending  []*dispatchJob
+	running  int
+	next     time.Time
+	lastUsed time.Time
+}
+
+func newControllerDispatcher(rate float64, concurrency int) *controllerDispatcher {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	d := &controllerDispatcher{concurrency: concurrency, lastUsed: time.Now()}
+	if rate > 0 {
+		d.interval = time.Duration(float64(time.Second) / rate)
+	}
+
+	return d
+}
+
+// enqueue ставит команду в очередь. Результат придет в возвращенный канал
+func (d *controllerDispatcher) enqueue(act deviceActionSmartHome, send func(context.Context, deviceActionSmartHome) error) <-chan error {
+	done := make(chan error, 1)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.lastUsed = time.Now()
+	merged := false
+	for _, job := range d.pending {
+		if job.act.ID == act.ID {
+			job.act = act
+			job.send = send
+			job.waiters = append(job.waiters, done)
+			merged = true
+			break
+		}
+	}
+	if !merged {
+		d.pending = append(d.pending, &dispatchJob{act: act, send: send, waiters: []chan error{done}})
+	}
+
+	if d.running < d.concurrency {
+		d.running++
+		go d.work()
+	}
+
+	return done
+}
+
+// waitDispatch ждет результат команды. Если ctx завершился раньше, возвращается errDispatchTimeout,
+// а команда все равно будет отправлена
+func waitDispatch(c context.Context, done <-chan error) error {
+	ctx := c
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errDispatchTimeout
+	}
+}
+
+// work выполняет команды, пока очередь не опустеет
+func (d *controllerDispatcher) work() {
+	for {
+		job := d.take()
+		if job == nil {
+			return
+		}
+
+		// Команда выполняется и после ухода вызывающего, поэтому у нее свой контекст
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := job.send(ctx, job.act)
+		cancel()
+
+		for _, waiter := range job.waiters {
+			waiter <- err
+		}
+	}
+}
+
+// take дожидается очередного окна по rate и забирает первую команду.
+// Пока идет ожидание, команда еще может быть заменена более новой
+func (d *controllerDispatcher) take() *dispatchJob {
+	d.mutex.Lock()
+	if len(d.pending) == 0 {
+		d.running--
+		d.mutex.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	start := d.next
+	if start.Before(now) {
+		start = now
+	}
+	d.next = start.Add(d.interval)
+	d.mutex.Unlock()
+
+	time.Sleep(time.Until(start))
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(d.pending) == 0 {
+		d.running--
+		return nil
+	}
+
+	job := d.pending[0]
+	d.pending = d.pending[1:]
+	return job
+}
+
+// idle - в очереди нет команд и ее не использовали дольше ttl
+func (d *controllerDispatcher) idle(now time.Time, ttl time.Duration) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.running == 0 && len(d.pending) == 0 && now.Sub(d.lastUsed) >= ttl
+}
+
+// touch откладывает удаление очереди, пока вызывающий ставит в нее команду
+func (d *controllerDispatcher) touch(now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.lastUsed = now
+}
+
+type dispatcherRegistry struct {
+	mutex       sync.Mutex
+	dispatchers map[string]*controllerDispatcher
+}
+
+func newDispatcherRegistry() *dispatcherRegistry {
+	return &dispatcherRegistry{dispatchers: make(map[string]*controllerDispatcher)}
+}
+
+// get возвращает очередь контроллера uri, создавая ее с текущими dispatchRate и dispatchConcurrency.
+// Заодно удаляются очереди, простаивающие дольше dispatcherIdleTTL
+func (r *dispatcherRegistry) get(uri string) *controllerDispatcher {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	for key, d := range r.dispatchers {
+		if key != uri && d.idle(now, dispatcherIdleTTL) {
+			delete(r.dispatchers, key)
+		}
+	}
+
+	d, ok := r.dispatchers[uri]
+	if !ok {
+		d = newControllerDispatcher(dispatchRate, dispatchConcurrency)
+		r.dispatchers[uri] = d
+	}
+	d.touch(now)
+
+	return d
+}
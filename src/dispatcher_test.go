@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestControllerDispatcher(t *testing.T) {
+	d := newControllerDispatcher(0, 1)
+
+	release := make(chan struct{})
+	mutex := sync.Mutex{}
+	running, maxRunning := 0, 0
+	sent := make([]deviceActionSmartHome, 0)
+
+	send := func(ctx context.Context, act deviceActionSmartHome) error {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		<-release
+
+		mutex.Lock()
+		running--
+		sent = append(sent, act)
+		mutex.Unlock()
+		return nil
+	}
+
+	first := d.enqueue(deviceActionSmartHome{ID: 1}, send)
+	time.Sleep(10 * time.Millisecond)
+
+	// Пока контроллер занят, две команды одному устройству сливаются в одну
+	second := d.enqueue(deviceActionSmartHome{ID: 2, TurnOn: 0}, send)
+	third := d.enqueue(deviceActionSmartHome{ID: 2, TurnOn: 1}, send)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, waitDispatch(ctx, second), errDispatchTimeout)
+
+	close(release)
+	assert.NoError(t, waitDispatch(context.Background(), first))
+	assert.NoError(t, waitDispatch(context.Background(), second))
+	assert.NoError(t, waitDispatch(context.Background(), third))
+
+	assert.Equal(t, 1, maxRunning)
+	assert.Equal(t, 2, len(sent))
+	assert.Equal(t, 1, sent[1].TurnOn)
+
+	// Не больше 20 команд в секунду
+	d = newControllerDispatcher(20, 2)
+	noop := func(ctx context.Context, act deviceActionSmartHome) error { return nil }
+
+	started := time.Now()
+	results := make([]<-chan error, 0)
+	for i := 0; i < 5; i++ {
+		results = append(results, d.enqueue(deviceActionSmartHome{ID: i}, noop))
+	}
+	for _, done := range results {
+		assert.NoError(t, waitDispatch(context.Background(), done))
+	}
+	assert.GreaterOrEqual(t, int64(time.Since(started)), int64(200*time.Millisecond))
+}
+
+func TestDispatcherEviction(t *testing.T) {
+	ttl := dispatcherIdleTTL
+	t.Cleanup(func() { dispatcherIdleTTL = ttl })
+	dispatcherIdleTTL = 50 * time.Millisecond
+
+	registry := newDispatcherRegistry()
+	busy := registry.get("http://busy")
+	release := make(chan struct{})
+	done := busy.enqueue(deviceActionSmartHome{ID: 1}, func(ctx context.Context, act deviceActionSmartHome) error {
+		<-release
+		return nil
+	})
+	registry.get("http://idle")
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Простаивающая очередь удаляется, очередь с выполняющейся командой остается
+	registry.get("http://other")
+	assert.Equal(t, 2, len(registry.dispatchers))
+	assert.Same(t, busy, registry.dispatchers["http://busy"])
+
+	close(release)
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// driverHTTP - протокол getalldevices/setcommandalice, драйвер по умолчанию
+const driverHTTP = "http"
+
+// controllerDriver - протокол связи с контроллером
+type controllerDriver interface {
+	// devices возвращает устройства контроллера вместе с их состоянием
+	devices(ctx context.Context) ([]deviceSmartHome, error)
+	// state возвращает текущее состояние устройств ids, при ids = nil - всех устройств
+	state(ctx context.Context, ids []int) ([]deviceSmartHome, error)
+	// execute выполняет команду устройству
+	execute(ctx context.Context, act deviceActionSmartHome) error
+}
+
+// drivers - конструкторы драйверов по значению колонки controllers.driver
+var drivers = map[string]func(cntl controllerRow) (controllerDriver, error){
+	driverHTTP:   newHTTPDriver,
+	driverModbus: newModbusDriver,
+}
+
+// controllerRow - поля controllers, нужные для связи с контроллером
+type controllerRow struct {
+	ID           int
+	UserID       int
+	Name         string
+	Password     string
+	URI          string
+	CodecVersion int
+	CodecKey     string
+	PreviousKey  string
+	RotatedAt    string
+	PendingKey   string
+	Driver       string
+	DriverConfig string
+	Verified     bool
+}
+
+// controllerColumns - колонки для scanController
+const controllerColumns = `id, user_id, name, password, uri, codec_version, codec_key, codec_previous_key, key_rotated_at, codec_pending_key, driver, driver_config, verified`
+
+func scanController(rows *sql.Rows) (controllerRow, error) {
+	var cntl controllerRow
+	var uri, codecKey, previousKey, rotatedAt, pendingKey, driverConfig sql.NullString
+
+	if err := rows.Scan(&cntl.ID, &cntl.UserID, &cntl.Name, &cntl.Password, &uri,
+		&cntl.CodecVersion, &codecKey, &previousKey, &rotatedAt, &pendingKey, &cntl.Driver, &driverConfig, &cntl.Verified); err != nil {
+		return cntl, err
+	}
+	cntl.URI = uri.String
+	cntl.CodecKey = codecKey.String
+	cntl.PreviousKey = previousKey.String
+	cntl.RotatedAt = rotatedAt.String
+	cntl.PendingKey = pendingKey.String
+	cntl.DriverConfig = driverConfig.String
+
+	return cntl, nil
+}
+
+// driver создает драйвер контроллера
+func (cntl controllerRow) driver() (controllerDriver, error) {
+	name := cntl.Driver
+	if name == "" {
+		name = driverHTTP
+	}
+
+	constructor, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown controller driver %q", name)
+	}
+
+	return constructor(cntl)
+}
+
+type httpDriver struct {
+	id       int
+	name     string
+	password string
+	uri      string
+	codec    controllerCodec
+}
+
+func newHTTPDriver(cntl controllerRow) (controllerDriver, error) {
+	codec, err := controllerCodecFor(cntl.CodecVersion, cntl.CodecKey, cntl.PreviousKey, cntl.RotatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return httpDriver{id: cntl.ID, name: cntl.Name, password: cntl.Password, uri: cntl.URI, codec: codec}, nil
+}
+
+func (d httpDriver) devices(ctx context.Context) ([]deviceSmartHome, error) {
+	return getUserDevicesFromSmartHome(ctx, d.id, d.name, d.password, d.uri, d.codec)
+}
+
+// state у контроллера нет чтения отдельных линий, поэтому читается весь список
+func (d httpDriver) state(ctx context.Context, ids []int) ([]deviceSmartHome, error) {
+	devices, _, err := requestUserDevicesFromSmartHome(ctx, d.id, d.name, d.password, d.uri, d.codec)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterDevices(devices, ids), nil
+}
+
+func (d httpDriver) execute(ctx context.Context, act deviceActionSmartHome) error {
+	act.Login = d.name
+	act.Password = d.password
+
+	return sendActionToSmartHome(ctx, d.uri, d.codec, act)
+}
+
+// readControllerDevices читает устройства через автомат контроллера id и записывает замер связи.
+// Единственное место, где чтение списка устройств учитывается автоматом и health: драйверы
+// вызывают его из devices, а state и execute идут без него
+func readControllerDevices(c context.Context, id int, read func(ctx context.Context) ([]deviceSmartHome, string, error)) ([]deviceSmartHome, error) {
+	var devices []deviceSmartHome
+
+	err := breakers.call(c, id, func(ctx context.Context) error {
+		var firmware string
+		var err error
+
+		started := time.Now()
+		devices, firmware, err = read(ctx)
+		health.record(id, time.Since(started), len(devices), firmware, err)
+
+		return err
+	})
+
+	return devices, err
+}
+
+func filterDevices(devices []deviceSmartHome, ids []int) []deviceSmartHome {
+	if ids == nil {
+		return devices
+	}
+
+	wanted := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	result := make([]deviceSmartHome, 0, len(ids))
+	for _, device := range devices {
+		if wanted[device.ID] {
+			result = append(result, device)
+		}
+	}
+
+	return result
+}
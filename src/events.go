@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// eventBuffer - сколько событий ждут отправки одному потоку приложения
+const eventBuffer = 64
+
+// eventKeepAlive - период комментария в потоке, чтобы прокси не закрывали простаивающее соединение
+const eventKeepAlive = 30 * time.Second
+
+var appEvents = newEventHub()
+
+// eventHub раздает события контроллеров потокам приложения. Поток получает события только
+// контроллеров своего пользователя, медленный поток теряет события, а не задерживает опрос
+type eventHub struct {
+	mutex       sync.Mutex
+	subscribers map[int]map[chan controllerEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[int]map[chan controllerEvent]struct{})}
+}
+
+// subscribe открывает поток событий пользователя. Возвращаемая функция закрывает поток
+func (h *eventHub) subscribe(userID int) (<-chan controllerEvent, func()) {
+	events := make(chan controllerEvent, eventBuffer)
+
+	h.mutex.Lock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[chan controllerEvent]struct{})
+	}
+	h.subscribers[userID][events] = struct{}{}
+	h.mutex.Unlock()
+
+	return events, func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+
+		delete(h.subscribers[userID], events)
+		if len(h.subscribers[userID]) == 0 {
+			delete(h.subscribers, userID)
+		}
+	}
+}
+
+// publish - обработчик событий опроса, см. poller.subscribe
+func (h *eventHub) publish(event controllerEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for events := range h.subscribers[event.UserID] {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// streamEvents отдает приложению события контроллеров пользователя как text/event-stream
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var token string
+	tokenInfo := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(tokenInfo) == 2 {
+		token = tokenInfo[1]
+	} else {
+		msu.Error(ctx,
+			errors.New("invalid AuthHeader len"),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := store.userByAppToken(ctx, token)
+	if err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		msu.Error(ctx, errors.New("response writer does not support streaming"), zap.Any("uri", r.RequestURI))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := appEvents.subscribe(user.ID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	// Контекст запроса заменяет prometheusHandler, отключение клиента видно по ошибке записи
+	for {
+		select {
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-events:
+			data, marshalErr := json.Marshal(event)
+			if marshalErr != nil {
+				msu.Error(ctx, marshalErr, zap.Int("user", user.ID))
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
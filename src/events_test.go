@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+)
+
+func TestEventHub(t *testing.T) {
+	hub := newEventHub()
+
+	events, cancel := hub.subscribe(1)
+	hub.publish(controllerEvent{Type: DeviceStateChanged, UserID: 2})
+	hub.publish(controllerEvent{Type: ControllerOffline, UserID: 1})
+
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, ControllerOffline, (<-events).Type)
+
+	// Переполненный поток не блокирует публикацию
+	for i := 0; i < eventBuffer+1; i++ {
+		hub.publish(controllerEvent{Type: DeviceStateChanged, UserID: 1})
+	}
+	assert.Equal(t, eventBuffer, len(events))
+
+	cancel()
+	assert.Empty(t, hub.subscribers)
+}
+
+func TestYandexNotifier(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+	store = newMemoryStorage()
+
+	var requests []string
+	var bodies []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "OAuth skill-token", r.Header.Get("Authorization"))
+		data, _ := ioutil.ReadAll(r.Body)
+		var body map[string]interface{}
+		assert.NoError(t, json.Unmarshal(data, &body))
+		requests = append(requests, r.URL.Path)
+		bodies = append(bodies, body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	notifier := newYandexNotifier("skill", "skill-token")
+	notifier.url = server.URL + "/skill/callback/"
+
+	device := deviceSmartHome{ID: 1, Guid: "{A}", DeviceTypeID: 1, TurnOn: 1}
+	ids := []deviceSmartHome{device}
+	require.NoError(t, assignDeviceIDs(context.Background(), 5, ids))
+
+	require.NoError(t, notifier.notify(context.Background(), controllerEvent{Type: DeviceStateChanged, ControllerID: 5, UserID: 7, Device: &device}))
+	require.NoError(t, notifier.notify(context.Background(), controllerEvent{Type: DeviceAdded, ControllerID: 5, UserID: 7, Device: &device}))
+	require.NoError(t, notifier.notify(context.Background(), controllerEvent{Type: ControllerOffline, ControllerID: 5, UserID: 7}))
+
+	require.Equal(t, []string{"/skill/callback/state", "/skill/callback/discovery"}, requests)
+
+	payload := bodies[0]["payload"].(map[string]interface{})
+	assert.Equal(t, "7", payload["user_id"])
+	state := payload["devices"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, ids[0].externalID, state["id"])
+	assert.NotEmpty(t, state["capabilities"])
+	assert.Equal(t, "7", bodies[1]["payload"].(map[string]interface{})["user_id"])
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+
+	"gitlab.com/ms-ural/bsh/backend/src/fakecontroller"
+	"go.uber.org/zap"
+)
+
+// fakeCodec дает эмулятору контроллера кодеки сервера, чтобы тесты проверяли настоящую кодировку
+type fakeCodec struct {
+	codec controllerCodec
+}
+
+func (c fakeCodec) Version() int { return c.codec.version() }
+
+func (c fakeCodec) Encode(source string) (string, error) { return c.codec.encode(source) }
+
+func (c fakeCodec) Decode(source string) (string, error) { return c.codec.decode(source) }
+
+// newFakeKeyCodec - смена ключа командой setkey кодеками сервера
+func newFakeKeyCodec(version int, key string) (fakecontroller.Codec, error) {
+	codec, err := newCodec(version, key)
+	if err != nil {
+		return nil, err
+	}
+	return fakeCodec{codec}, nil
+}
+
+// loadFakeController загружает эмулятор контроллера, понимающий все кодеки сервера
+func loadFakeController(path string, login string, password string) (*fakecontroller.Controller, error) {
+	fake, err := fakecontroller.Load(path, login, password)
+	if err != nil {
+		return nil, err
+	}
+	fake.SetKeyCodec(newFakeKeyCodec)
+	return fake, nil
+}
+
+// runFakeController запускает эмулятор контроллера: bsh-backend fakecontroller -fixture devices.json
+func runFakeController(args []string) error {
+	ctx := context.Background()
+
+	flags := flag.NewFlagSet("fakecontroller", flag.ContinueOnError)
+	addr := flags.String("addr", ":9010", "listen address")
+	fixture := flags.String("fixture", "", "devices file in getalldevices format")
+	login := flags.String("login", "", "controller login, any login is accepted if empty")
+	password := flags.String("password", "", "controller password")
+	latency := flags.Duration("latency", 0, "delay before every response")
+	key := flags.String("key", "", "AES-GCM codec key in hex, legacy codec is still accepted")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *fixture == "" {
+		return errors.New("fixture is not set")
+	}
+
+	fake, err := loadFakeController(*fixture, *login, *password)
+	if err != nil {
+		return err
+	}
+	fake.SetLatency(*latency)
+
+	if *key != "" {
+		codec, err := newCodec(codecAESGCM, *key)
+		if err != nil {
+			return err
+		}
+		fake.SetCodec(fakeCodec{codec}, true)
+	}
+
+	msu.Info(ctx,
+		zap.String("fakecontroller", *addr),
+		zap.String("fixture", *fixture),
+		zap.Int("devices", len(fake.State())))
+
+	return http.ListenAndServe(*addr, fake.Control())
+}
@@ -0,0 +1,69 @@
+package fakecontroller
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+const (
+	// LegacyVersion - версия XOR кодека, которую понимает любая прошивка
+	LegacyVersion = 1
+	// DefaultKey - общий ключ XOR кодека прошивки по умолчанию
+	DefaultKey = "abc321"
+)
+
+var errDecode = errors.New("unable to decode payload")
+
+// Codec шифрует ответы эмулятора и расшифровывает запросы к нему
+type Codec interface {
+	Version() int
+	Encode(source string) (string, error)
+	Decode(source string) (string, error)
+}
+
+// LegacyCodec - XOR по шестнадцатеричной строке, как в прошивке контроллера. Пустой Key - DefaultKey
+type LegacyCodec struct {
+	Key string
+}
+
+func (c LegacyCodec) key() string {
+	if c.Key == "" {
+		return DefaultKey
+	}
+
+	return c.Key
+}
+
+func (c LegacyCodec) Version() int {
+	return LegacyVersion
+}
+
+func (c LegacyCodec) Encode(source string) (string, error) {
+	key := c.key()
+	upper := []byte(strings.ToUpper(hex.EncodeToString([]byte(source))))
+	for i := range upper {
+		upper[i] ^= key[i%len(key)]
+	}
+
+	return hex.EncodeToString(upper), nil
+}
+
+func (c LegacyCodec) Decode(source string) (string, error) {
+	xored, err := hex.DecodeString(source)
+	if err != nil {
+		return "", errDecode
+	}
+
+	key := c.key()
+	for i := range xored {
+		xored[i] ^= key[i%len(key)]
+	}
+
+	decoded, err := hex.DecodeString(string(xored))
+	if err != nil {
+		return "", errDecode
+	}
+
+	return string(decoded), nil
+}
@@ -0,0 +1,428 @@
+// Package fakecontroller эмулирует контроллер умного дома для тестов и локальной разработки:
+// отвечает на getalldevices, setcommandalice и setkey и хранит состояние устройств в памяти.
+//
+//	fake, _ := fakecontroller.Load("testdata/fakecontroller.json", "11", "11")
+//	server := httptest.NewServer(fake)
+//
+// По умолчанию эмулятор понимает только XOR кодек с общим ключом, другие кодеки подключаются SetCodec
+package fakecontroller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Device - устройство в формате ответа getalldevices
+type Device struct {
+	ID             int    `json:"id"`
+	Guid           string `json:"guid"`
+	Name           string `json:"name"`
+	RoomID         int    `json:"idRooms"`
+	RoomName       string `json:"roomsName"`
+	DeviceTypeID   int    `json:"idDevices"`
+	DeviceTypeName string `json:"deviceTypes"`
+	FloorID        int    `json:"idFloor"`
+	FloorName      string `json:"floorName"`
+	Line           int    `json:"line"`
+	LineID         int    `json:"idLine"`
+	LineIndex      int    `json:"indexLine"`
+	Active         int    `json:"active"`
+	Dimming        int    `json:"dimming"`
+	TurnOn         int    `json:"idStatus"`
+	DimmingValue   int    `json:"dimmingValue"`
+}
+
+// Command - команда setcommandalice
+type Command struct {
+	Login         string `json:"login"`
+	Password      string `json:"password"`
+	ID            int    `json:"id"`
+	FloorID       int    `json:"idFloor"`
+	RoomID        int    `json:"idRoom"`
+	LineID        int    `json:"idLine"`
+	Line          int    `json:"line"`
+	LineIndex     int    `json:"indexLine"`
+	TurnOn        int    `json:"idStatus"`
+	ChangeDimming int    `json:"changeDimming"`
+	Dimming       int    `json:"dimming"`
+	DimmingValue  int    `json:"dimmingValue"`
+	ColorDraw     string `json:"colorDraw"`
+	ColorDrawOff  string `json:"colorDrawOff"`
+	SetPassword   string `json:"setPassword"`
+	ColorText     string `json:"colorText"`
+}
+
+// KeyCodecFunc создает кодек версии version с ключом, присланным командой setkey
+type KeyCodecFunc func(version int, key string) (Codec, error)
+
+// Controller - эмулятор контроллера, http.Handler для httptest.NewServer
+type Controller struct {
+	mutex    sync.Mutex
+	login    string
+	password string
+	devices  []Device
+	codecs   map[int]Codec
+	keyCodec KeyCodecFunc
+
+	latency    time.Duration
+	failures   int
+	failStatus int
+	stuck      bool
+	commands   []Command
+}
+
+// New создает эмулятор. Пустой login принимает любые учетные данные
+func New(login string, password string, devices []Device) *Controller {
+	return &Controller{
+		login:      login,
+		password:   password,
+		devices:    append([]Device{}, devices...),
+		codecs:     map[int]Codec{LegacyVersion: LegacyCodec{}},
+		keyCodec:   legacyKeyCodec,
+		failStatus: http.StatusInternalServerError,
+	}
+}
+
+// Load читает устройства из файла в формате ответа getalldevices
+func Load(path string, login string, password string) (*Controller, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]Device, 0)
+	if err = json.Unmarshal(data, &devices); err != nil {
+		return nil, err
+	}
+
+	return New(login, password, devices), nil
+}
+
+// legacyKeyCodec - setkey без SetKeyCodec меняет только ключ XOR кодека
+func legacyKeyCodec(version int, key string) (Codec, error) {
+	if version != LegacyVersion || key == "" {
+		return nil, fmt.Errorf("unsupported codec version %d", version)
+	}
+
+	return LegacyCodec{Key: key}, nil
+}
+
+// SetCodec включает поддержку кодека. Если legacy = false, эмулятор понимает только переданный кодек
+func (f *Controller) SetCodec(codec Codec, legacy bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.codecs = map[int]Codec{codec.Version(): codec}
+	if legacy {
+		f.codecs[LegacyVersion] = LegacyCodec{}
+	}
+}
+
+// SetKeyCodec задает, как создавать кодеки для ключей из команды setkey
+func (f *Controller) SetKeyCodec(keyCodec KeyCodecFunc) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.keyCodec = keyCodec
+}
+
+// SetLatency задерживает каждый ответ эмулятора
+func (f *Controller) SetLatency(latency time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.latency = latency
+}
+
+// FailNext завершает следующие count запросов ошибкой status.
+// Статус 0 означает разрыв соединения без ответа
+func (f *Controller) FailNext(count int, status int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failures = count
+	f.failStatus = status
+}
+
+// SetStuck эмулирует зависшее реле: команды принимаются с ответом ok, но состояние не меняется
+func (f *Controller) SetStuck(stuck bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.stuck = stuck
+}
+
+// State возвращает текущее состояние устройств
+func (f *Controller) State() []Device {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]Device{}, f.devices...)
+}
+
+// Received возвращает все принятые команды
+func (f *Controller) Received() []Command {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]Command{}, f.commands...)
+}
+
+func (f *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	latency := f.latency
+	fail := f.failures > 0
+	status := f.failStatus
+	if fail {
+		f.failures--
+	}
+	f.mutex.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if fail {
+		if status == 0 {
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+			status = http.StatusServiceUnavailable
+		}
+		w.WriteHeader(status)
+		return
+	}
+
+	query := r.URL.Query()
+
+	// Прошивка без поддержки запрошенного кодека игнорирует параметр codec
+	version := LegacyVersion
+	if v, err := strconv.Atoi(query.Get("codec")); err == nil {
+		version = v
+	}
+
+	f.mutex.Lock()
+	codec, ok := f.codecs[version]
+	if !ok {
+		codec, ok = f.codecs[LegacyVersion]
+	}
+	f.mutex.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if request := query.Get("getalldevices"); request != "" {
+		f.getAllDevices(w, codec, request)
+		return
+	}
+
+	if request := query.Get("setcommandalice"); request != "" {
+		f.setCommand(w, codec, request)
+		return
+	}
+
+	if request := query.Get("setkey"); request != "" {
+		f.setKey(w, codec, request)
+		return
+	}
+
+	w.WriteHeader(http.StatusBadRequest)
+}
+
+func (f *Controller) authorized(login string, password string) bool {
+	return f.login == "" || (f.login == login && f.password == password)
+}
+
+func (f *Controller) getAllDevices(w http.ResponseWriter, codec Codec, request string) {
+	credentials := struct {
+		Login    string `json:"login"`
+		Password string `json:"password"`
+	}{}
+
+	decoded, err := codec.Decode(request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = json.Unmarshal([]byte(decoded), &credentials); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !f.authorized(credentials.Login, credentials.Password) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	result, err := json.Marshal(f.State())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	f.respond(w, codec, string(result))
+}
+
+func (f *Controller) respond(w http.ResponseWriter, codec Codec, payload string) {
+	encoded, err := codec.Encode(payload)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, encoded)
+}
+
+func (f *Controller) setCommand(w http.ResponseWriter, codec Codec, request string) {
+	var command Command
+	decoded, err := codec.Decode(request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = json.Unmarshal([]byte(decoded), &command); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !f.authorized(command.Login, command.Password) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f.mutex.Lock()
+	f.commands = append(f.commands, command)
+	found := false
+	for index, device := range f.devices {
+		if device.ID != command.ID {
+			continue
+		}
+		found = true
+		if f.stuck {
+			continue
+		}
+		f.devices[index].TurnOn = command.TurnOn
+		if command.ChangeDimming == 1 {
+			f.devices[index].DimmingValue = command.DimmingValue
+		}
+	}
+	f.mutex.Unlock()
+
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f.respond(w, codec, `{"result":"ok"}`)
+}
+
+// setKey меняет ключ кодека, которым пришел запрос, и отвечает уже новым ключом
+func (f *Controller) setKey(w http.ResponseWriter, codec Codec, request string) {
+	decoded, err := codec.Decode(request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	credentials := struct {
+		Login    string `json:"login"`
+		Password string `json:"password"`
+		Key      string `json:"key"`
+	}{}
+	if err = json.Unmarshal([]byte(decoded), &credentials); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !f.authorized(credentials.Login, credentials.Password) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f.mutex.Lock()
+	keyCodec := f.keyCodec
+	f.mutex.Unlock()
+
+	next, err := keyCodec(codec.Version(), credentials.Key)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	f.codecs[next.Version()] = next
+	f.mutex.Unlock()
+
+	f.respond(w, next, `{"result":"ok"}`)
+}
+
+// Control добавляет к эмулятору управление сбоями:
+// /fake/latency?value=2s, /fake/fail?count=3&status=500, /fake/stuck?value=true, /fake/state
+func (f *Controller) Control() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/fake/latency", func(w http.ResponseWriter, r *http.Request) {
+		latency, err := time.ParseDuration(r.URL.Query().Get("value"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.SetLatency(latency)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux.HandleFunc("/fake/fail", func(w http.ResponseWriter, r *http.Request) {
+		count, err := strconv.Atoi(r.URL.Query().Get("count"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		status, err := strconv.Atoi(r.URL.Query().Get("status"))
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+		f.FailNext(count, status)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux.HandleFunc("/fake/stuck", func(w http.ResponseWriter, r *http.Request) {
+		stuck, err := strconv.ParseBool(r.URL.Query().Get("value"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.SetStuck(stuck)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux.HandleFunc("/fake/state", func(w http.ResponseWriter, r *http.Request) {
+		result, err := json.Marshal(f.State())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, string(result))
+	})
+
+	mux.Handle("/", f)
+
+	return mux
+}
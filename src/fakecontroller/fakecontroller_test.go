@@ -0,0 +1,70 @@
+package fakecontroller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func request(t *testing.T, server *httptest.Server, method string, payload interface{}) (int, string) {
+	data, err := json.Marshal(payload)
+	assert.NoError(t, err)
+
+	encoded, err := LegacyCodec{}.Encode(string(data))
+	assert.NoError(t, err)
+
+	response, err := http.Get(server.URL + "/?" + method + "=" + url.QueryEscape(encoded))
+	assert.NoError(t, err)
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	if response.StatusCode != http.StatusOK {
+		return response.StatusCode, ""
+	}
+
+	decoded, err := LegacyCodec{}.Decode(string(body))
+	assert.NoError(t, err)
+	return response.StatusCode, decoded
+}
+
+func TestController(t *testing.T) {
+	fake, err := Load("../testdata/fakecontroller.json", "11", "11")
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(fake.Control())
+	defer server.Close()
+
+	status, body := request(t, server, "getalldevices", Command{Login: "11", Password: "11"})
+	assert.Equal(t, http.StatusOK, status)
+	devices := make([]Device, 0)
+	assert.NoError(t, json.Unmarshal([]byte(body), &devices))
+	assert.Equal(t, 2, len(devices))
+
+	status, _ = request(t, server, "getalldevices", Command{Login: "11", Password: "wrong"})
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, _ = request(t, server, "setcommandalice", Command{Login: "11", Password: "11", ID: devices[0].ID, TurnOn: 1})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 1, fake.State()[0].TurnOn)
+	assert.Equal(t, 1, len(fake.Received()))
+
+	fake.SetStuck(true)
+	status, _ = request(t, server, "setcommandalice", Command{Login: "11", Password: "11", ID: devices[0].ID, TurnOn: 0})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 1, fake.State()[0].TurnOn)
+
+	fake.FailNext(1, http.StatusBadGateway)
+	status, _ = request(t, server, "getalldevices", Command{Login: "11", Password: "11"})
+	assert.Equal(t, http.StatusBadGateway, status)
+
+	response, err := http.Get(server.URL + "/fake/state")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+)
+
+func TestFakeController(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	fake, err := loadFakeController("testdata/fakecontroller.json", "11", "11")
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	devices, err := getUserDevicesFromSmartHome(context.Background(), 101, "11", "11", server.URL, legacyCodec{key: encryptKey})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(devices))
+	assert.Equal(t, "{96BFEAAC-57F3-490A-B47A-EBAB901FD8CC}", devices[0].Guid)
+	assert.Equal(t, server.URL, devices[0].host)
+
+	_, err = getUserDevicesFromSmartHome(context.Background(), 101, "11", "wrong", server.URL, legacyCodec{key: encryptKey})
+	assert.Error(t, err)
+
+	// Состояние хранится по id контроллера, а не по общему uri
+	assert.NotEmpty(t, health.get(101).LastError)
+	assert.Nil(t, health.get(103))
+	_, err = getUserDevicesFromSmartHome(context.Background(), 103, "11", "11", server.URL, legacyCodec{key: encryptKey})
+	assert.NoError(t, err)
+	assert.Empty(t, health.get(103).LastError)
+	assert.Equal(t, 2, health.get(103).DeviceCount)
+
+	var action deviceActionRequestYandex
+	action.ID = devices[0].Guid
+	action.Capabilities = append(action.Capabilities, struct {
+		Type  string `json:"type"`
+		State struct {
+			Instance string      `json:"instance"`
+			Value    interface{} `json:"value"`
+			Relative bool        `json:"relative,omitempty"`
+		} `json:"state"`
+	}{Type: "devices.capabilities.on_off"})
+	action.Capabilities[0].State.Instance = "on"
+	action.Capabilities[0].State.Value = true
+
+	err = actionToSmartHome(context.Background(), devices[:1], action)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fake.State()[0].TurnOn)
+	assert.Equal(t, 1, len(fake.Received()))
+
+	fake.FailNext(1, http.StatusInternalServerError)
+	_, err = getUserDevicesFromSmartHome(context.Background(), 101, "11", "11", server.URL, legacyCodec{key: encryptKey})
+	assert.Error(t, err)
+
+	_, err = getUserDevicesFromSmartHome(context.Background(), 101, "11", "11", server.URL, legacyCodec{key: encryptKey})
+	assert.NoError(t, err)
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	key := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	aead, err := newCodec(codecAESGCM, key)
+	assert.NoError(t, err)
+
+	fake, err := loadFakeController("testdata/fakecontroller.json", "", "")
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	// Старая прошивка понимает только legacy: без разрешения переход на legacy отклоняется
+	version, result := negotiateCodec(context.Background(), 0, "11", "11", server.URL, 0, key, false)
+	assert.False(t, result.OK)
+	assert.Equal(t, "codec", result.Stage)
+	assert.Equal(t, codecAESGCM, version)
+
+	version, result = negotiateCodec(context.Background(), 0, "11", "11", server.URL, 0, key, true)
+	assert.True(t, result.OK)
+	assert.True(t, result.Downgraded)
+	assert.Equal(t, codecLegacy, version)
+
+	version, result = negotiateCodec(context.Background(), 0, "11", "11", server.URL, 0, "", false)
+	assert.True(t, result.OK)
+	assert.False(t, result.Downgraded)
+	assert.Equal(t, codecLegacy, version)
+
+	fake.SetCodec(fakeCodec{aead}, false)
+
+	version, result = negotiateCodec(context.Background(), 0, "11", "11", server.URL, 0, key, false)
+	assert.True(t, result.OK)
+	assert.Equal(t, codecAESGCM, version)
+	assert.Equal(t, 2, result.DeviceCount)
+
+	version, result = negotiateCodec(context.Background(), 0, "11", "11", server.URL, codecLegacy, "", false)
+	assert.False(t, result.OK)
+	assert.Equal(t, "response", result.Stage)
+	assert.Equal(t, codecLegacy, version)
+}
+
+func TestKeyRotation(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	fake, err := loadFakeController("testdata/fakecontroller.json", "", "")
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	// Ключ нельзя передавать под общим ключом прошивки
+	shared, err := newCodec(codecLegacy, "")
+	assert.NoError(t, err)
+	assert.Equal(t, errSharedKeyRotation, requestKeyRotation(context.Background(), "11", "11", server.URL, shared, "00112233445566778899aabbccddeeff"))
+	assert.Equal(t, 0, len(fake.Received()))
+
+	oldKey := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	old, err := newCodec(codecAESGCM, oldKey)
+	assert.NoError(t, err)
+	fake.SetCodec(fakeCodec{old}, false)
+
+	key, err := generateCodecKey(codecAESGCM)
+	assert.NoError(t, err)
+	assert.NoError(t, requestKeyRotation(context.Background(), "11", "11", server.URL, old, key))
+
+	// Прежний ключ больше не подходит
+	_, err = getUserDevicesFromSmartHome(context.Background(), 101, "11", "11", server.URL, old)
+	assert.Error(t, err)
+
+	codec, err := controllerCodecFor(codecAESGCM, key, oldKey, time.Now().Format(time.RFC3339))
+	assert.NoError(t, err)
+
+	devices, err := getUserDevicesFromSmartHome(context.Background(), 101, "11", "11", server.URL, codec)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(devices))
+}
+
+func TestRotatingCodec(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	previous, _ := newCodec(codecAESGCM, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	current, _ := newCodec(codecAESGCM, "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100")
+
+	now := time.Now()
+	codec := rotatingCodec{current: current, previous: previous, until: now.Add(time.Hour), now: func() time.Time { return now }}
+
+	encoded, _ := previous.encode(`{"result":"ok"}`)
+	decoded, err := codec.decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"result":"ok"}`, decoded)
+
+	now = now.Add(2 * time.Hour)
+	_, err = codec.decode(encoded)
+	assert.Error(t, err)
+}
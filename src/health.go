@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var errControllerResponse = errors.New("invalid controller response")
+
+// errCodecDowngrade - контроллер не принял ключ AES-GCM и ответил только на legacy
+var errCodecDowngrade = errors.New("controller does not support codec_version 2, pass allow_legacy=true to use legacy codec")
+
+// Вес последнего замера в скользящей задержке
+const latencyWeight = 0.2
+
+var health = newHealthRegistry()
+
+type controllerHealth struct {
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	LatencyMs   float64    `json:"latency_ms"`
+	DeviceCount int        `json:"device_count"`
+	Firmware    string     `json:"firmware,omitempty"`
+}
+
+type healthRegistry struct {
+	mutex       sync.Mutex
+	controllers map[int]controllerHealth
+}
+
+func newHealthRegistry() *healthRegistry {
+	return &healthRegistry{controllers: make(map[int]controllerHealth)}
+}
+
+// record запоминает результат обращения к контроллеру по его id. Еще не сохраненный
+// контроллер с id = 0 не запоминается
+func (r *healthRegistry) record(id int, latency time.Duration, devices int, firmware string, err error) {
+	if id == 0 {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	h, ok := r.controllers[id]
+	now := time.Now()
+
+	ms := float64(latency) / float64(time.Millisecond)
+	if !ok || h.LatencyMs == 0 {
+		h.LatencyMs = ms
+	} else {
+		h.LatencyMs = latencyWeight*ms + (1-latencyWeight)*h.LatencyMs
+	}
+
+	if firmware != "" {
+		h.Firmware = firmware
+	}
+
+	if err != nil {
+		h.LastError = err.Error()
+		h.LastErrorAt = &now
+	} else {
+		h.LastSuccess = &now
+		h.DeviceCount = devices
+	}
+
+	r.controllers[id] = h
+}
+
+// get возвращает состояние контроллера или nil, если к нему еще не обращались
+func (r *healthRegistry) get(id int) *controllerHealth {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	h, ok := r.controllers[id]
+	if !ok {
+		return nil
+	}
+
+	return &h
+}
+
+// remove забывает состояние удаленного контроллера
+func (r *healthRegistry) remove(id int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.controllers, id)
+}
+
+type controllerTestResult struct {
+	OK          bool    `json:"ok"`
+	Stage       string  `json:"stage,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	LatencyMs   float64 `json:"latency_ms"`
+	DeviceCount int     `json:"device_count"`
+	Firmware    string  `json:"firmware,omitempty"`
+	Downgraded  bool    `json:"downgraded,omitempty"`
+}
+
+// probeController выполняет getalldevices в обход автомата и возвращает подробный результат.
+// Успешная проверка закрывает автомат контроллера id, у еще не сохраненного контроллера id = 0
+func probeController(c context.Context, id int, username string, password string, host string, codec controllerCodec) controllerTestResult {
+	ctx, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+
+	started := time.Now()
+	devices, firmware, err := requestUserDevicesFromSmartHome(ctx, id, username, password, host, codec)
+	latency := time.Since(started)
+	health.record(id, latency, len(devices), firmware, err)
+
+	result := controllerTestResult{
+		OK:          err == nil,
+		LatencyMs:   float64(latency) / float64(time.Millisecond),
+		DeviceCount: len(devices),
+		Firmware:    firmware,
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+		if errors.Is(err, errControllerResponse) {
+			result.Stage = "response"
+		} else {
+			result.Stage = "connection"
+		}
+		return result
+	}
+
+	if id != 0 {
+		breakers.reset(id)
+	}
+
+	return result
+}
+
+// negotiateCodec проверяет контроллер заданной версией кодека. Для версии 0 сначала пробуется
+// AES-GCM, если задан ключ, затем legacy. Возвращает версию, на которую ответил контроллер,
+// или предпочтительную, если не ответил ни на одну.
+// Переход с заданным ключом на legacy допускается только с allowLegacy: иначе контроллер,
+// не принявший ключ, молча работал бы без шифрования
+func negotiateCodec(c context.Context, id int, username string, password string, host string, version int, key string, allowLegacy bool) (int, controllerTestResult) {
+	versions := []int{version}
+	if version == 0 {
+		versions = []int{codecLegacy}
+		if key != "" {
+			versions = []int{codecAESGCM, codecLegacy}
+		}
+	}
+
+	var result controllerTestResult
+	for _, v := range versions {
+		// При автоматическом выборе ключ относится к AES-GCM, legacy проверяется общим ключом
+		codecKey := key
+		if version == 0 && v == codecLegacy {
+			codecKey = ""
+		}
+
+		codec, err := newCodec(v, codecKey)
+		if err != nil {
+			result = controllerTestResult{Stage: "codec", Error: err.Error()}
+			continue
+		}
+
+		probe := probeController(c, id, username, password, host, codec)
+		if !probe.OK {
+			result = probe
+			continue
+		}
+
+		if v != versions[0] {
+			if !allowLegacy {
+				probe.OK = false
+				probe.Stage = "codec"
+				probe.Error = errCodecDowngrade.Error()
+				return versions[0], probe
+			}
+			probe.Downgraded = true
+			msu.Warn(c, errCodecDowngrade, zap.Int("controller", id), zap.String("host", host))
+		}
+		return v, probe
+	}
+
+	return versions[0], result
+}
+
+// probeDriver проверяет контроллер с драйвером, отличным от http, чтением состояния всех устройств
+func probeDriver(c context.Context, id int, driver controllerDriver, uri string) controllerTestResult {
+	ctx, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+
+	started := time.Now()
+	devices, err := driver.state(ctx, nil)
+	latency := time.Since(started)
+	health.record(id, latency, len(devices), "", err)
+
+	result := controllerTestResult{
+		OK:          err == nil,
+		LatencyMs:   float64(latency) / float64(time.Millisecond),
+		DeviceCount: len(devices),
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+		result.Stage = "connection"
+		return result
+	}
+
+	if id != 0 {
+		breakers.reset(id)
+	}
+
+	return result
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// keyGracePeriod - сколько после смены ключа принимаются ответы, зашифрованные старым ключом
+var keyGracePeriod = 24 * time.Hour
+
+var (
+	// errSharedKeyRotation - новый ключ, зашифрованный общим ключом прошивки, прочитает любой
+	errSharedKeyRotation = errors.New("controller uses the shared legacy key, set codec_key over the API instead of rotation")
+	// errKeyRejected - контроллер ответил, что ключ не принят, и остался на текущем ключе
+	errKeyRejected = errors.New("key rejected")
+)
+
+// generateCodecKey создает ключ контроллера: 32 байта для AES-GCM, 16 для legacy, в hex
+func generateCodecKey(version int) (string, error) {
+	size := 16
+	if version == codecAESGCM {
+		size = 32
+	}
+
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(key), nil
+}
+
+// rotatingCodec шифрует новым ключом, а расшифровывает новым или, до окончания
+// переходного периода, старым
+type rotatingCodec struct {
+	current  controllerCodec
+	previous controllerCodec
+	until    time.Time
+	now      func() time.Time
+}
+
+func (c rotatingCodec) version() int {
+	return c.current.version()
+}
+
+func (c rotatingCodec) encode(source string) (string, error) {
+	return c.current.encode(source)
+}
+
+// decode считает расшифровку удачной, только если получился JSON:
+// legacy с чужим ключом не всегда возвращает ошибку
+func (c rotatingCodec) decode(source string) (string, error) {
+	decoded, err := c.current.decode(source)
+	if err == nil && json.Valid([]byte(decoded)) {
+		return decoded, nil
+	}
+
+	if c.now().Before(c.until) {
+		if previous, e := c.previous.decode(source); e == nil && json.Valid([]byte(previous)) {
+			return previous, nil
+		}
+	}
+
+	if err == nil {
+		err = errCodecDecode
+	}
+
+	return "", err
+}
+
+// keyGraceUntil возвращает, до какого времени принимается предыдущий ключ контроллера
+func keyGraceUntil(rotatedAt string) (time.Time, bool) {
+	rotated, err := time.Parse(time.RFC3339, rotatedAt)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return rotated.Add(keyGracePeriod), true
+}
+
+// controllerCodecFor возвращает кодек контроллера по строке из controllers.
+// Если ключ недавно сменили, старый ключ принимается еще keyGracePeriod
+func controllerCodecFor(version int, key string, previousKey string, rotatedAt string) (controllerCodec, error) {
+	current, err := newCodec(version, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if rotatedAt == "" {
+		return current, nil
+	}
+
+	if _, err = time.Parse(time.RFC3339, rotatedAt); err != nil {
+		return nil, err
+	}
+
+	until, _ := keyGraceUntil(rotatedAt)
+	if time.Now().After(until) {
+		return current, nil
+	}
+
+	previous, err := newCodec(version, previousKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return rotatingCodec{current: current, previous: previous, until: until, now: time.Now}, nil
+}
+
+// usesSharedKey - кодек шифрует общим ключом прошивки
+func usesSharedKey(codec controllerCodec) bool {
+	if rotating, ok := codec.(rotatingCodec); ok {
+		codec = rotating.current
+	}
+
+	legacy, ok := codec.(legacyCodec)
+	return ok && legacy.key == encryptKey
+}
+
+// requestKeyRotation передает контроллеру ключ key командой setkey, зашифрованной текущим ключом.
+// Контроллер подтверждает смену ответом {"result":"ok"}, errKeyRejected - контроллер отказал.
+// При других ошибках неизвестно, принял ли контроллер ключ
+func requestKeyRotation(c context.Context, username string, password string, host string, codec controllerCodec, key string) error {
+	ctx, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+
+	if usesSharedKey(codec) {
+		return errSharedKeyRotation
+	}
+
+	next, err := newCodec(codec.version(), key)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(struct {
+		Login    string `json:"login"`
+		Password string `json:"password"`
+		Key      string `json:"key"`
+	}{Login: username, Password: password, Key: key})
+	if err != nil {
+		return err
+	}
+
+	request, err := controllerQuery(codec, "setkey", string(payload))
+	if err != nil {
+		return err
+	}
+
+	msu.Info(ctx, zap.String("request", "controller"), zap.String("command", "setkey"), zap.String("uri", host))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", host+"?"+request, nil)
+	if err != nil {
+		return err
+	}
+
+	client := controllerClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: status %d", errControllerResponse, resp.StatusCode)
+	}
+
+	var body []byte
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return err
+	}
+
+	// Контроллер может ответить как новым, так и старым ключом
+	reply := rotatingCodec{current: next, previous: codec, until: time.Now().Add(time.Minute), now: time.Now}
+	decoded, err := reply.decode(strings.TrimSpace(string(body)))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errControllerResponse, err)
+	}
+
+	result := struct {
+		Result string `json:"result"`
+	}{}
+	if err = json.Unmarshal([]byte(decoded), &result); err != nil {
+		return fmt.Errorf("%w: %v", errControllerResponse, err)
+	}
+
+	if result.Result != "ok" {
+		return fmt.Errorf("%w: %s", errKeyRejected, result.Result)
+	}
+
+	return nil
+}
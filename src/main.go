@@ -2,14 +2,15 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"strings"
-	"sync"
 	"time"
 
 	"net/http"
@@ -39,12 +40,28 @@ var (
 	msu               *logger.MsuLogger
 	databaseErrors    prometheus.Counter
 	getDurations      *prometheus.HistogramVec
+	breakerStates     *prometheus.GaugeVec
 	httpsEnabled      = true
-	timeout           = 15
+	timeout           = 15 * time.Second
 	databaseDirectory = "/tmp"
 	db                *sql.DB
 
+	controllerPoller *poller
+	pollInterval     = 30 * time.Second
+	pollConcurrency  = 4
+
 	debug = true
+
+	// commands - дополнительные режимы запуска: bsh-backend <command> [flags]
+	commands = map[string]func(args []string) error{
+		"fakecontroller": runFakeController,
+		"agent":          runAgent,
+		"migrate":        runMigrate,
+		"secrets":        runSecrets,
+		"backup":         runBackup,
+		"clients":        runClients,
+		"passwords":      runPasswords,
+	}
 )
 
 func main() {
@@ -72,6 +89,36 @@ func main() {
 
 	msu = logger.NewMsuLogger(zaplogger, Product, Component)
 
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			// Флаги принадлежат команде, настройки берутся из файла и окружения
+			conf, _, err := loadConfig(nil)
+			if err != nil {
+				msu.Fatal(context.Background(), err)
+			}
+			conf.apply()
+
+			if err := command(os.Args[2:]); err != nil {
+				msu.Fatal(context.Background(), err)
+			}
+			return
+		}
+	}
+
+	conf, printConfig, err := loadConfig(os.Args[1:])
+	if err != nil {
+		msu.Fatal(context.Background(), err)
+	}
+	if printConfig {
+		out, err := conf.print()
+		if err != nil {
+			msu.Fatal(context.Background(), err)
+		}
+		fmt.Print(out)
+		return
+	}
+	conf.apply()
+
 	/** PROMETHEUS */
 	/* Database errors counter */
 	databaseErrors = prometheus.NewCounter(
@@ -86,6 +133,29 @@ func main() {
 	},
 		[]string{"api"})
 	prometheus.MustRegister(getDurations)
+	/* Controller circuit breaker state: 0 - closed, 1 - open, 2 - half-open */
+	breakerStates = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "controller_breaker_state",
+		Help: "controller circuit breaker state",
+	},
+		[]string{"controller"})
+	prometheus.MustRegister(breakerStates)
+	/* Expired authorization requests, codes and tokens removed by the janitor */
+	authRequestsExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "auth_requests_expired_total",
+		Help: "expired authorization requests removed",
+	})
+	prometheus.MustRegister(authRequestsExpired)
+	authCodesExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "auth_codes_expired_total",
+		Help: "expired authorization codes removed",
+	})
+	prometheus.MustRegister(authCodesExpired)
+	tokensExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "oauth_tokens_expired_total",
+		Help: "expired access and refresh token pairs removed",
+	})
+	prometheus.MustRegister(tokensExpired)
 
 	corsOpts := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"}, //you service is available and allowed for this base url
@@ -105,9 +175,12 @@ func main() {
 		},
 	})
 
-	if _, ok := os.LookupEnv("HTTPS_DISABLED"); ok {
-		httpsEnabled = false
+	// Блокировка не дает восстановить копию поверх базы работающего сервера
+	unlock, err := lockDatabase(databaseDirectory + "/users.db")
+	if err != nil {
+		msu.Fatal(context.Background(), err)
 	}
+	defer unlock()
 
 	if err := initializeDB(context.Background(), databaseDirectory+"/users.db"); err != nil {
 		msu.Fatal(context.Background(), err)
@@ -118,26 +191,94 @@ func main() {
 	}
 	defer db.Close()
 
+	if secretKeys, err = loadSecretKeyring(); err != nil {
+		msu.Fatal(context.Background(), err)
+	}
+	if secretKeys == nil {
+		sealed, err := sealedControllers(context.Background(), db)
+		if err != nil {
+			msu.Fatal(context.Background(), err)
+		}
+		if sealed > 0 {
+			msu.Fatal(context.Background(), fmt.Errorf("CONTROLLER_SECRETS_KEY is not set, but secrets of %d controllers are encrypted", sealed))
+		}
+		msu.Warn(context.Background(), errors.New("CONTROLLER_SECRETS_KEY is not set, controller secrets are stored in plaintext"))
+	} else if count, err := rewrapControllerSecrets(context.Background(), db, secretKeys); err != nil {
+		msu.Fatal(context.Background(), err)
+	} else if count > 0 {
+		msu.Info(context.Background(), zap.String("secrets", "encrypted"), zap.Int("controllers", count))
+	}
+
+	// Ключ лежит рядом с копиями базы: каталог копий в Docker - том, а сами копии ключа не содержат
+	tokenKey, err := loadTokenKey(context.Background(), db, backupDir()+"/token.key")
+	if err != nil {
+		msu.Fatal(context.Background(), err)
+	}
+	if count, err := hashStoredTokens(context.Background(), db, tokenKey); err != nil {
+		msu.Fatal(context.Background(), err)
+	} else if count > 0 {
+		msu.Info(context.Background(), zap.String("tokens", "hashed"), zap.Int("count", count))
+		msu.Warn(context.Background(), fmt.Errorf("backups in %s taken before tokens were hashed still hold them in plaintext", backupDir()))
+	}
+	store = newSQLiteStorage(db, secretKeys, tokenKey)
+
+	// Без клиентов OAuth платформы не могут связать аккаунты
+	if err := seedYandexClient(context.Background(), store, yandexClientSecret, yandexRedirectURI); err != nil {
+		msu.Fatal(context.Background(), err)
+	}
+	if clients, err := store.oauthClients(context.Background()); err != nil {
+		msu.Fatal(context.Background(), err)
+	} else if len(clients) == 0 {
+		msu.Fatal(context.Background(), errors.New("no OAuth clients registered: set YANDEX_CLIENT_SECRET to the client secret of the Yandex skill or run bsh-backend clients add"))
+	}
+
+	// Пароли в md5 пересчитываются при входе, оставшиеся видны в логе и в команде passwords report
+	if legacy, total, err := store.legacyPasswordUsers(context.Background()); err != nil {
+		msu.Error(context.Background(), err)
+	} else if len(legacy) > 0 {
+		msu.Info(context.Background(), zap.String("passwords", "legacy md5"), zap.Int("users", len(legacy)), zap.Int("total", total))
+	}
+
+	go runCommandQueue(context.Background(), commandQueueInterval)
+
+	if backupInterval > 0 {
+		go runBackups(context.Background(), backupInterval)
+	}
+
+	go runAuthJanitor(context.Background(), authJanitorInterval)
+
+	controllerPoller = newPoller(pollInterval, pollConcurrency)
+	controllerPoller.subscribe(appEvents.publish)
+	if yandexSkillID != "" {
+		notifier := newYandexNotifier(yandexSkillID, yandexSkillToken)
+		go notifier.run(context.Background())
+		controllerPoller.subscribe(notifier.publish)
+	} else {
+		msu.Warn(context.Background(), errors.New("YANDEX_SKILL_ID is not set, device state changes are not reported to Yandex"))
+	}
+	if pollEnabled {
+		go controllerPoller.run(context.Background())
+	}
+
 	if httpsEnabled {
-		dir := "/opt/certs"
 		hostPolicy := func(ctx context.Context, host string) error {
 			return nil
 		}
 		certManager := autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
 			HostPolicy: hostPolicy,
-			Cache:      autocert.DirCache(dir),
-			Email:      "info@msural.ru",
+			Cache:      autocert.DirCache(certDirectory),
+			Email:      autocertEmail,
 		}
 
 		server := &http.Server{
-			Addr:      ":8443",
+			Addr:      httpsAddr,
 			Handler:   prometheusHandler(corsOpts.Handler(handlers())),
 			TLSConfig: certManager.TLSConfig(),
 		}
 
 		go func(s *http.Server) {
-			err := http.ListenAndServe(":8080", certManager.HTTPHandler(nil))
+			err := http.ListenAndServe(httpAddr, certManager.HTTPHandler(nil))
 			if err != nil {
 				if e := s.Shutdown(context.Background()); e != nil {
 					msu.Fatal(context.Background(), e)
@@ -148,7 +289,7 @@ func main() {
 
 		err = server.ListenAndServeTLS("", "")
 	} else {
-		err = http.ListenAndServe(":8080", prometheusHandler(corsOpts.Handler(handlers())))
+		err = http.ListenAndServe(httpAddr, prometheusHandler(corsOpts.Handler(handlers())))
 		//err = http.ListenAndServe(":8080", corsOpts.Handler(handlers()))
 	}
 
@@ -162,8 +303,9 @@ func handlers() http.Handler {
 
 	// Yandex API
 	r.HandleFunc("/api/v1.0", head).Methods(http.MethodHead)
-	r.HandleFunc("/auth/authorize", authorize)
-	r.HandleFunc("/auth/token", token)
+	r.HandleFunc("/auth/authorize", authorize).Methods(http.MethodGet)
+	r.HandleFunc("/auth/token", token).Methods(http.MethodPost)
+	r.HandleFunc("/auth/revoke", revoke).Methods(http.MethodPost)
 	r.HandleFunc("/api/v1.0/user/unlink", unlink).Methods(http.MethodPost)
 	r.HandleFunc("/api/v1.0/user/devices", devices).Methods(http.MethodGet)
 	r.HandleFunc("/api/v1.0/user/devices/action", action).Methods(http.MethodPost)
@@ -180,6 +322,17 @@ func handlers() http.Handler {
 	r.HandleFunc("/controllers", createController).Methods(http.MethodPost)
 	r.HandleFunc("/controllers/{id}", updateController).Methods(http.MethodPut)
 	r.HandleFunc("/controllers/{id}", deleteController).Methods(http.MethodDelete)
+	r.HandleFunc("/controllers/{id}/test", testController).Methods(http.MethodPost)
+	r.HandleFunc("/controllers/{id}/rotate-key", rotateControllerKey).Methods(http.MethodPost)
+	r.HandleFunc("/controllers/{id}/tunnel", enableControllerTunnel).Methods(http.MethodPost)
+	r.HandleFunc("/controllers/{id}/state", pushControllerState).Methods(http.MethodPost)
+	r.HandleFunc("/controllers/{id}/devices", getDeviceIDs).Methods(http.MethodGet)
+	r.HandleFunc("/controllers/{id}/devices/{device_id}", rebindDeviceID).Methods(http.MethodPut)
+	r.HandleFunc("/commands", getCommands).Methods(http.MethodGet)
+	r.HandleFunc("/commands/{id}", cancelCommand).Methods(http.MethodDelete)
+	r.HandleFunc("/events", streamEvents).Methods(http.MethodGet)
+	// Controller agents behind NAT
+	r.Handle("/tunnel", tunnelHandler())
 	// PROMETHEUS
 	r.Handle("/metrics", promhttp.Handler())
 
@@ -194,52 +347,40 @@ func head(w http.ResponseWriter, r *http.Request) {
 func authorize(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	requestID := generateUUID()
-
-	mutex := sync.Mutex{}
-
-	mutex.Lock()
-	defer mutex.Unlock()
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{})
-	if err != nil {
-		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer tx.Rollback()
+	msu.Info(ctx, zap.Any("query", r.URL.Query()))
 
-	if _, err := db.ExecContext(ctx,
-		`INSERT INTO auth_requests (id, request, dt) VALUES ($1, $2, $3)`,
-		requestID, r.URL.RawQuery, time.Now().Format(time.RFC3339)); err != nil {
-		msu.Error(ctx,
-			err,
+	request, oauthErr := parseAuthorizationRequest(ctx, r.URL.Query())
+	if oauthErr != nil {
+		msu.Warn(ctx,
+			oauthErr,
 			zap.Any("uri", r.RequestURI),
 			zap.Any("query", r.URL.Query()))
-		w.WriteHeader(http.StatusInternalServerError)
+		// Ошибки до проверки client_id и redirect_uri показываются пользователю, остальные уходят клиенту
+		if request.redirectURI != "" {
+			oauthRedirect(w, request.redirectURI, authorizationErrorParams(request, oauthErr))
+			return
+		}
+		writeOAuthError(w, oauthErr)
 		return
 	}
 
-	if err = tx.Commit(); err != nil {
+	requestID := generateUUID()
+
+	// Параметры проверяются еще раз при входе, поэтому запрос сохраняется как есть
+	if err := store.createAuthRequest(ctx, requestID, r.URL.RawQuery, time.Now()); err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")))
-		w.WriteHeader(http.StatusInternalServerError)
+			zap.Any("query", r.URL.Query()))
+		writeOAuthError(w, newOAuthError(http.StatusInternalServerError, "server_error", "authorization request is not saved"))
 		return
 	}
 
-	msu.Info(ctx, zap.Any("query", r.URL.Query()))
-
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/text;charset=UTF-8")
+	w.Header().Set("Content-Type", "text/html;charset=UTF-8")
 	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("X-Request-Id", requestID)
+	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, string(`<!DOCTYPE html>
 	<html lang="ru">
 	<head>
@@ -252,6 +393,7 @@ func authorize(w http.ResponseWriter, r *http.Request) {
 		</div>
 	
 		<div class="container">
+		<p>`+html.EscapeString(request.client.Name)+`</p>
 		<label for="uname"><b>Username</b></label>
 		<input type="text" placeholder="Enter Username" name="username" required>
 		<br>
@@ -270,317 +412,262 @@ func authorize(w http.ResponseWriter, r *http.Request) {
 	// <button type="button" class="cancelbtn">Cancel</button>
 	//	<span class="psw">Forgot <a href="#">password?</a></span>
 	//	</div>
-
-	//w.Header().Set("Location", "https://social.yandex.net/broker/redirect?"+r.URL.RawQuery+"&code="+generateUUID())
-	//w.WriteHeader(http.StatusMovedPermanently)
 }
 
 func login(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	var err error
-	var body []byte
-	if body, err = ioutil.ReadAll(r.Body); err != nil {
+	if err := r.ParseForm(); err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")))
-		w.WriteHeader(http.StatusBadRequest)
+			zap.Any("query", r.URL.Query()))
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_request", "malformed form"))
 		return
 	}
-	defer r.Body.Close()
+
+	username := r.PostForm.Get("username")
+	password := r.PostForm.Get("password")
+	request := r.PostForm.Get("rid")
 
 	msu.Info(ctx,
-		zap.String("request", "yandex"),
+		zap.String("request", "login"),
 		zap.Any("uri", r.RequestURI),
-		zap.Any("query", r.URL.Query()),
-		zap.Any("AuthHeader", r.Header.Get("Authorization")),
-		zap.Any("body", string(body)))
-
-	username := ""
-	password := ""
-	request := ""
-	// credentials from body
-	for _, val := range strings.Split(string(body), "&") {
-		if strings.HasPrefix(val, "username") {
-			temp := strings.Split(val, "=")
-			if len(temp) == 2 {
-				username = temp[len(temp)-1]
-			}
-			continue
-		}
-
-		if strings.HasPrefix(val, "password") {
-			temp := strings.Split(val, "=")
-			if len(temp) == 2 {
-				password = temp[len(temp)-1]
-			}
-			continue
-		}
-
-		if strings.HasPrefix(val, "rid") {
-			temp := strings.Split(val, "=")
-			if len(temp) == 2 {
-				request = temp[len(temp)-1]
-			}
-			continue
-		}
-	}
-	//
+		zap.String("username", username),
+		zap.String("rid", request))
 
 	if username == "" || password == "" || request == "" {
 		msu.Error(ctx,
 			errors.New("username, password or requestId is empty"),
 			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
-		w.WriteHeader(http.StatusBadRequest)
+			zap.String("username", username),
+			zap.String("rid", request))
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_request", "username, password and rid are required"))
 		return
 	}
 
-	// check user exists
-	var rows *sql.Rows
-	if rows, err = db.QueryContext(ctx,
-		`SELECT id FROM users WHERE name = $1 AND password = $2`,
-		username,
-		fmt.Sprintf("%x", md5.Sum([]byte(password)))); err != nil {
+	user, err := authenticateUser(ctx, username, password)
+	if err != nil && err != errNotFound {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
-		w.WriteHeader(http.StatusInternalServerError)
+			zap.String("username", username),
+			zap.String("rid", request))
+		writeOAuthError(w, newOAuthError(http.StatusInternalServerError, "server_error", "user lookup failed"))
 		return
 	}
 
-	id := 0
-	if rows.Next() {
-		if err = rows.Scan(&id); err != nil {
-			msu.Error(ctx,
-				err,
-				zap.Any("uri", r.RequestURI),
-				zap.Any("query", r.URL.Query()),
-				zap.Any("AuthHeader", r.Header.Get("Authorization")),
-				zap.Any("body", string(body)))
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-	} else {
+	if err == errNotFound {
 		msu.Error(ctx,
 			errors.New("invalid login or password"),
 			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
-		w.WriteHeader(http.StatusBadRequest)
+			zap.String("username", username),
+			zap.String("rid", request))
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_request", "invalid username or password"))
 		return
 	}
-	rows.Close()
 	//
 
-	// get r.URL.RawQuery for yandex response
-	urlRawQuery := ""
-	if err = db.QueryRowContext(ctx, `SELECT request FROM auth_requests WHERE id = $1`, request).Scan(&urlRawQuery); err != nil {
+	// Запрос авторизации, сохраненный в authorize
+	rawQuery, created, err := store.authRequest(ctx, request)
+	if err == nil && time.Since(created) > authRequestTTL {
+		err = errors.New("authorization request expired")
+	}
+	if err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
-		w.WriteHeader(http.StatusBadRequest)
+			zap.String("username", username),
+			zap.String("rid", request))
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_request", "unknown or expired authorization request"))
 		return
 	}
-	//
-
-	code := generateUUID()
 
-	mutex := sync.Mutex{}
-
-	mutex.Lock()
-	defer mutex.Unlock()
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{})
+	query, err := url.ParseQuery(rawQuery)
 	if err != nil {
-		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
-		w.WriteHeader(http.StatusInternalServerError)
+		msu.Error(ctx, err, zap.String("rid", request))
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_request", "malformed authorization request"))
 		return
 	}
-	defer tx.Rollback()
-	// set code to users
-	if _, err = tx.ExecContext(ctx, `UPDATE users SET yandex_code = $1 WHERE name = $2`, code, username); err != nil {
-		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
-		w.WriteHeader(http.StatusBadRequest)
+	// Клиента могли удалить или изменить после открытия страницы входа
+	authorization, oauthErr := parseAuthorizationRequest(ctx, query)
+	if oauthErr != nil {
+		msu.Error(ctx, oauthErr, zap.String("rid", request), zap.Any("query", query))
+		writeOAuthError(w, oauthErr)
 		return
 	}
 	//
 
-	// remove request from auth_requests
-	if _, err = tx.ExecContext(ctx, `DELETE FROM auth_requests WHERE id = $1`, request); err != nil {
-		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	code := authCode{
+		Code:            generateUUID(),
+		UserID:          user.ID,
+		ClientID:        authorization.client.ID,
+		Scope:           authorization.scope,
+		Challenge:       authorization.challenge,
+		ChallengeMethod: authorization.challengeMethod,
+		IssuedAt:        time.Now(),
+	}
+	if authorization.explicitRedirect {
+		code.RedirectURI = authorization.redirectURI
 	}
-	//
 
-	if err = tx.Commit(); err != nil {
+	// save code and remove request from auth_requests
+	if err = store.completeAuthRequest(ctx, request, code); err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
-		w.WriteHeader(http.StatusBadRequest)
+			zap.String("username", username),
+			zap.String("rid", request))
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_request", "unknown or expired authorization request"))
 		return
 	}
 
-	w.Header().Set("Location", "https://social.yandex.net/broker/redirect?"+urlRawQuery+"&code="+code)
-	w.WriteHeader(http.StatusMovedPermanently)
+	params := url.Values{"code": {code.Code}}
+	if authorization.state != "" {
+		params.Set("state", authorization.state)
+	}
+	oauthRedirect(w, authorization.redirectURI, params)
+}
 
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope,omitempty"`
 }
 
 func token(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	var err error
-	var body []byte
-	if body, err = ioutil.ReadAll(r.Body); err != nil {
+	if err := r.ParseForm(); err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")))
-		w.WriteHeader(http.StatusBadRequest)
+			zap.Any("query", r.URL.Query()))
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_request", "malformed form"))
 		return
 	}
-	defer r.Body.Close()
+
+	grantType := r.PostForm.Get("grant_type")
 
 	msu.Info(ctx,
-		zap.String("request", "yandex"),
+		zap.String("request", "token"),
 		zap.Any("uri", r.RequestURI),
-		zap.Any("query", r.URL.Query()),
-		zap.Any("AuthHeader", r.Header.Get("Authorization")),
-		zap.Any("body", string(body)))
-
-	// grant_type=refresh_token
-	code := ""
-	grant_type := ""
-	refresh_token := ""
-	// credentials from body
-	msu.Info(ctx, zap.Any("query", strings.Split(string(body), "&")))
-	for _, val := range strings.Split(string(body), "&") {
-		if strings.HasPrefix(val, "code") {
-			temp := strings.Split(val, "=")
-			if len(temp) == 2 {
-				code = temp[len(temp)-1]
-			}
-		} else if strings.HasPrefix(val, "grant_type") {
-			temp := strings.Split(val, "=")
-			if len(temp) == 2 {
-				grant_type = temp[len(temp)-1]
-			}
-		} else if strings.HasPrefix(val, "refresh_token") {
-			temp := strings.Split(val, "=")
-			if len(temp) == 2 {
-				refresh_token = temp[len(temp)-1]
-			}
+		zap.String("grant_type", grantType),
+		zap.String("client_id", r.PostForm.Get("client_id")))
+
+	client, oauthErr := authenticateClient(ctx, r)
+	if oauthErr == nil {
+		if name := repeatedParameter(r.PostForm); name != "" {
+			oauthErr = newOAuthError(http.StatusBadRequest, "invalid_request", name+" must not be repeated")
 		}
 	}
-	//
-
-	access_token := generateUUID()
+	if oauthErr != nil {
+		msu.Error(ctx, oauthErr, zap.Any("uri", r.RequestURI), zap.String("grant_type", grantType))
+		writeOAuthError(w, oauthErr)
+		return
+	}
 
-	var commandTag sql.Result
+	now := time.Now()
+	tokens := newTokenPair(now)
 
-	mutex := sync.Mutex{}
+	var err error
+	switch grantType {
+	case "authorization_code": // Выдаем новое семейство токенов
+		var code authCode
+		if code, oauthErr = exchangeAuthCode(ctx, client, r.PostForm); oauthErr == nil {
+			tokens.Family = generateUUID()
+			tokens.UserID = code.UserID
+			tokens.ClientID = client.ID
+			tokens.Scope = code.Scope
+			err = store.createTokens(ctx, tokens)
+		}
+	case "refresh_token": // Обмениваем токен обновления на новую пару того же семейства
+		refreshToken := r.PostForm.Get("refresh_token")
+		if refreshToken == "" {
+			oauthErr = newOAuthError(http.StatusBadRequest, "invalid_request", "refresh_token is required")
+			break
+		}
+		tokens, err = store.rotateRefreshToken(ctx, refreshToken, client.ID, tokens, now)
+		switch err {
+		case errNotFound:
+			oauthErr = newOAuthError(http.StatusBadRequest, "invalid_grant", "unknown, expired or revoked refresh_token")
+			err = nil
+		case errTokenReused:
+			msu.Warn(ctx, err, zap.String("client_id", client.ID))
+			oauthErr = newOAuthError(http.StatusBadRequest, "invalid_grant", "refresh_token was already used, tokens are revoked")
+			err = nil
+		}
+	case "":
+		oauthErr = newOAuthError(http.StatusBadRequest, "invalid_request", "grant_type is required")
+	default:
+		oauthErr = newOAuthError(http.StatusBadRequest, "unsupported_grant_type", "grant_type "+grantType+" is not supported")
+	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{})
 	if err != nil {
-		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
-		w.WriteHeader(http.StatusInternalServerError)
+		oauthErr = newOAuthError(http.StatusInternalServerError, "server_error", "token is not issued")
+		msu.Error(ctx, err, zap.Any("uri", r.RequestURI), zap.String("client_id", client.ID))
+	}
+	if oauthErr != nil {
+		msu.Error(ctx, oauthErr, zap.Any("uri", r.RequestURI), zap.String("client_id", client.ID), zap.String("grant_type", grantType))
+		writeOAuthError(w, oauthErr)
 		return
 	}
-	defer tx.Rollback()
+	//
 
-	if grant_type == "authorization_code" { // Выдаем новый токен
-		commandTag, err = tx.ExecContext(ctx, `UPDATE users SET yandex_token = $1 WHERE yandex_code = $2`, access_token, code)
-	} else if grant_type == "refresh_token" { // Проверяем токен, выдаем новый
-		msu.Info(ctx, zap.Any("access_token", access_token), zap.Any("refresh_token", refresh_token))
-		commandTag, err = tx.ExecContext(ctx, `UPDATE users SET yandex_token = $1 WHERE yandex_token = $2`, access_token, refresh_token)
-	}
+	result, _ := json.Marshal(tokenResponse{
+		AccessToken:  tokens.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL / time.Second),
+		RefreshToken: tokens.RefreshToken,
+		Scope:        tokens.Scope,
+	})
 
-	if err != nil {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, string(result))
+}
+
+// revoke отзывает токен клиента по RFC 7009 вместе с его семейством. Ответ не раскрывает,
+// был ли токен действующим
+func revoke(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if err := r.ParseForm(); err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")))
-		w.WriteHeader(http.StatusInternalServerError)
+			zap.Any("query", r.URL.Query()))
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_request", "malformed form"))
 		return
 	}
 
-	if i, err := commandTag.RowsAffected(); err != nil {
-		if i == 0 {
-			msu.Error(ctx,
-				err,
-				zap.Any("uri", r.RequestURI),
-				zap.Any("query", r.URL.Query()),
-				zap.Any("AuthHeader", r.Header.Get("Authorization")))
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	msu.Info(ctx,
+		zap.String("request", "revoke"),
+		zap.Any("uri", r.RequestURI),
+		zap.String("client_id", r.PostForm.Get("client_id")),
+		zap.String("token_type_hint", r.PostForm.Get("token_type_hint")))
+
+	client, oauthErr := authenticateClient(ctx, r)
+	if oauthErr == nil && r.PostForm.Get("token") == "" {
+		oauthErr = newOAuthError(http.StatusBadRequest, "invalid_request", "token is required")
+	}
+	if oauthErr != nil {
+		msu.Error(ctx, oauthErr, zap.Any("uri", r.RequestURI))
+		writeOAuthError(w, oauthErr)
+		return
 	}
-	//
 
-	if err = tx.Commit(); err != nil {
-		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")))
-		w.WriteHeader(http.StatusBadRequest)
+	if err := store.revokeTokenFamily(ctx, r.PostForm.Get("token"), client.ID, time.Now()); err != nil && err != errNotFound {
+		msu.Error(ctx, err, zap.Any("uri", r.RequestURI), zap.String("client_id", client.ID))
+		writeOAuthError(w, newOAuthError(http.StatusServiceUnavailable, "server_error", "token is not revoked"))
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("Pragma", "no-cache")
 	w.WriteHeader(http.StatusOK)
-
-	msu.Info(ctx, zap.Any("response", string(`{
-		"access_token":"`+access_token+`",
-		"token_type":"Bearer",
-		"expires_in": 62208000,
-		"refresh_token":"`+access_token+`"
-	}`)))
-	fmt.Fprint(w,
-		string(`{
-			"access_token":"`+access_token+`",
-			"token_type":"Bearer",
-			"expires_in": 62208000,
-			"refresh_token":"`+access_token+`"
-		}`),
-	)
 }
 
 func unlink(w http.ResponseWriter, r *http.Request) {
@@ -605,12 +692,8 @@ func unlink(w http.ResponseWriter, r *http.Request) {
 		zap.Any("query", r.URL.Query()),
 		zap.Any("AuthHeader", r.Header.Get("Authorization")))
 
-	mutex := sync.Mutex{}
-
-	mutex.Lock()
-	defer mutex.Unlock()
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{})
-	if err != nil {
+	// Отзывается все семейство токена. Его могли отозвать раньше, повторная отвязка тоже успешна
+	if err = store.revokeTokenFamily(ctx, token, "", time.Now()); err != nil && err != errNotFound {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
@@ -619,43 +702,8 @@ func unlink(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	defer tx.Rollback()
-
-	var commandTag sql.Result
-	// select and update token from code
-	if commandTag, err = tx.ExecContext(ctx, `UPDATE users SET yandex_token = null WHERE yandex_token = $1`, token); err != nil {
-		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	if i, err := commandTag.RowsAffected(); err != nil {
-		if i == 0 {
-			msu.Error(ctx,
-				err,
-				zap.Any("uri", r.RequestURI),
-				zap.Any("query", r.URL.Query()),
-				zap.Any("AuthHeader", r.Header.Get("Authorization")))
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-	}
 	//
 
-	if err = tx.Commit(); err != nil {
-		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")))
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("Pragma", "no-cache")
@@ -0,0 +1,740 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStorage - хранилище в памяти для тестов обработчиков без файла базы
+type memoryStorage struct {
+	mutex        sync.Mutex
+	users        map[int]userRow
+	cntls        map[int]controllerRow
+	tunnelTokens map[int]string
+	appTokens    map[int]string
+	authRequests map[string]memoryAuthRequest
+	authCodes    map[string]authCode
+	clients      map[string]oauthClient
+	tokens       []memoryToken
+	ids          map[string]deviceID
+	commands     map[int]queuedCommand
+	nextID       int
+}
+
+type memoryToken struct {
+	tokenRow
+	rotated bool
+	revoked bool
+}
+
+type memoryAuthRequest struct {
+	query   string
+	created time.Time
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		users:        make(map[int]userRow),
+		cntls:        make(map[int]controllerRow),
+		tunnelTokens: make(map[int]string),
+		appTokens:    make(map[int]string),
+		authRequests: make(map[string]memoryAuthRequest),
+		authCodes:    make(map[string]authCode),
+		clients:      make(map[string]oauthClient),
+		ids:          make(map[string]deviceID),
+		commands:     make(map[int]queuedCommand),
+	}
+}
+
+func (s *memoryStorage) createUser(ctx context.Context, name string, password string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, user := range s.users {
+		if user.Name == name {
+			return 0, errUserExists
+		}
+	}
+
+	s.nextID++
+	s.users[s.nextID] = userRow{ID: s.nextID, Name: name, Password: password}
+
+	return s.nextID, nil
+}
+
+// findUser возвращает первого пользователя, для которого match вернул true
+func (s *memoryStorage) findUser(match func(user userRow) bool) (userRow, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, user := range s.users {
+		if match(user) {
+			return user, nil
+		}
+	}
+
+	return userRow{}, errNotFound
+}
+
+func (s *memoryStorage) userByName(ctx context.Context, name string) (userRow, error) {
+	return s.findUser(func(user userRow) bool { return user.Name == name })
+}
+
+func (s *memoryStorage) userByAppToken(ctx context.Context, token string) (userRow, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, appToken := range s.appTokens {
+		if token != "" && appToken == token {
+			return s.users[id], nil
+		}
+	}
+
+	return userRow{}, errNotFound
+}
+
+func (s *memoryStorage) userByAccessToken(ctx context.Context, token string, now time.Time) (userRow, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, row := range s.tokens {
+		if row.AccessToken == token && !row.rotated && !row.revoked && row.AccessExpiresAt.After(now) {
+			if user, ok := s.users[row.UserID]; ok {
+				return user, nil
+			}
+		}
+	}
+
+	return userRow{}, errNotFound
+}
+
+func (s *memoryStorage) setAppToken(ctx context.Context, userID int, token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return errNotFound
+	}
+	s.appTokens[userID] = token
+
+	return nil
+}
+
+func (s *memoryStorage) setPassword(ctx context.Context, userID int, password string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return errNotFound
+	}
+	user.Password = password
+	s.users[userID] = user
+
+	return nil
+}
+
+func (s *memoryStorage) legacyPasswordUsers(ctx context.Context) ([]string, int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	names := make([]string, 0)
+	for _, user := range s.users {
+		if isLegacyPasswordHash(user.Password) {
+			names = append(names, user.Name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, len(s.users), nil
+}
+
+func (s *memoryStorage) createTokens(ctx context.Context, tokens tokenRow) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.tokens = append(s.tokens, memoryToken{tokenRow: tokens})
+	return nil
+}
+
+func (s *memoryStorage) rotateRefreshToken(ctx context.Context, refreshToken string, clientID string, next tokenRow, now time.Time) (tokenRow, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for index, row := range s.tokens {
+		if row.RefreshToken != refreshToken {
+			continue
+		}
+		if row.revoked || row.ClientID != clientID {
+			return tokenRow{}, errNotFound
+		}
+		if row.rotated {
+			s.revokeFamily(row.Family)
+			return tokenRow{}, errTokenReused
+		}
+		if !row.RefreshExpiresAt.After(now) {
+			return tokenRow{}, errNotFound
+		}
+
+		s.tokens[index].rotated = true
+		next.Family = row.Family
+		next.UserID = row.UserID
+		next.ClientID = clientID
+		next.Scope = row.Scope
+		s.tokens = append(s.tokens, memoryToken{tokenRow: next})
+		return next, nil
+	}
+
+	return tokenRow{}, errNotFound
+}
+
+// revokeFamily отзывает семейство и возвращает число отозванных пар, вызывается под mutex
+func (s *memoryStorage) revokeFamily(family string) int {
+	revoked := 0
+	for index, row := range s.tokens {
+		if row.Family == family && !row.revoked {
+			s.tokens[index].revoked = true
+			revoked++
+		}
+	}
+
+	return revoked
+}
+
+func (s *memoryStorage) revokeTokenFamily(ctx context.Context, token string, clientID string, now time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, row := range s.tokens {
+		if (row.AccessToken == token || row.RefreshToken == token) && (clientID == "" || row.ClientID == clientID) {
+			if s.revokeFamily(row.Family) == 0 {
+				return errNotFound
+			}
+			return nil
+		}
+	}
+
+	return errNotFound
+}
+
+func (s *memoryStorage) revokeClientTokens(ctx context.Context, clientID string, now time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	revoked := 0
+	for index, row := range s.tokens {
+		if row.ClientID == clientID && !row.revoked {
+			s.tokens[index].revoked = true
+			revoked++
+		}
+	}
+
+	return revoked, nil
+}
+
+func (s *memoryStorage) expireTokens(ctx context.Context, before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	kept := s.tokens[:0]
+	for _, row := range s.tokens {
+		if !row.RefreshExpiresAt.Before(before) {
+			kept = append(kept, row)
+		}
+	}
+	expired := len(s.tokens) - len(kept)
+	s.tokens = kept
+
+	return expired, nil
+}
+
+func (s *memoryStorage) createAuthRequest(ctx context.Context, id string, query string, created time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.authRequests[id] = memoryAuthRequest{query: query, created: created}
+	return nil
+}
+
+func (s *memoryStorage) authRequest(ctx context.Context, id string) (string, time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	request, ok := s.authRequests[id]
+	if !ok {
+		return "", time.Time{}, errNotFound
+	}
+	return request.query, request.created, nil
+}
+
+func (s *memoryStorage) completeAuthRequest(ctx context.Context, id string, code authCode) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.authRequests[id]; !ok {
+		return errNotFound
+	}
+
+	s.authCodes[code.Code] = code
+	delete(s.authRequests, id)
+
+	return nil
+}
+
+func (s *memoryStorage) consumeAuthCode(ctx context.Context, code string) (authCode, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	row, ok := s.authCodes[code]
+	if !ok {
+		return authCode{}, errNotFound
+	}
+	delete(s.authCodes, code)
+
+	return row, nil
+}
+
+func (s *memoryStorage) expireAuthRequests(ctx context.Context, before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	expired := 0
+	for id, request := range s.authRequests {
+		if request.created.Before(before) {
+			delete(s.authRequests, id)
+			expired++
+		}
+	}
+
+	return expired, nil
+}
+
+func (s *memoryStorage) expireAuthCodes(ctx context.Context, before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	expired := 0
+	for code, row := range s.authCodes {
+		if row.IssuedAt.Before(before) {
+			delete(s.authCodes, code)
+			expired++
+		}
+	}
+
+	return expired, nil
+}
+
+func (s *memoryStorage) createOAuthClient(ctx context.Context, client oauthClient) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.clients[client.ID]; ok {
+		return errClientExists
+	}
+	s.clients[client.ID] = client
+
+	return nil
+}
+
+func (s *memoryStorage) updateOAuthClient(ctx context.Context, client oauthClient) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, ok := s.clients[client.ID]
+	if !ok {
+		return errNotFound
+	}
+	client.CreatedAt = stored.CreatedAt
+	s.clients[client.ID] = client
+
+	return nil
+}
+
+func (s *memoryStorage) oauthClient(ctx context.Context, id string) (oauthClient, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client, ok := s.clients[id]
+	if !ok {
+		return oauthClient{}, errNotFound
+	}
+
+	return client, nil
+}
+
+func (s *memoryStorage) oauthClients(ctx context.Context) ([]oauthClient, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	clients := make([]oauthClient, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+
+	return clients, nil
+}
+
+func (s *memoryStorage) deleteOAuthClient(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.clients[id]; !ok {
+		return errNotFound
+	}
+	delete(s.clients, id)
+	for code, row := range s.authCodes {
+		if row.ClientID == id {
+			delete(s.authCodes, code)
+		}
+	}
+	kept := s.tokens[:0]
+	for _, row := range s.tokens {
+		if row.ClientID != id {
+			kept = append(kept, row)
+		}
+	}
+	s.tokens = kept
+
+	return nil
+}
+
+// findControllers возвращает подходящие контроллеры, отсортированные по id
+func (s *memoryStorage) findControllers(match func(cntl controllerRow) bool) []controllerRow {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	controllers := make([]controllerRow, 0)
+	for _, cntl := range s.cntls {
+		if match(cntl) {
+			controllers = append(controllers, cntl)
+		}
+	}
+	sort.Slice(controllers, func(i, j int) bool { return controllers[i].ID < controllers[j].ID })
+
+	return controllers
+}
+
+func (s *memoryStorage) controllers(ctx context.Context) ([]controllerRow, error) {
+	return s.findControllers(func(cntl controllerRow) bool { return true }), nil
+}
+
+func (s *memoryStorage) userControllers(ctx context.Context, userID int) ([]controllerRow, error) {
+	return s.findControllers(func(cntl controllerRow) bool { return cntl.UserID == userID }), nil
+}
+
+func (s *memoryStorage) controller(ctx context.Context, id int) (controllerRow, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cntl, ok := s.cntls[id]
+	if !ok {
+		return controllerRow{}, errNotFound
+	}
+	return cntl, nil
+}
+
+func (s *memoryStorage) userController(ctx context.Context, userID int, id int) (controllerRow, error) {
+	cntl, err := s.controller(ctx, id)
+	if err == nil && cntl.UserID != userID {
+		return controllerRow{}, errNotFound
+	}
+	return cntl, err
+}
+
+func (s *memoryStorage) createController(ctx context.Context, cntl controllerRow) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.nextID++
+	cntl.ID = s.nextID
+	if cntl.Driver == "" {
+		cntl.Driver = driverHTTP
+	}
+	s.cntls[cntl.ID] = cntl
+
+	return cntl.ID, nil
+}
+
+// updateControllerRow обновляет контроллер под мьютексом, userID = 0 - без проверки владельца
+func (s *memoryStorage) updateControllerRow(userID int, id int, update func(cntl *controllerRow)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cntl, ok := s.cntls[id]
+	if !ok || (userID != 0 && cntl.UserID != userID) {
+		return errNotFound
+	}
+
+	update(&cntl)
+	s.cntls[id] = cntl
+	return nil
+}
+
+func (s *memoryStorage) updateController(ctx context.Context, cntl controllerRow) error {
+	return s.updateControllerRow(cntl.UserID, cntl.ID, func(row *controllerRow) {
+		row.Name = cntl.Name
+		row.Password = cntl.Password
+		row.URI = cntl.URI
+		row.CodecVersion = cntl.CodecVersion
+		row.CodecKey = cntl.CodecKey
+		row.Driver = cntl.Driver
+		row.DriverConfig = cntl.DriverConfig
+		row.Verified = cntl.Verified
+	})
+}
+
+func (s *memoryStorage) deleteController(ctx context.Context, userID int, id int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cntl, ok := s.cntls[id]
+	if !ok || cntl.UserID != userID {
+		return errNotFound
+	}
+
+	delete(s.cntls, id)
+	delete(s.tunnelTokens, id)
+	for key, device := range s.ids {
+		if device.ControllerID == id {
+			delete(s.ids, key)
+		}
+	}
+	for key, command := range s.commands {
+		if command.ControllerID == id {
+			delete(s.commands, key)
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) setControllerVerified(ctx context.Context, id int, verified bool) error {
+	return s.updateControllerRow(0, id, func(cntl *controllerRow) { cntl.Verified = verified })
+}
+
+func (s *memoryStorage) setPendingControllerKey(ctx context.Context, id int, key string) error {
+	return s.updateControllerRow(0, id, func(cntl *controllerRow) { cntl.PendingKey = key })
+}
+
+func (s *memoryStorage) commitControllerKey(ctx context.Context, id int, rotated time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cntl, ok := s.cntls[id]
+	if !ok || cntl.PendingKey == "" {
+		return errNotFound
+	}
+
+	cntl.PreviousKey = cntl.CodecKey
+	cntl.CodecKey = cntl.PendingKey
+	cntl.PendingKey = ""
+	cntl.RotatedAt = rotated.Format(time.RFC3339)
+	s.cntls[id] = cntl
+	return nil
+}
+
+func (s *memoryStorage) setControllerTunnel(ctx context.Context, userID int, id int, uri string, token string) error {
+	err := s.updateControllerRow(userID, id, func(cntl *controllerRow) {
+		cntl.URI = uri
+		cntl.Verified = false
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.tunnelTokens[id] = token
+	return nil
+}
+
+func (s *memoryStorage) checkTunnelToken(ctx context.Context, id int, token string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	expected, ok := s.tunnelTokens[id]
+	return ok && expected == token, nil
+}
+
+func (s *memoryStorage) deviceIDs(ctx context.Context, controllerID int) ([]deviceID, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ids := make([]deviceID, 0)
+	for _, device := range s.ids {
+		if device.ControllerID == controllerID {
+			ids = append(ids, device)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].CreatedAt != ids[j].CreatedAt {
+			return ids[i].CreatedAt < ids[j].CreatedAt
+		}
+		return ids[i].Guid < ids[j].Guid
+	})
+
+	return ids, nil
+}
+
+func (s *memoryStorage) assignDeviceID(ctx context.Context, controllerID int, guid string, id string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, device := range s.ids {
+		if device.ControllerID == controllerID && device.Guid == guid {
+			return device.ID, nil
+		}
+	}
+	if _, ok := s.ids[id]; ok {
+		return "", errDeviceIDTaken
+	}
+
+	s.ids[id] = deviceID{ID: id, ControllerID: controllerID, Guid: guid, CreatedAt: time.Now().UTC().Format(commandTimeLayout)}
+	return id, nil
+}
+
+func (s *memoryStorage) rebindDeviceID(ctx context.Context, userID int, controllerID int, id string, guid string) (deviceID, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	device, ok := s.ids[id]
+	if !ok || device.ControllerID != controllerID || s.cntls[controllerID].UserID != userID {
+		return deviceID{}, errNotFound
+	}
+
+	for key, other := range s.ids {
+		if other.ControllerID == controllerID && other.Guid == guid && key != id {
+			delete(s.ids, key)
+		}
+	}
+
+	device.Guid = guid
+	s.ids[id] = device
+
+	return device, nil
+}
+
+func (s *memoryStorage) enqueueCommand(ctx context.Context, command queuedCommand) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	command.Attempts = 0
+	for id, queued := range s.commands {
+		if queued.ControllerID == command.ControllerID && queued.DeviceID == command.DeviceID {
+			command.ID = id
+			s.commands[id] = command
+			return nil
+		}
+	}
+
+	s.nextID++
+	command.ID = s.nextID
+	s.commands[command.ID] = command
+	return nil
+}
+
+func (s *memoryStorage) dropDeviceCommand(ctx context.Context, controllerID int, deviceID int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, command := range s.commands {
+		if command.ControllerID == controllerID && command.DeviceID == deviceID {
+			delete(s.commands, id)
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) expireCommands(ctx context.Context, now time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count := 0
+	for id, command := range s.commands {
+		if command.ExpiresAt <= now.UTC().Format(commandTimeLayout) {
+			delete(s.commands, id)
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (s *memoryStorage) dueCommands(ctx context.Context, now time.Time) ([]queuedCommand, error) {
+	return s.filterCommands(func(command queuedCommand) bool {
+		return command.NextAttemptAt <= now.UTC().Format(commandTimeLayout)
+	}), nil
+}
+
+func (s *memoryStorage) retryCommand(ctx context.Context, command queuedCommand, lastError string, next time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	queued, ok := s.commands[command.ID]
+	if ok && queued.CreatedAt == command.CreatedAt {
+		queued.Attempts++
+		queued.LastError = lastError
+		queued.NextAttemptAt = next.UTC().Format(commandTimeLayout)
+		s.commands[command.ID] = queued
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) completeCommand(ctx context.Context, command queuedCommand) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if queued, ok := s.commands[command.ID]; ok && queued.CreatedAt == command.CreatedAt {
+		delete(s.commands, command.ID)
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) userCommands(ctx context.Context, userID int, now time.Time) ([]queuedCommand, error) {
+	s.mutex.Lock()
+	owned := make(map[int]bool)
+	for id, cntl := range s.cntls {
+		owned[id] = cntl.UserID == userID
+	}
+	s.mutex.Unlock()
+
+	return s.filterCommands(func(command queuedCommand) bool {
+		return owned[command.ControllerID] && command.ExpiresAt > now.UTC().Format(commandTimeLayout)
+	}), nil
+}
+
+func (s *memoryStorage) cancelUserCommand(ctx context.Context, userID int, id int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	command, ok := s.commands[id]
+	if !ok || s.cntls[command.ControllerID].UserID != userID {
+		return errNotFound
+	}
+
+	delete(s.commands, id)
+	return nil
+}
+
+// filterCommands возвращает команды, подходящие под условие, в порядке постановки
+func (s *memoryStorage) filterCommands(match func(command queuedCommand) bool) []queuedCommand {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	commands := make([]queuedCommand, 0)
+	for _, command := range s.commands {
+		if match(command) {
+			commands = append(commands, command)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].ID < commands[j].ID })
+
+	return commands
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Миграции лежат в migrations/NNNN_name.up.sql и NNNN_name.down.sql и встраиваются в бинарник.
+// Примененные версии записываются в schema_migrations
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// legacyBaseline - версия схемы, до которой доводили базу initializeDB и addColumn до появления миграций
+const legacyBaseline = 2
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+type migrationState struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	AppliedAt string `json:"applied_at,omitempty"`
+}
+
+// loadMigrations читает встроенные миграции, отсортированные по версии
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		file := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(file, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(file, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("invalid migration file %s", file)
+		}
+
+		base := strings.TrimSuffix(file, "."+direction+".sql")
+		separator := strings.Index(base, "_")
+		if separator < 1 {
+			return nil, fmt.Errorf("invalid migration file %s", file)
+		}
+		version, err := strconv.Atoi(base[:separator])
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("invalid migration file %s", file)
+		}
+
+		body, err := migrationFiles.ReadFile(path.Join("migrations", file))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: base[separator+1:]}
+			byVersion[version] = m
+		} else if m.name != base[separator+1:] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.name, base[separator+1:])
+		}
+
+		if direction == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d has no up script", m.version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	for index, m := range migrations {
+		if m.version != index+1 {
+			return nil, fmt.Errorf("migration %d is missing", index+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+func ensureMigrationsTable(c context.Context, db *sql.DB) error {
+	ctx := c
+
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY NOT NULL,
+		name       TEXT NOT NULL,
+		applied_at TEXT NOT NULL)`)
+	return err
+}
+
+// appliedMigrations возвращает время применения по версиям
+func appliedMigrations(c context.Context, db *sql.DB) (map[int]string, error) {
+	ctx := c
+
+	rows, err := db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// migrationStatus возвращает все известные миграции с временем применения
+func migrationStatus(c context.Context, db *sql.DB, migrations []migration) ([]migrationState, error) {
+	ctx := c
+
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]migrationState, 0, len(migrations))
+	for _, m := range migrations {
+		states = append(states, migrationState{Version: m.version, Name: m.name, AppliedAt: applied[m.version]})
+	}
+
+	for version := range applied {
+		if version > len(migrations) {
+			return states, fmt.Errorf("database schema version %d is newer than this binary", version)
+		}
+	}
+
+	return states, nil
+}
+
+// schemaVersion - наибольшая примененная версия
+func schemaVersion(applied map[int]string) int {
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+
+	return version
+}
+
+// inspectDatabase возвращает примененные миграции, не изменяя базу. legacy = true для базы,
+// созданной до появления миграций, ее примет adoptLegacyDatabase
+func inspectDatabase(c context.Context, db *sql.DB) (map[int]string, bool, error) {
+	ctx := c
+
+	tables := func(name string) (int, error) {
+		cnt := 0
+		err := db.QueryRowContext(ctx, `SELECT count(name) FROM sqlite_master WHERE type = 'table' AND name = $1`, name).Scan(&cnt)
+		return cnt, err
+	}
+
+	cnt, err := tables("schema_migrations")
+	if err != nil {
+		return nil, false, err
+	}
+	if cnt > 0 {
+		applied, err := appliedMigrations(ctx, db)
+		if err != nil || len(applied) > 0 {
+			return applied, false, err
+		}
+	}
+
+	cnt, err = tables("users")
+	return map[int]string{}, cnt > 0, err
+}
+
+// adoptLegacyDatabase отмечает legacyBaseline примененной для базы, созданной до появления миграций.
+// Недостающие в такой базе колонки добавляются так же, как это делал upgradeDB
+func adoptLegacyDatabase(c context.Context, db *sql.DB) error {
+	ctx := c
+
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil || len(applied) > 0 {
+		return err
+	}
+
+	cnt := 0
+	if err = db.QueryRowContext(ctx, `SELECT count(name) FROM sqlite_master WHERE type = 'table' AND name = 'users'`).Scan(&cnt); err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return nil
+	}
+
+	msu.Info(ctx, zap.Any("database", "adopting schema created before migrations"))
+
+	columns := []struct{ name, definition string }{
+		{"verified", "INTEGER NOT NULL DEFAULT 1"},
+		{"codec_version", "INTEGER NOT NULL DEFAULT 1"},
+		{"codec_key", "TEXT"},
+		{"codec_previous_key", "TEXT"},
+		{"key_rotated_at", "TEXT"},
+		{"tunnel_token", "TEXT"},
+		{"driver", "TEXT NOT NULL DEFAULT 'http'"},
+		{"driver_config", "TEXT"},
+	}
+	for _, column := range columns {
+		if err = addColumn(ctx, db, "controllers", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Format(commandTimeLayout)
+	for _, m := range migrations[:legacyBaseline] {
+		if _, err = db.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`, m.version, m.name, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateUp применяет миграции до версии target включительно, каждую в своей транзакции
+func migrateUp(c context.Context, db *sql.DB, migrations []migration, target int) error {
+	ctx := c
+
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version > target {
+			break
+		}
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+
+		msu.Info(ctx, zap.Any("database", "migrate up"), zap.Int("version", m.version), zap.String("name", m.name))
+		if err = applyMigration(ctx, db, m.version, m.up, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+				m.version, m.name, time.Now().UTC().Format(commandTimeLayout))
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateDown откатывает примененные миграции новее target, начиная с последней
+func migrateDown(c context.Context, db *sql.DB, migrations []migration, target int) error {
+	ctx := c
+
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for index := len(migrations) - 1; index >= 0; index-- {
+		m := migrations[index]
+		if m.version <= target {
+			break
+		}
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		if m.down == "" {
+			return fmt.Errorf("migration %d %s can't be rolled back", m.version, m.name)
+		}
+
+		msu.Info(ctx, zap.Any("database", "migrate down"), zap.Int("version", m.version), zap.String("name", m.name))
+		if err = applyMigration(ctx, db, m.version, m.down, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.version)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(c context.Context, db *sql.DB, version int, script string, record func(tx *sql.Tx) error) error {
+	ctx := c
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d: %w", version, err)
+	}
+	if err = record(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// backupDatabase сохраняет копию базы перед изменением схемы в каталог копий и возвращает ее путь.
+// Копию можно восстановить командой backup restore
+func backupDatabase(c context.Context, db *sql.DB) (string, error) {
+	ctx := c
+
+	backup, err := createBackup(ctx, db, backupDir(), backupRetain)
+	if err != nil {
+		return "", err
+	}
+
+	return backup.Path, nil
+}
+
+// runMigrate управляет схемой базы:
+// bsh-backend migrate [-db /tmp/users.db] status | up [-to N] | down [-to N]
+// down без -to откатывает одну последнюю миграцию. Откат ниже 0007 теряет токены Яндекса,
+// пользователям придется заново связать аккаунты
+func runMigrate(args []string) error {
+	ctx := context.Background()
+
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dbPath := flags.String("db", databaseDirectory+"/users.db", "database file")
+	target := flags.Int("to", -1, "target schema version")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// Флаги допускаются и до, и после действия
+	action := "status"
+	if flags.NArg() > 0 {
+		action = flags.Arg(0)
+		if err := flags.Parse(flags.Args()[1:]); err != nil {
+			return err
+		}
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	// Схема не меняется под работающим сервером: он держит блокировку базы
+	unlock, err := lockDatabase(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	database, err := sql.Open("sqlite3", *dbPath)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	applied, legacy, err := inspectDatabase(ctx, database)
+	if err != nil {
+		return err
+	}
+	version := schemaVersion(applied)
+	if legacy {
+		version = legacyBaseline
+	}
+
+	switch action {
+	case "up":
+		if *target < 0 {
+			*target = len(migrations)
+		}
+	case "down":
+		if *target < 0 {
+			*target = version - 1
+		}
+	}
+
+	// Копия снимается до принятия базы без миграций, которое уже меняет схему
+	changed := (action == "up" && *target > version) || (action == "down" && *target < version)
+	if legacy || (version > 0 && changed) {
+		backup, err := backupDatabase(ctx, database)
+		if err != nil {
+			return err
+		}
+		msu.Info(ctx, zap.Any("database", "backup"), zap.String("path", backup))
+	}
+
+	if err = ensureMigrationsTable(ctx, database); err != nil {
+		return err
+	}
+	if err = adoptLegacyDatabase(ctx, database); err != nil {
+		return err
+	}
+
+	switch action {
+	case "status":
+		states, err := migrationStatus(ctx, database, migrations)
+		for _, state := range states {
+			appliedAt := "pending"
+			if state.AppliedAt != "" {
+				appliedAt = state.AppliedAt
+			}
+			fmt.Printf("%04d %-30s %s\n", state.Version, state.Name, appliedAt)
+		}
+		return err
+	case "up":
+		if *target <= version {
+			return nil
+		}
+		return migrateUp(ctx, database, migrations, *target)
+	case "down":
+		if *target >= version {
+			return nil
+		}
+		return migrateDown(ctx, database, migrations, *target)
+	}
+
+	return errors.New("unknown migrate action " + action + ", expected status, up or down")
+}
@@ -0,0 +1,3 @@
+DROP TABLE auth_requests;
+DROP TABLE controllers;
+DROP TABLE users;
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS users (
+	id             INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	name           TEXT    NOT NULL,
+	password       TEXT NOT NULL,
+	yandex_code    TEXT,
+	yandex_token   TEXT,
+	app_token      TEXT);
+
+CREATE TABLE IF NOT EXISTS controllers (
+	id             INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	user_id        INTEGER NOT NULL,
+	name           TEXT    NOT NULL,
+	password       TEXT NOT NULL,
+	uri            TEXT,
+	FOREIGN KEY(user_id) REFERENCES users(id));
+
+CREATE TABLE IF NOT EXISTS auth_requests (
+	id TEXT NOT NULL,
+	request TEXT NOT NULL,
+	dt TEXT NOT NULL);
@@ -0,0 +1,8 @@
+ALTER TABLE controllers DROP COLUMN driver_config;
+ALTER TABLE controllers DROP COLUMN driver;
+ALTER TABLE controllers DROP COLUMN tunnel_token;
+ALTER TABLE controllers DROP COLUMN key_rotated_at;
+ALTER TABLE controllers DROP COLUMN codec_previous_key;
+ALTER TABLE controllers DROP COLUMN codec_key;
+ALTER TABLE controllers DROP COLUMN codec_version;
+ALTER TABLE controllers DROP COLUMN verified;
@@ -0,0 +1,8 @@
+ALTER TABLE controllers ADD COLUMN verified INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE controllers ADD COLUMN codec_version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE controllers ADD COLUMN codec_key TEXT;
+ALTER TABLE controllers ADD COLUMN codec_previous_key TEXT;
+ALTER TABLE controllers ADD COLUMN key_rotated_at TEXT;
+ALTER TABLE controllers ADD COLUMN tunnel_token TEXT;
+ALTER TABLE controllers ADD COLUMN driver TEXT NOT NULL DEFAULT 'http';
+ALTER TABLE controllers ADD COLUMN driver_config TEXT;
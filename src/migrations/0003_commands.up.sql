@@ -0,0 +1,13 @@
+-- Очередь команд для недоступных контроллеров, на устройство хранится только последняя команда
+CREATE TABLE IF NOT EXISTS commands (
+	id              INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	controller_id   INTEGER NOT NULL,
+	device_id       INTEGER NOT NULL,
+	payload         TEXT NOT NULL,
+	attempts        INTEGER NOT NULL DEFAULT 0,
+	last_error      TEXT,
+	created_at      TEXT NOT NULL,
+	next_attempt_at TEXT NOT NULL,
+	expires_at      TEXT NOT NULL,
+	UNIQUE(controller_id, device_id),
+	FOREIGN KEY(controller_id) REFERENCES controllers(id));
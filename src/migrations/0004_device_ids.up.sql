@@ -0,0 +1,10 @@
+-- Внешние id устройств, которые видят Яндекс и приложение. id выдается на пару
+-- контроллер + guid, поэтому одинаковые guid на разных контроллерах не пересекаются.
+-- Линии штор с общим guid получают один id
+CREATE TABLE IF NOT EXISTS device_ids (
+	id              TEXT PRIMARY KEY NOT NULL,
+	controller_id   INTEGER NOT NULL,
+	guid            TEXT NOT NULL,
+	created_at      TEXT NOT NULL,
+	UNIQUE(controller_id, guid),
+	FOREIGN KEY(controller_id) REFERENCES controllers(id));
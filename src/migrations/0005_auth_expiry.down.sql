@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS auth_requests_dt;
+ALTER TABLE users DROP COLUMN yandex_code_at;
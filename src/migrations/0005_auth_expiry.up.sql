@@ -0,0 +1,4 @@
+-- Время выдачи кода авторизации Яндекса: просроченные коды не обмениваются на токен
+-- и удаляются вместе с просроченными запросами авторизации
+ALTER TABLE users ADD COLUMN yandex_code_at TEXT;
+CREATE INDEX IF NOT EXISTS auth_requests_dt ON auth_requests (dt);
@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN yandex_code TEXT;
+ALTER TABLE users ADD COLUMN yandex_code_at TEXT;
+DROP INDEX IF EXISTS oauth_codes_created_at;
+DROP TABLE IF EXISTS oauth_codes;
+DROP TABLE IF EXISTS oauth_clients;
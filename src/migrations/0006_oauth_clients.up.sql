@@ -0,0 +1,26 @@
+-- Клиенты OAuth - платформы, которые связывают аккаунты пользователей: Яндекс и другие.
+-- secret - sha256 секрета клиента в hex, redirect_uris - разрешенные адреса возврата через перевод строки
+CREATE TABLE IF NOT EXISTS oauth_clients (
+	id            TEXT PRIMARY KEY NOT NULL,
+	name          TEXT NOT NULL,
+	secret        TEXT NOT NULL,
+	redirect_uris TEXT NOT NULL,
+	created_at    TEXT NOT NULL);
+
+-- Коды авторизации привязаны к клиенту, адресу возврата и PKCE. redirect_uri пустой,
+-- если клиент не передал его в запросе авторизации
+CREATE TABLE IF NOT EXISTS oauth_codes (
+	code                  TEXT PRIMARY KEY NOT NULL,
+	user_id               INTEGER NOT NULL,
+	client_id             TEXT NOT NULL,
+	redirect_uri          TEXT NOT NULL,
+	scope                 TEXT NOT NULL,
+	code_challenge        TEXT NOT NULL,
+	code_challenge_method TEXT NOT NULL,
+	created_at            TEXT NOT NULL,
+	FOREIGN KEY(user_id) REFERENCES users(id));
+CREATE INDEX IF NOT EXISTS oauth_codes_created_at ON oauth_codes (created_at);
+
+-- Коды Яндекса хранились у пользователя, теперь они в oauth_codes
+ALTER TABLE users DROP COLUMN yandex_code_at;
+ALTER TABLE users DROP COLUMN yandex_code;
@@ -0,0 +1,8 @@
+-- Откат теряет токены Яндекса: в oauth_tokens они хранятся хэшами, и вернуть в users.yandex_token
+-- действующий токен нельзя. После отката пользователям нужно заново связать аккаунт в Яндексе
+ALTER TABLE users ADD COLUMN yandex_token TEXT;
+DROP INDEX IF EXISTS oauth_tokens_refresh_expires_at;
+DROP INDEX IF EXISTS oauth_tokens_family;
+DROP INDEX IF EXISTS oauth_tokens_refresh_token;
+DROP INDEX IF EXISTS oauth_tokens_access_token;
+DROP TABLE IF EXISTS oauth_tokens;
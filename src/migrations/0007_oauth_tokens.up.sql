@@ -0,0 +1,31 @@
+-- Токены доступа и обновления. Пары одного семейства получены обновлением из одного кода авторизации:
+-- rotated_at - пара обменена на следующую, revoked_at - семейство отозвано
+CREATE TABLE IF NOT EXISTS oauth_tokens (
+	id                 INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	family             TEXT NOT NULL,
+	user_id            INTEGER NOT NULL,
+	client_id          TEXT NOT NULL,
+	access_token       TEXT NOT NULL,
+	refresh_token      TEXT NOT NULL,
+	scope              TEXT NOT NULL,
+	access_expires_at  TEXT NOT NULL,
+	refresh_expires_at TEXT NOT NULL,
+	created_at         TEXT NOT NULL,
+	rotated_at         TEXT,
+	revoked_at         TEXT,
+	FOREIGN KEY(user_id) REFERENCES users(id));
+CREATE UNIQUE INDEX IF NOT EXISTS oauth_tokens_access_token ON oauth_tokens (access_token);
+CREATE UNIQUE INDEX IF NOT EXISTS oauth_tokens_refresh_token ON oauth_tokens (refresh_token);
+CREATE INDEX IF NOT EXISTS oauth_tokens_family ON oauth_tokens (family);
+CREATE INDEX IF NOT EXISTS oauth_tokens_refresh_expires_at ON oauth_tokens (refresh_expires_at);
+
+-- Токены Яндекса переносятся к клиенту yandex и действуют столько же, сколько выдавались раньше:
+-- 720 дней. Тот же токен принимается как токен обновления, и Яндекс получает новую пару без повторной связки
+INSERT INTO oauth_tokens (family, user_id, client_id, access_token, refresh_token, scope, access_expires_at, refresh_expires_at, created_at)
+SELECT lower(hex(randomblob(16))), id, 'yandex', yandex_token, yandex_token, '',
+	strftime('%Y-%m-%dT%H:%M:%SZ', 'now', '+720 days'),
+	strftime('%Y-%m-%dT%H:%M:%SZ', 'now', '+720 days'),
+	strftime('%Y-%m-%dT%H:%M:%SZ', 'now')
+FROM users WHERE yandex_token IS NOT NULL AND yandex_token != '';
+
+ALTER TABLE users DROP COLUMN yandex_token;
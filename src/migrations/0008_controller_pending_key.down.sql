@@ -0,0 +1 @@
+ALTER TABLE controllers DROP COLUMN codec_pending_key;
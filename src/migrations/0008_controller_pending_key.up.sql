@@ -0,0 +1,2 @@
+-- Новый ключ контроллера сохраняется до команды setkey и становится текущим после подтверждения
+ALTER TABLE controllers ADD COLUMN codec_pending_key TEXT;
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+)
+
+func TestMigrations(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+	ctx := context.Background()
+
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+	require.True(t, len(migrations) >= legacyBaseline)
+
+	path := t.TempDir() + "/users.db"
+	useBackupDir(t)
+	require.NoError(t, initializeDB(ctx, path))
+
+	database, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer database.Close()
+
+	applied, err := appliedMigrations(ctx, database)
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), schemaVersion(applied))
+
+	// Новая база не копируется
+	backups, err := listBackups(backupDir())
+	require.NoError(t, err)
+	assert.Empty(t, backups)
+
+	// Откат до нуля и обратно
+	require.NoError(t, migrateDown(ctx, database, migrations, 0))
+	applied, err = appliedMigrations(ctx, database)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	require.NoError(t, migrateUp(ctx, database, migrations, len(migrations)))
+	_, err = database.Exec(`INSERT INTO controllers (user_id, name, password, uri, driver) VALUES (1, 'c', 'p', 'http://c', 'http')`)
+	assert.NoError(t, err)
+}
+
+func TestMigrateLocked(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+	path := t.TempDir() + "/users.db"
+	useBackupDir(t)
+
+	// Пока сервер держит блокировку, миграции не выполняются
+	unlock, err := lockDatabase(path)
+	require.NoError(t, err)
+	assert.Equal(t, errDatabaseLocked, runMigrate([]string{"-db", path, "up"}))
+	unlock()
+
+	assert.NoError(t, runMigrate([]string{"-db", path, "up"}))
+}
+
+func TestMigrationsLegacyDatabase(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+	ctx := context.Background()
+
+	// База, созданная до миграций и так и не обновленная
+	path := t.TempDir() + "/users.db"
+	useBackupDir(t)
+	database, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer database.Close()
+
+	_, err = database.Exec(`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, name TEXT NOT NULL, password TEXT NOT NULL,
+		yandex_code TEXT, yandex_token TEXT, app_token TEXT);
+		CREATE TABLE controllers (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, user_id INTEGER NOT NULL, name TEXT NOT NULL,
+		password TEXT NOT NULL, uri TEXT, verified INTEGER NOT NULL DEFAULT 1);
+		CREATE TABLE auth_requests (id TEXT NOT NULL, request TEXT NOT NULL, dt TEXT NOT NULL);
+		INSERT INTO users (name, password, yandex_token) VALUES ('user', '', 'legacy-token');
+		INSERT INTO controllers (user_id, name, password, uri) VALUES (1, 'c', 'p', 'http://c');`)
+	require.NoError(t, err)
+
+	require.NoError(t, initializeDB(ctx, path))
+
+	applied, err := appliedMigrations(ctx, database)
+	require.NoError(t, err)
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), len(applied))
+
+	// Копия снята до принятия базы: в ней еще нет ни миграций, ни добавленных колонок
+	backups, err := listBackups(backupDir())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(backups))
+	backup, err := sql.Open("sqlite3", backups[0].Path)
+	require.NoError(t, err)
+	defer backup.Close()
+	_, unadopted, err := inspectDatabase(ctx, backup)
+	require.NoError(t, err)
+	assert.True(t, unadopted)
+	assert.Error(t, backup.QueryRow(`SELECT driver FROM controllers`).Scan(new(string)))
+
+	var driver string
+	require.NoError(t, database.QueryRow(`SELECT driver FROM controllers WHERE id = 1`).Scan(&driver))
+	assert.Equal(t, driverHTTP, driver)
+
+	// Токен Яндекса перенесен в oauth_tokens клиента yandex, хэшируется при запуске и обменивается только этим клиентом
+	hashed, err := hashStoredTokens(ctx, database, []byte(testTokenKey))
+	require.NoError(t, err)
+	assert.Equal(t, 2, hashed)
+	legacy := newSQLiteStorage(database, nil, []byte(testTokenKey))
+	user, err := legacy.userByAccessToken(ctx, "legacy-token", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "user", user.Name)
+	_, err = legacy.rotateRefreshToken(ctx, "legacy-token", "alice", newTokenPair(time.Now()), time.Now())
+	assert.Equal(t, errNotFound, err)
+	// Токен доступа не истекает раньше, чем истекали токены Яндекса до миграции
+	_, err = legacy.userByAccessToken(ctx, "legacy-token", time.Now().Add(719*24*time.Hour))
+	require.NoError(t, err)
+	tokens, err := legacy.rotateRefreshToken(ctx, "legacy-token", yandexClientID, newTokenPair(time.Now()), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, yandexClientID, tokens.ClientID)
+
+	// Повторный запуск ничего не меняет
+	require.NoError(t, initializeDB(ctx, path))
+	backups, err = listBackups(backupDir())
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(backups))
+
+	// Откат 0007 не возвращает хэши вместо токенов: токены Яндекса теряются, аккаунт связывается заново
+	require.NoError(t, migrateDown(ctx, database, migrations, 6))
+	var yandexToken sql.NullString
+	require.NoError(t, database.QueryRow(`SELECT yandex_token FROM users WHERE id = 1`).Scan(&yandexToken))
+	assert.False(t, yandexToken.Valid)
+}
+
+// useBackupDir направляет копии базы во временный каталог теста
+func useBackupDir(t *testing.T) {
+	previous := backupDirectory
+	backupDirectory = t.TempDir() + "/backups"
+	t.Cleanup(func() { backupDirectory = previous })
+}
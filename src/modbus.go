@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// driverModbus - реле и диммеры Modbus TCP. Устройства описываются в controllers.driver_config:
+//
+//	{"unit": 1, "devices": [
+//	  {"id": 1, "name": "Свет кухня", "room": "Кухня", "coil": 0},
+//	  {"id": 2, "name": "Диммер зал", "room": "Зал", "coil": 1, "register": 10, "max": 255}]}
+//
+// Катушка coil включает устройство, holding регистр register задает яркость от 0 до max
+const driverModbus = "modbus"
+
+const (
+	modbusReadCoils        = 0x01
+	modbusReadRegisters    = 0x03
+	modbusWriteCoil        = 0x05
+	modbusWriteRegister    = 0x06
+	modbusDefaultPort      = "502"
+	modbusMaxCoilSpan      = 2000
+	modbusMaxRegisterSpan  = 125
+	modbusDefaultLightType = 1
+	modbusDefaultMax       = 100
+)
+
+var errModbusException = errors.New("modbus exception")
+
+type modbusConfig struct {
+	Unit    byte           `json:"unit"`
+	Devices []modbusDevice `json:"devices"`
+}
+
+type modbusDevice struct {
+	ID       int     `json:"id"`
+	Guid     string  `json:"guid,omitempty"`
+	Name     string  `json:"name"`
+	RoomID   int     `json:"room_id"`
+	Room     string  `json:"room"`
+	Type     int     `json:"type"`
+	Coil     uint16  `json:"coil"`
+	Register *uint16 `json:"register,omitempty"`
+	Max      uint16  `json:"max,omitempty"`
+}
+
+type modbusDriver struct {
+	id      int
+	uri     string
+	address string
+	config  modbusConfig
+}
+
+func newModbusDriver(cntl controllerRow) (controllerDriver, error) {
+	u, err := url.Parse(cntl.URI)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != driverModbus || u.Host == "" {
+		return nil, errors.New("modbus controller uri must be modbus://host[:port]")
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), modbusDefaultPort)
+	}
+
+	var config modbusConfig
+	if err = json.Unmarshal([]byte(cntl.DriverConfig), &config); err != nil {
+		return nil, fmt.Errorf("invalid modbus driver config: %v", err)
+	}
+	if len(config.Devices) == 0 {
+		return nil, errors.New("invalid modbus driver config: no devices")
+	}
+
+	ids := make(map[int]bool, len(config.Devices))
+	for index := range config.Devices {
+		device := &config.Devices[index]
+		if ids[device.ID] {
+			return nil, fmt.Errorf("invalid modbus driver config: duplicate device id %d", device.ID)
+		}
+		ids[device.ID] = true
+
+		if device.Guid == "" {
+			device.Guid = fmt.Sprintf("modbus-%d-%d", cntl.ID, device.ID)
+		}
+		if device.Type == 0 {
+			device.Type = modbusDefaultLightType
+		}
+		if device.Max == 0 {
+			device.Max = modbusDefaultMax
+		}
+	}
+
+	coils, registers := modbusSpans(config.Devices)
+	if coils.count > modbusMaxCoilSpan || registers.count > modbusMaxRegisterSpan {
+		return nil, errors.New("invalid modbus driver config: coils or registers are too far apart")
+	}
+
+	return modbusDriver{id: cntl.ID, uri: cntl.URI, address: address, config: config}, nil
+}
+
+func (d modbusDriver) devices(ctx context.Context) ([]deviceSmartHome, error) {
+	return readControllerDevices(ctx, d.id, func(ctx context.Context) ([]deviceSmartHome, string, error) {
+		devices, err := d.read(ctx, d.config.Devices)
+		return devices, "", err
+	})
+}
+
+func (d modbusDriver) state(ctx context.Context, ids []int) ([]deviceSmartHome, error) {
+	if ids == nil {
+		return d.read(ctx, d.config.Devices)
+	}
+
+	wanted := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	devices := make([]modbusDevice, 0, len(ids))
+	for _, device := range d.config.Devices {
+		if wanted[device.ID] {
+			devices = append(devices, device)
+		}
+	}
+
+	return d.read(ctx, devices)
+}
+
+func (d modbusDriver) execute(ctx context.Context, act deviceActionSmartHome) error {
+	var device *modbusDevice
+	for index := range d.config.Devices {
+		if d.config.Devices[index].ID == act.ID {
+			device = &d.config.Devices[index]
+		}
+	}
+	if device == nil {
+		return fmt.Errorf("modbus device %d not found", act.ID)
+	}
+
+	client, err := dialModbus(ctx, d.address, d.config.Unit)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+
+	if act.ChangeDimming == 1 && device.Register != nil {
+		value := act.DimmingValue
+		if value < 0 {
+			value = 0
+		} else if value > 100 {
+			value = 100
+		}
+		if err = client.writeRegister(*device.Register, uint16(value*int(device.Max)/100)); err != nil {
+			return err
+		}
+	}
+
+	return client.writeCoil(device.Coil, act.TurnOn == 1)
+}
+
+// read читает катушки и регистры устройств двумя запросами
+func (d modbusDriver) read(c context.Context, devices []modbusDevice) ([]deviceSmartHome, error) {
+	ctx := c
+	result := make([]deviceSmartHome, 0, len(devices))
+	if len(devices) == 0 {
+		return result, nil
+	}
+
+	client, err := dialModbus(ctx, d.address, d.config.Unit)
+	if err != nil {
+		return nil, err
+	}
+	defer client.close()
+
+	coilSpan, registerSpan := modbusSpans(devices)
+
+	coils, err := client.readCoils(coilSpan.first, uint16(coilSpan.count))
+	if err != nil {
+		return nil, err
+	}
+
+	var registers []uint16
+	if registerSpan.count > 0 {
+		if registers, err = client.readRegisters(registerSpan.first, uint16(registerSpan.count)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, device := range devices {
+		smartHome := deviceSmartHome{
+			ID:           device.ID,
+			Guid:         device.Guid,
+			Name:         device.Name,
+			RoomID:       device.RoomID,
+			RoomName:     device.Room,
+			DeviceTypeID: device.Type,
+			LineID:       device.ID,
+			Active:       1,
+			host:         d.uri,
+			driver:       d,
+			controllerID: d.id,
+		}
+
+		if coils[device.Coil-coilSpan.first] {
+			smartHome.TurnOn = 1
+		}
+
+		if device.Register != nil {
+			smartHome.Dimming = 1
+			smartHome.DimmingValue = int(registers[*device.Register-registerSpan.first]) * 100 / int(device.Max)
+		}
+
+		result = append(result, smartHome)
+	}
+
+	return result, nil
+}
+
+// modbusSpan - диапазон адресов. count в int: 0..65535 дает 65536 адресов, больше uint16
+type modbusSpan struct {
+	first uint16
+	count int
+}
+
+// modbusSpans возвращает диапазоны адресов катушек и регистров, покрывающие все устройства
+func modbusSpans(devices []modbusDevice) (coils modbusSpan, registers modbusSpan) {
+	var coilLast, registerLast uint16
+	hasRegisters := false
+
+	for index, device := range devices {
+		if index == 0 || device.Coil < coils.first {
+			coils.first = device.Coil
+		}
+		if index == 0 || device.Coil > coilLast {
+			coilLast = device.Coil
+		}
+
+		if device.Register == nil {
+			continue
+		}
+		if !hasRegisters || *device.Register < registers.first {
+			registers.first = *device.Register
+		}
+		if !hasRegisters || *device.Register > registerLast {
+			registerLast = *device.Register
+		}
+		hasRegisters = true
+	}
+
+	if len(devices) > 0 {
+		coils.count = int(coilLast) - int(coils.first) + 1
+	}
+	if hasRegisters {
+		registers.count = int(registerLast) - int(registers.first) + 1
+	}
+
+	return coils, registers
+}
+
+// modbusClient - минимальный клиент Modbus TCP: чтение и запись одиночных катушек и holding регистров
+type modbusClient struct {
+	conn        net.Conn
+	unit        byte
+	transaction uint16
+}
+
+func dialModbus(ctx context.Context, address string, unit byte) (*modbusClient, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(timeout)
+	}
+	conn.SetDeadline(deadline)
+
+	return &modbusClient{conn: conn, unit: unit}, nil
+}
+
+func (m *modbusClient) close() {
+	m.conn.Close()
+}
+
+// request отправляет PDU и возвращает данные ответа без кода функции
+func (m *modbusClient) request(function byte, data []byte) ([]byte, error) {
+	m.transaction++
+
+	frame := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint16(frame[0:], m.transaction)
+	binary.BigEndian.PutUint16(frame[2:], 0)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(data)+2))
+	frame[6] = m.unit
+	frame[7] = function
+	copy(frame[8:], data)
+
+	if _, err := m.conn.Write(frame); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(m.conn, header); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 2 || length > 256 {
+		return nil, fmt.Errorf("invalid modbus response length %d", length)
+	}
+
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(m.conn, pdu); err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint16(header[0:]) != m.transaction {
+		return nil, errors.New("modbus transaction id mismatch")
+	}
+
+	if pdu[0] == function|0x80 {
+		if len(pdu) < 2 {
+			return nil, errModbusException
+		}
+		return nil, fmt.Errorf("%w: function %#x code %d", errModbusException, function, pdu[1])
+	}
+	if pdu[0] != function {
+		return nil, fmt.Errorf("unexpected modbus function %#x", pdu[0])
+	}
+
+	return pdu[1:], nil
+}
+
+func (m *modbusClient) readCoils(address uint16, quantity uint16) ([]bool, error) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data[0:], address)
+	binary.BigEndian.PutUint16(data[2:], quantity)
+
+	response, err := m.request(modbusReadCoils, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 1 || int(response[0]) != (int(quantity)+7)/8 || len(response)-1 != int(response[0]) {
+		return nil, errors.New("invalid modbus read coils response")
+	}
+
+	coils := make([]bool, quantity)
+	for i := range coils {
+		coils[i] = response[1+i/8]&(1<<(uint(i)%8)) != 0
+	}
+
+	return coils, nil
+}
+
+func (m *modbusClient) readRegisters(address uint16, quantity uint16) ([]uint16, error) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data[0:], address)
+	binary.BigEndian.PutUint16(data[2:], quantity)
+
+	response, err := m.request(modbusReadRegisters, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 1 || int(response[0]) != 2*int(quantity) || len(response)-1 != int(response[0]) {
+		return nil, errors.New("invalid modbus read registers response")
+	}
+
+	registers := make([]uint16, quantity)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(response[1+2*i:])
+	}
+
+	return registers, nil
+}
+
+func (m *modbusClient) writeCoil(address uint16, on bool) error {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data[0:], address)
+	if on {
+		binary.BigEndian.PutUint16(data[2:], 0xff00)
+	}
+
+	_, err := m.request(modbusWriteCoil, data)
+	return err
+}
+
+func (m *modbusClient) writeRegister(address uint16, value uint16) error {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data[0:], address)
+	binary.BigEndian.PutUint16(data[2:], value)
+
+	_, err := m.request(modbusWriteRegister, data)
+	return err
+}
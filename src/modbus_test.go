@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeModbus - Modbus TCP сервер с катушками и holding регистрами в памяти
+type fakeModbus struct {
+	mutex     sync.Mutex
+	coils     [64]bool
+	registers [64]uint16
+}
+
+func (f *fakeModbus) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeModbus) handle(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		response := f.execute(pdu)
+		binary.BigEndian.PutUint16(header[4:], uint16(len(response)+1))
+		conn.Write(append(header, response...))
+	}
+}
+
+func (f *fakeModbus) execute(pdu []byte) []byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	address := binary.BigEndian.Uint16(pdu[1:])
+	value := binary.BigEndian.Uint16(pdu[3:])
+
+	switch pdu[0] {
+	case modbusReadCoils:
+		data := make([]byte, (value+7)/8)
+		for i := uint16(0); i < value; i++ {
+			if f.coils[address+i] {
+				data[i/8] |= 1 << (i % 8)
+			}
+		}
+		return append([]byte{pdu[0], byte(len(data))}, data...)
+	case modbusReadRegisters:
+		data := make([]byte, 2*value)
+		for i := uint16(0); i < value; i++ {
+			binary.BigEndian.PutUint16(data[2*i:], f.registers[address+i])
+		}
+		return append([]byte{pdu[0], byte(len(data))}, data...)
+	case modbusWriteCoil:
+		f.coils[address] = value == 0xff00
+		return pdu
+	case modbusWriteRegister:
+		f.registers[address] = value
+		return pdu
+	}
+
+	return []byte{pdu[0] | 0x80, 1}
+}
+
+func TestModbusDriver(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	fake := &fakeModbus{}
+	fake.coils[3] = true
+	fake.registers[10] = 255
+	go fake.serve(listener)
+
+	config := `{"unit": 1, "devices": [
+		{"id": 1, "name": "Свет кухня", "room": "Кухня", "coil": 3},
+		{"id": 2, "name": "Диммер зал", "room": "Зал", "coil": 5, "register": 10, "max": 255}]}`
+
+	_, err = newModbusDriver(controllerRow{ID: 7, URI: "modbus://" + listener.Addr().String(), DriverConfig: `{"devices": []}`})
+	assert.Error(t, err)
+	_, err = newModbusDriver(controllerRow{ID: 7, URI: "modbus://" + listener.Addr().String(),
+		DriverConfig: `{"devices": [{"id": 1, "coil": 0}, {"id": 1, "coil": 1}]}`})
+	assert.Error(t, err)
+	_, err = newModbusDriver(controllerRow{ID: 7, URI: "modbus://" + listener.Addr().String(),
+		DriverConfig: `{"devices": [{"id": 1, "coil": 0}, {"id": 2, "coil": 5000}]}`})
+	assert.Error(t, err)
+
+	driver, err := controllerRow{ID: 7, URI: "modbus://" + listener.Addr().String(), Driver: driverModbus, DriverConfig: config}.driver()
+	require.NoError(t, err)
+
+	devices, err := driver.devices(context.Background())
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	assert.Equal(t, "modbus-7-1", devices[0].Guid)
+	assert.Equal(t, 1, devices[0].TurnOn)
+	assert.Equal(t, 0, devices[1].TurnOn)
+	assert.Equal(t, 1, devices[1].Dimming)
+	assert.Equal(t, 100, devices[1].DimmingValue)
+
+	err = driver.execute(context.Background(), deviceActionSmartHome{ID: 2, TurnOn: 1, ChangeDimming: 1, DimmingValue: 40})
+	require.NoError(t, err)
+	assert.True(t, fake.coils[5])
+	assert.Equal(t, uint16(102), fake.registers[10])
+
+	state, err := driver.state(context.Background(), []int{2})
+	require.NoError(t, err)
+	require.Len(t, state, 1)
+	assert.Equal(t, 1, state[0].TurnOn)
+	assert.Equal(t, 40, state[0].DimmingValue)
+
+	assert.Error(t, driver.execute(context.Background(), deviceActionSmartHome{ID: 9, TurnOn: 1}))
+}
+
+func TestModbusSpans(t *testing.T) {
+	register := uint16(65535)
+	coils, registers := modbusSpans([]modbusDevice{{Coil: 0}, {Coil: 65535, Register: &register}})
+	assert.Equal(t, 65536, coils.count)
+	assert.Equal(t, 1, registers.count)
+
+	// Диапазон во весь адресный уровень не переполняется и не проходит проверку конфигурации
+	_, err := newModbusDriver(controllerRow{URI: "modbus://127.0.0.1", Driver: driverModbus,
+		DriverConfig: `{"devices":[{"id":1,"guid":"a","coil":0},{"id":2,"guid":"b","coil":65535}]}`})
+	assert.Error(t, err)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// yandexDialogsURL - API уведомлений умного дома Яндекса
+const yandexDialogsURL = "https://dialogs.yandex.net/api/v1/skills/"
+
+// notifyBuffer - сколько событий ждут отправки в Яндекс
+const notifyBuffer = 256
+
+var (
+	// yandexSkillID и yandexSkillToken - id навыка и OAuth токен для уведомлений, без них уведомления выключены
+	yandexSkillID    = ""
+	yandexSkillToken = ""
+)
+
+// yandexUserID - id пользователя в ответах навыка, по нему Яндекс сопоставляет уведомления
+func yandexUserID(userID int) string {
+	return strconv.Itoa(userID)
+}
+
+// yandexNotifier сообщает Яндексу об изменениях устройств: состояние через callback/state,
+// появление и удаление устройств через callback/discovery. События отправляются из своей горутины,
+// чтобы медленный ответ Яндекса не задерживал опрос контроллеров
+type yandexNotifier struct {
+	url    string
+	token  string
+	client *http.Client
+	events chan controllerEvent
+}
+
+func newYandexNotifier(skillID string, token string) *yandexNotifier {
+	return &yandexNotifier{
+		url:    yandexDialogsURL + skillID + "/callback/",
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+		events: make(chan controllerEvent, notifyBuffer),
+	}
+}
+
+// publish - обработчик событий опроса, см. poller.subscribe. При переполнении событие теряется
+func (n *yandexNotifier) publish(event controllerEvent) {
+	select {
+	case n.events <- event:
+	default:
+		msu.Warn(context.Background(), fmt.Errorf("yandex notification queue is full, %s dropped", event.Type),
+			zap.Int("controller", event.ControllerID))
+	}
+}
+
+func (n *yandexNotifier) run(c context.Context) {
+	ctx := c
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-n.events:
+			if err := n.notify(ctx, event); err != nil {
+				msu.Warn(ctx, err, zap.String("event", string(event.Type)), zap.Int("controller", event.ControllerID))
+			}
+		}
+	}
+}
+
+func (n *yandexNotifier) notify(c context.Context, event controllerEvent) error {
+	ctx := c
+
+	switch event.Type {
+	case DeviceAdded, DeviceRemoved:
+		return n.send(ctx, "discovery", struct {
+			UserID string `json:"user_id"`
+		}{UserID: yandexUserID(event.UserID)})
+	case DeviceStateChanged:
+		device := *event.Device
+		typeYandexID, err := typeYandex(device.DeviceTypeID)
+		if err != nil {
+			return nil
+		}
+		// Вторая линия шторы не видна в Яндексе, см. toYandexDevices
+		if (typeYandexID == "devices.types.openable" || typeYandexID == "devices.types.openable.curtain") && device.LineIndex%2 == 1 {
+			return nil
+		}
+
+		devices := []deviceSmartHome{device}
+		if err = assignDeviceIDs(ctx, event.ControllerID, devices); err != nil {
+			return err
+		}
+		if devices[0].externalID == "" {
+			return nil
+		}
+
+		type deviceState struct {
+			ID           string        `json:"id"`
+			Capabilities []interface{} `json:"capabilities"`
+		}
+		return n.send(ctx, "state", struct {
+			UserID  string        `json:"user_id"`
+			Devices []deviceState `json:"devices"`
+		}{
+			UserID: yandexUserID(event.UserID),
+			Devices: []deviceState{{
+				ID:           devices[0].externalID,
+				Capabilities: toYandexQueryCapabilities(typeYandexID, device),
+			}},
+		})
+	}
+
+	return nil
+}
+
+func (n *yandexNotifier) send(c context.Context, method string, payload interface{}) error {
+	ctx := c
+
+	body, err := json.Marshal(struct {
+		TS      int64       `json:"ts"`
+		Payload interface{} `json:"payload"`
+	}{
+		TS:      time.Now().Unix(),
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "OAuth "+n.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	if debug {
+		msu.Info(ctx, zap.String("request", "yandex"), zap.String("uri", n.url+method), zap.String("body", string(body)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		result, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("yandex callback/%s: status %d: %s", method, resp.StatusCode, result)
+	}
+
+	return nil
+}
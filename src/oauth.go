@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// pkcePattern - допустимые code_challenge и code_verifier по RFC 7636
+var pkcePattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+// authCode - код авторизации, выданный пользователю для клиента
+type authCode struct {
+	Code     string
+	UserID   int
+	ClientID string
+	// RedirectURI - redirect_uri из запроса авторизации, пустой, если клиент его не передал
+	RedirectURI     string
+	Scope           string
+	Challenge       string
+	ChallengeMethod string
+	IssuedAt        time.Time
+}
+
+// oauthError - ошибка по RFC 6749: code уходит в поле error ответа или адреса возврата
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	status      int
+}
+
+func newOAuthError(status int, code string, description string) *oauthError {
+	return &oauthError{Code: code, Description: description, status: status}
+}
+
+func (e *oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// writeOAuthError отвечает ошибкой в JSON. На 401 клиенту предлагается HTTP Basic
+func writeOAuthError(w http.ResponseWriter, e *oauthError) {
+	result, _ := json.Marshal(e)
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if e.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="bsh"`)
+	}
+	w.WriteHeader(e.status)
+	fmt.Fprint(w, string(result))
+}
+
+// oauthRedirect перенаправляет пользователя на адрес клиента, дополняя его параметры
+func oauthRedirect(w http.ResponseWriter, uri string, params url.Values) {
+	location, _ := url.Parse(uri)
+	query := location.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	location.RawQuery = query.Encode()
+
+	w.Header().Set("Location", location.String())
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusFound)
+}
+
+// repeatedParameter возвращает имя параметра, переданного больше одного раза
+func repeatedParameter(values url.Values) string {
+	for name, value := range values {
+		if len(value) > 1 {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// authorizationRequest - проверенные параметры запроса /auth/authorize
+type authorizationRequest struct {
+	client oauthClient
+	// redirectURI - куда вернуть пользователя, пустой, пока client_id и redirect_uri не проверены
+	redirectURI string
+	// explicitRedirect - redirect_uri передан явно и должен повториться при обмене кода
+	explicitRedirect bool
+	state            string
+	scope            string
+	challenge        string
+	challengeMethod  string
+}
+
+// parseAuthorizationRequest проверяет параметры запроса авторизации. Пока client_id и redirect_uri
+// не проверены, ошибку нельзя отправлять на redirect_uri - тогда request.redirectURI пустой
+func parseAuthorizationRequest(c context.Context, query url.Values) (authorizationRequest, *oauthError) {
+	ctx := c
+	var request authorizationRequest
+
+	if len(query["client_id"]) > 1 || len(query["redirect_uri"]) > 1 {
+		return request, newOAuthError(http.StatusBadRequest, "invalid_request", "client_id and redirect_uri must not be repeated")
+	}
+	clientID := query.Get("client_id")
+	if clientID == "" {
+		return request, newOAuthError(http.StatusBadRequest, "invalid_request", "client_id is required")
+	}
+
+	client, err := store.oauthClient(ctx, clientID)
+	if err == errNotFound {
+		return request, newOAuthError(http.StatusBadRequest, "invalid_request", "unknown client_id")
+	}
+	if err != nil {
+		return request, newOAuthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	request.client = client
+
+	// Без redirect_uri используется единственный зарегистрированный адрес клиента
+	redirectURI := query.Get("redirect_uri")
+	request.explicitRedirect = redirectURI != ""
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if redirectURI == "" {
+		return request, newOAuthError(http.StatusBadRequest, "invalid_request", "redirect_uri is required")
+	}
+	if !client.allowsRedirect(redirectURI) {
+		return request, newOAuthError(http.StatusBadRequest, "invalid_request", "redirect_uri is not registered for the client")
+	}
+	request.redirectURI = redirectURI
+	request.state = query.Get("state")
+
+	if name := repeatedParameter(query); name != "" {
+		return request, newOAuthError(http.StatusBadRequest, "invalid_request", name+" must not be repeated")
+	}
+
+	switch query.Get("response_type") {
+	case "code":
+	case "":
+		return request, newOAuthError(http.StatusBadRequest, "invalid_request", "response_type is required")
+	default:
+		return request, newOAuthError(http.StatusBadRequest, "unsupported_response_type", "only response_type=code is supported")
+	}
+
+	request.scope = query.Get("scope")
+	request.challenge = query.Get("code_challenge")
+	request.challengeMethod = query.Get("code_challenge_method")
+	if request.challenge == "" && request.challengeMethod != "" {
+		return request, newOAuthError(http.StatusBadRequest, "invalid_request", "code_challenge is required with code_challenge_method")
+	}
+	if request.challenge != "" {
+		if request.challengeMethod == "" {
+			request.challengeMethod = "plain"
+		}
+		if request.challengeMethod != "plain" && request.challengeMethod != "S256" {
+			return request, newOAuthError(http.StatusBadRequest, "invalid_request", "code_challenge_method must be S256 or plain")
+		}
+		if !pkcePattern.MatchString(request.challenge) {
+			return request, newOAuthError(http.StatusBadRequest, "invalid_request", "invalid code_challenge")
+		}
+	}
+
+	return request, nil
+}
+
+// authorizationErrorParams - параметры адреса возврата с ошибкой запроса авторизации
+func authorizationErrorParams(request authorizationRequest, e *oauthError) url.Values {
+	params := url.Values{"error": {e.Code}, "error_description": {e.Description}}
+	if request.state != "" {
+		params.Set("state", request.state)
+	}
+
+	return params
+}
+
+// verifyCodeChallenge проверяет code_verifier клиента по code_challenge из запроса авторизации
+func verifyCodeChallenge(challenge string, method string, verifier string) bool {
+	if !pkcePattern.MatchString(verifier) {
+		return false
+	}
+	if method == "S256" {
+		sum := sha256.Sum256([]byte(verifier))
+		verifier = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
+	return subtle.ConstantTimeCompare([]byte(verifier), []byte(challenge)) == 1
+}
+
+// authenticateClient проверяет клиента по HTTP Basic или по client_id и client_secret в теле запроса.
+// Форма запроса должна быть уже разобрана
+func authenticateClient(c context.Context, r *http.Request) (oauthClient, *oauthError) {
+	ctx := c
+
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		if r.PostForm.Get("client_secret") != "" {
+			return oauthClient{}, newOAuthError(http.StatusBadRequest, "invalid_request", "only one client authentication method is allowed")
+		}
+		// По RFC 6749 id и секрет в Basic закодированы как application/x-www-form-urlencoded
+		var err error
+		if clientID, err = url.QueryUnescape(clientID); err != nil {
+			return oauthClient{}, newOAuthError(http.StatusUnauthorized, "invalid_client", "malformed client credentials")
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return oauthClient{}, newOAuthError(http.StatusUnauthorized, "invalid_client", "malformed client credentials")
+		}
+		if formID := r.PostForm.Get("client_id"); formID != "" && formID != clientID {
+			return oauthClient{}, newOAuthError(http.StatusBadRequest, "invalid_request", "client_id does not match client credentials")
+		}
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	if clientID == "" {
+		return oauthClient{}, newOAuthError(http.StatusUnauthorized, "invalid_client", "client authentication is required")
+	}
+
+	client, err := store.oauthClient(ctx, clientID)
+	if err != nil && err != errNotFound {
+		return oauthClient{}, newOAuthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	if err == errNotFound || !client.checkSecret(secret) {
+		return oauthClient{}, newOAuthError(http.StatusUnauthorized, "invalid_client", "client authentication failed")
+	}
+
+	return client, nil
+}
+
+// exchangeAuthCode проверяет код авторизации и возвращает его. Код удаляется и при ошибке проверки,
+// чтобы его нельзя было подбирать
+func exchangeAuthCode(c context.Context, client oauthClient, form url.Values) (authCode, *oauthError) {
+	ctx := c
+
+	code := form.Get("code")
+	if code == "" {
+		return authCode{}, newOAuthError(http.StatusBadRequest, "invalid_request", "code is required")
+	}
+
+	row, err := store.consumeAuthCode(ctx, code)
+	if err == errNotFound {
+		return authCode{}, newOAuthError(http.StatusBadRequest, "invalid_grant", "unknown or used authorization code")
+	}
+	if err != nil {
+		return authCode{}, newOAuthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+
+	if time.Since(row.IssuedAt) > authCodeTTL {
+		return authCode{}, newOAuthError(http.StatusBadRequest, "invalid_grant", "authorization code expired")
+	}
+	if row.ClientID != client.ID {
+		return authCode{}, newOAuthError(http.StatusBadRequest, "invalid_grant", "authorization code was issued to another client")
+	}
+	if row.RedirectURI != "" && form.Get("redirect_uri") != row.RedirectURI {
+		return authCode{}, newOAuthError(http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+	}
+	if row.Challenge != "" && !verifyCodeChallenge(row.Challenge, row.ChallengeMethod, form.Get("code_verifier")) {
+		return authCode{}, newOAuthError(http.StatusBadRequest, "invalid_grant", "invalid code_verifier")
+	}
+
+	return row, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+)
+
+const (
+	testClientSecret = "client-secret"
+	testRedirectURI  = "https://social.yandex.net/broker/redirect"
+)
+
+// registerTestClient регистрирует клиента yandex с единственным адресом возврата
+func registerTestClient(t *testing.T) {
+	require.NoError(t, store.createOAuthClient(context.Background(), oauthClient{
+		ID:           "yandex",
+		Name:         "Яндекс",
+		SecretHash:   hashClientSecret(testClientSecret),
+		RedirectURIs: []string{testRedirectURI},
+		CreatedAt:    time.Now(),
+	}))
+}
+
+func TestOAuthAuthorize(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+	store = newMemoryStorage()
+	registerTestClient(t)
+	require.NoError(t, store.createOAuthClient(context.Background(), oauthClient{
+		ID:           "other",
+		Name:         "Other",
+		SecretHash:   hashClientSecret(testClientSecret),
+		RedirectURIs: []string{"https://other.example/callback", "https://other.example/second"},
+	}))
+	router := handlers()
+
+	challenge := strings.Repeat("a", 43)
+	tests := []struct {
+		name  string
+		query string
+		// redirect - ошибка отправлена клиенту на адрес возврата, а не показана пользователю
+		redirect bool
+		error    string
+	}{
+		{"valid", "response_type=code&client_id=yandex&state=s", false, ""},
+		{"explicit redirect", "response_type=code&client_id=yandex&redirect_uri=" + url.QueryEscape(testRedirectURI), false, ""},
+		{"pkce", "response_type=code&client_id=yandex&code_challenge=" + challenge + "&code_challenge_method=S256", false, ""},
+		{"missing client", "response_type=code", false, "invalid_request"},
+		{"unknown client", "response_type=code&client_id=unknown", false, "invalid_request"},
+		{"foreign redirect", "response_type=code&client_id=yandex&redirect_uri=https://evil.example/", false, "invalid_request"},
+		{"redirect required", "response_type=code&client_id=other", false, "invalid_request"},
+		{"repeated client", "response_type=code&client_id=yandex&client_id=other", false, "invalid_request"},
+		{"missing response type", "client_id=yandex&state=s", true, "invalid_request"},
+		{"token response type", "response_type=token&client_id=yandex&state=s", true, "unsupported_response_type"},
+		{"repeated state", "response_type=code&client_id=yandex&state=a&state=b", true, "invalid_request"},
+		{"bad challenge method", "response_type=code&client_id=yandex&code_challenge=" + challenge + "&code_challenge_method=S512", true, "invalid_request"},
+		{"short challenge", "response_type=code&client_id=yandex&code_challenge=short", true, "invalid_request"},
+		{"method without challenge", "response_type=code&client_id=yandex&code_challenge_method=S256", true, "invalid_request"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/auth/authorize?"+test.query, nil))
+
+			switch {
+			case test.error == "":
+				assert.Equal(t, http.StatusOK, recorder.Code)
+				assert.NotEmpty(t, recorder.Header().Get("X-Request-Id"))
+				assert.Contains(t, recorder.Body.String(), "Яндекс")
+			case test.redirect:
+				require.Equal(t, http.StatusFound, recorder.Code)
+				location, err := url.Parse(recorder.Header().Get("Location"))
+				require.NoError(t, err)
+				assert.Equal(t, "social.yandex.net", location.Host)
+				assert.Equal(t, test.error, location.Query().Get("error"))
+				if strings.Contains(test.query, "state=s") {
+					assert.Equal(t, "s", location.Query().Get("state"))
+				}
+			default:
+				assert.Equal(t, http.StatusBadRequest, recorder.Code)
+				assert.Empty(t, recorder.Header().Get("Location"))
+				var response oauthError
+				require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+				assert.Equal(t, test.error, response.Code)
+				assert.NotEmpty(t, response.Description)
+			}
+		})
+	}
+}
+
+func TestOAuthToken(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	for name, newStore := range testStorages() {
+		t.Run(name, func(t *testing.T) {
+			store = newStore(t)
+			ctx := context.Background()
+			router := handlers()
+			registerTestClient(t)
+			_, err := store.createUser(ctx, "user", fmt.Sprintf("%x", md5.Sum([]byte("secret"))))
+			require.NoError(t, err)
+
+			post := func(uri string, form url.Values, configure func(req *http.Request)) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodPost, uri, strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				if configure != nil {
+					configure(req)
+				}
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, req)
+				return recorder
+			}
+			basic := func(req *http.Request) { req.SetBasicAuth("yandex", testClientSecret) }
+			oauthErrorCode := func(recorder *httptest.ResponseRecorder) string {
+				var response oauthError
+				require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+				return response.Code
+			}
+
+			// issueCode проходит authorize и login и возвращает код авторизации
+			issueCode := func(query string) string {
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/auth/authorize?response_type=code&client_id=yandex"+query, nil))
+				require.Equal(t, http.StatusOK, recorder.Code)
+
+				recorder = post("/auth/login", url.Values{"username": {"user"}, "password": {"secret"}, "rid": {recorder.Header().Get("X-Request-Id")}}, nil)
+				require.Equal(t, http.StatusFound, recorder.Code)
+				location, err := url.Parse(recorder.Header().Get("Location"))
+				require.NoError(t, err)
+				return location.Query().Get("code")
+			}
+
+			// Аутентификация клиента
+			code := issueCode("")
+			recorder := post("/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {code}}, nil)
+			assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+			assert.Equal(t, "invalid_client", oauthErrorCode(recorder))
+			assert.NotEmpty(t, recorder.Header().Get("WWW-Authenticate"))
+
+			recorder = post("/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {code}}, func(req *http.Request) {
+				req.SetBasicAuth("yandex", "wrong")
+			})
+			assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+			recorder = post("/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_secret": {testClientSecret}}, basic)
+			assert.Equal(t, "invalid_request", oauthErrorCode(recorder))
+
+			recorder = post("/auth/token", url.Values{"grant_type": {"password"}}, basic)
+			assert.Equal(t, "unsupported_grant_type", oauthErrorCode(recorder))
+
+			// Код обменивается один раз
+			recorder = post("/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {code}}, basic)
+			require.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+			var tokens tokenResponse
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &tokens))
+			assert.Equal(t, "Bearer", tokens.TokenType)
+			assert.NotEqual(t, tokens.AccessToken, tokens.RefreshToken)
+			assert.Equal(t, int(accessTokenTTL/time.Second), tokens.ExpiresIn)
+			user, err := store.userByAccessToken(ctx, tokens.AccessToken, time.Now())
+			require.NoError(t, err)
+			assert.Equal(t, "user", user.Name)
+
+			recorder = post("/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {code}}, basic)
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+			assert.Equal(t, "invalid_grant", oauthErrorCode(recorder))
+
+			recorder = post("/auth/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}}, basic)
+			require.Equal(t, http.StatusOK, recorder.Code)
+
+			// redirect_uri, переданный в запросе авторизации, должен повториться
+			code = issueCode("&redirect_uri=" + url.QueryEscape(testRedirectURI))
+			recorder = post("/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {code}}, basic)
+			assert.Equal(t, "invalid_grant", oauthErrorCode(recorder))
+			code = issueCode("&redirect_uri=" + url.QueryEscape(testRedirectURI))
+			recorder = post("/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {testRedirectURI}}, basic)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+
+			// PKCE S256
+			verifier := strings.Repeat("v", 50)
+			sum := sha256.Sum256([]byte(verifier))
+			challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+			code = issueCode("&code_challenge=" + challenge + "&code_challenge_method=S256")
+			recorder = post("/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {code}, "code_verifier": {strings.Repeat("w", 50)}}, basic)
+			assert.Equal(t, "invalid_grant", oauthErrorCode(recorder))
+			code = issueCode("&code_challenge=" + challenge + "&code_challenge_method=S256")
+			recorder = post("/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {code}, "code_verifier": {verifier}}, basic)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+
+			// Просроченный код
+			require.NoError(t, store.createAuthRequest(ctx, "request", "response_type=code&client_id=yandex", time.Now()))
+			require.NoError(t, store.completeAuthRequest(ctx, "request", authCode{
+				Code: "expired", UserID: user.ID, ClientID: "yandex", IssuedAt: time.Now().Add(-authCodeTTL - time.Minute),
+			}))
+			recorder = post("/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {"expired"}}, basic)
+			assert.Equal(t, "invalid_grant", oauthErrorCode(recorder))
+		})
+	}
+}
+
+func TestValidateRedirectURI(t *testing.T) {
+	assert.NoError(t, validateRedirectURI(testRedirectURI))
+	assert.NoError(t, validateRedirectURI("http://localhost:8080/callback"))
+	assert.NoError(t, validateRedirectURI("http://127.0.0.1/callback"))
+	assert.Error(t, validateRedirectURI("http://example.com/callback"))
+	assert.Error(t, validateRedirectURI("https://example.com/callback#fragment"))
+	assert.Error(t, validateRedirectURI("/callback"))
+}
+
+func TestSeedYandexClient(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	for name, newStorage := range testStorages() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			clients := newStorage(t)
+
+			require.NoError(t, seedYandexClient(ctx, clients, "", testRedirectURI))
+			list, err := clients.oauthClients(ctx)
+			require.NoError(t, err)
+			assert.Empty(t, list)
+
+			require.NoError(t, seedYandexClient(ctx, clients, "first", testRedirectURI))
+			client, err := clients.oauthClient(ctx, yandexClientID)
+			require.NoError(t, err)
+			assert.True(t, client.checkSecret("first"))
+			assert.Equal(t, []string{testRedirectURI}, client.RedirectURIs)
+
+			// Новый секрет из настроек заменяет старый, адрес возврата добавляется к зарегистрированным
+			require.NoError(t, seedYandexClient(ctx, clients, "second", "https://example.com/callback"))
+			client, err = clients.oauthClient(ctx, yandexClientID)
+			require.NoError(t, err)
+			assert.False(t, client.checkSecret("first"))
+			assert.True(t, client.checkSecret("second"))
+			assert.Equal(t, []string{testRedirectURI, "https://example.com/callback"}, client.RedirectURIs)
+		})
+	}
+}
+
+func TestClientsLocked(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+	path := t.TempDir() + "/users.db"
+	useBackupDir(t)
+
+	// Пока сервер держит блокировку, команда не трогает базу
+	unlock, err := lockDatabase(path)
+	require.NoError(t, err)
+	assert.Equal(t, errDatabaseLocked, runClients([]string{"-db", path, "list"}))
+	unlock()
+
+	assert.NoError(t, runClients([]string{"-db", path, "list"}))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// passwordCost - сложность bcrypt для новых хэшей. Хэши с другой сложностью пересчитываются при входе
+	passwordCost = bcrypt.DefaultCost
+
+	// errPasswordTooLong - bcrypt учитывает только первые 72 байта пароля
+	errPasswordTooLong = errors.New("password is longer than 72 bytes")
+
+	// dummyPasswordHash сравнивается с паролем неизвестного пользователя, чтобы по времени ответа
+	// нельзя было узнать, есть ли такой логин
+	dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+)
+
+// hashPassword возвращает хэш bcrypt пароля: соль и сложность хранятся в самой строке хэша
+func hashPassword(password string) (string, error) {
+	if len(password) > 72 {
+		return "", errPasswordTooLong
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	return string(hash), err
+}
+
+// isLegacyPasswordHash - хэш записан до перехода на bcrypt: md5 пароля без соли в hex
+func isLegacyPasswordHash(hash string) bool {
+	if len(hash) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// checkPassword сравнивает пароль с хэшем. upgrade - хэш устарел и его нужно пересчитать
+func checkPassword(hash string, password string) (ok bool, upgrade bool) {
+	if isLegacyPasswordHash(hash) {
+		sum := md5.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(hash)) == 1, true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, err != nil || cost != passwordCost
+}
+
+// authenticateUser проверяет логин и пароль, errNotFound - неизвестный логин или неверный пароль.
+// Устаревший хэш после успешной проверки заменяется хэшем bcrypt, ошибка замены не мешает входу
+func authenticateUser(c context.Context, name string, password string) (userRow, error) {
+	ctx := c
+
+	user, err := store.userByName(ctx, name)
+	if err == errNotFound {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return userRow{}, errNotFound
+	}
+	if err != nil {
+		return userRow{}, err
+	}
+
+	ok, upgrade := checkPassword(user.Password, password)
+	if !ok {
+		return userRow{}, errNotFound
+	}
+
+	if upgrade {
+		hash, err := hashPassword(password)
+		if err == nil {
+			err = store.setPassword(ctx, user.ID, hash)
+		}
+		if err != nil {
+			msu.Error(ctx, err, zap.Int("user", user.ID), zap.String("password", "upgrade"))
+		} else {
+			user.Password = hash
+		}
+	}
+
+	return user, nil
+}
+
+// runPasswords - команда passwords report: сколько пользователей еще не входили после перехода на bcrypt
+// и хранят пароль в md5. -list печатает их логины
+func runPasswords(args []string) error {
+	ctx := context.Background()
+
+	flags := flag.NewFlagSet("passwords", flag.ContinueOnError)
+	dbPath := flags.String("db", databaseDirectory+"/users.db", "database file")
+	list := flags.Bool("list", false, "print logins with legacy hashes")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// Флаги допускаются и до, и после действия
+	if flags.NArg() > 0 {
+		if flags.Arg(0) != "report" {
+			return errors.New("usage: passwords [-db path] report [-list]")
+		}
+		if err := flags.Parse(flags.Args()[1:]); err != nil {
+			return err
+		}
+	}
+
+	database, err := sql.Open("sqlite3", *dbPath)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	names, total, err := newSQLiteStorage(database, nil, nil).legacyPasswordUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *list && len(names) > 0 {
+		fmt.Println(strings.Join(names, "\n"))
+	}
+	fmt.Printf("legacy md5 passwords: %d of %d users\n", len(names), total)
+	return nil
+}
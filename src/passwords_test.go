@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordUpgrade(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	for name, newStore := range testStorages() {
+		t.Run(name, func(t *testing.T) {
+			store = newStore(t)
+			ctx := context.Background()
+
+			// Пользователи, созданные до перехода на bcrypt
+			_, err := store.createUser(ctx, "legacy", fmt.Sprintf("%x", md5.Sum([]byte("secret"))))
+			require.NoError(t, err)
+			_, err = store.createUser(ctx, "other", fmt.Sprintf("%x", md5.Sum([]byte("other"))))
+			require.NoError(t, err)
+			hash, err := hashPassword("modern")
+			require.NoError(t, err)
+			_, err = store.createUser(ctx, "modern", hash)
+			require.NoError(t, err)
+
+			legacy, total, err := store.legacyPasswordUsers(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"legacy", "other"}, legacy)
+			assert.Equal(t, 3, total)
+
+			// Неверный пароль не меняет хэш
+			_, err = authenticateUser(ctx, "legacy", "wrong")
+			assert.Equal(t, errNotFound, err)
+			_, err = authenticateUser(ctx, "unknown", "secret")
+			assert.Equal(t, errNotFound, err)
+			legacy, _, err = store.legacyPasswordUsers(ctx)
+			require.NoError(t, err)
+			assert.Len(t, legacy, 2)
+
+			// Верный пароль в md5 пересчитывается в bcrypt
+			user, err := authenticateUser(ctx, "legacy", "secret")
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(user.Password, "$2"))
+			stored, err := store.userByName(ctx, "legacy")
+			require.NoError(t, err)
+			assert.Equal(t, user.Password, stored.Password)
+
+			legacy, total, err = store.legacyPasswordUsers(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"other"}, legacy)
+			assert.Equal(t, 3, total)
+
+			_, err = authenticateUser(ctx, "legacy", "secret")
+			assert.NoError(t, err)
+			_, err = authenticateUser(ctx, "legacy", "wrong")
+			assert.Equal(t, errNotFound, err)
+
+			// Хэш со старой сложностью тоже пересчитывается
+			user, err = authenticateUser(ctx, "modern", "modern")
+			require.NoError(t, err)
+			assert.Equal(t, hash, user.Password)
+
+			passwordCost = bcrypt.MinCost
+			defer func() { passwordCost = bcrypt.DefaultCost }()
+			user, err = authenticateUser(ctx, "modern", "modern")
+			require.NoError(t, err)
+			cost, err := bcrypt.Cost([]byte(user.Password))
+			require.NoError(t, err)
+			assert.Equal(t, bcrypt.MinCost, cost)
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("secret")
+	require.NoError(t, err)
+	assert.False(t, isLegacyPasswordHash(hash))
+
+	ok, upgrade := checkPassword(hash, "secret")
+	assert.True(t, ok)
+	assert.False(t, upgrade)
+	ok, _ = checkPassword(hash, "wrong")
+	assert.False(t, ok)
+
+	// Одинаковые пароли дают разные хэши: соль хранится в строке хэша
+	again, err := hashPassword("secret")
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, again)
+
+	_, err = hashPassword(strings.Repeat("a", 73))
+	assert.Equal(t, errPasswordTooLong, err)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type controllerEventType string
+
+const (
+	// DeviceAdded Устройство появилось в списке контроллера
+	DeviceAdded controllerEventType = "device-added"
+	// DeviceRemoved Устройство пропало из списка контроллера
+	DeviceRemoved controllerEventType = "device-removed"
+	// DeviceStateChanged Изменилось состояние устройства
+	DeviceStateChanged controllerEventType = "device-state-changed"
+	// ControllerOffline Контроллер перестал отвечать
+	ControllerOffline controllerEventType = "controller-offline"
+	// ControllerOnline Контроллер снова отвечает
+	ControllerOnline controllerEventType = "controller-online"
+)
+
+type controllerEvent struct {
+	Type         controllerEventType `json:"type"`
+	ControllerID int                 `json:"controller_id"`
+	UserID       int                 `json:"user_id"`
+	Device       *deviceSmartHome    `json:"device,omitempty"`
+	Previous     *deviceSmartHome    `json:"previous,omitempty"`
+	Error        string              `json:"error,omitempty"`
+	Time         time.Time           `json:"time"`
+}
+
+type controllerSnapshot struct {
+	online  bool
+	devices []deviceSmartHome
+}
+
+type poller struct {
+	interval    time.Duration
+	concurrency int
+
+	mutex       sync.Mutex
+	snapshots   map[int]controllerSnapshot
+	subscribers []func(controllerEvent)
+}
+
+func newPoller(interval time.Duration, concurrency int) *poller {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &poller{
+		interval:    interval,
+		concurrency: concurrency,
+		snapshots:   make(map[int]controllerSnapshot),
+	}
+}
+
+// subscribe регистрирует обработчик событий. Обработчики вызываются последовательно из горутины опроса
+// или из обработчика push запроса контроллера
+func (p *poller) subscribe(handler func(controllerEvent)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.subscribers = append(p.subscribers, handler)
+}
+
+func (p *poller) publish(events []controllerEvent) {
+	p.mutex.Lock()
+	subscribers := append([]func(controllerEvent){}, p.subscribers...)
+	p.mutex.Unlock()
+
+	for _, event := range events {
+		for _, handler := range subscribers {
+			handler(event)
+		}
+	}
+}
+
+func (p *poller) run(c context.Context) {
+	ctx := c
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.pollAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *poller) pollAll(c context.Context) {
+	ctx := c
+
+	controllers, err := store.controllers(ctx)
+	if err != nil {
+		msu.Error(ctx, err)
+		return
+	}
+
+	p.forget(controllers)
+
+	semaphore := make(chan struct{}, p.concurrency)
+	wg := sync.WaitGroup{}
+
+	for _, cntl := range controllers {
+		cntl := cntl
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			p.publish(p.poll(ctx, cntl))
+		}()
+	}
+
+	wg.Wait()
+}
+
+// poll опрашивает контроллер. Время запроса ограничивает автомат контроллера
+func (p *poller) poll(c context.Context, cntl controllerRow) []controllerEvent {
+	ctx := c
+
+	driver, err := cntl.driver()
+
+	var devices []deviceSmartHome
+	if err == nil {
+		devices, err = driver.devices(ctx)
+	}
+
+	p.mutex.Lock()
+	previous, known := p.snapshots[cntl.ID]
+	if err != nil {
+		p.snapshots[cntl.ID] = controllerSnapshot{online: false, devices: previous.devices}
+	} else {
+		p.snapshots[cntl.ID] = controllerSnapshot{online: true, devices: devices}
+	}
+	p.mutex.Unlock()
+
+	now := time.Now()
+	events := make([]controllerEvent, 0)
+
+	if err != nil {
+		msu.Warn(ctx, err, zap.Int("controller", cntl.ID), zap.String("uri", cntl.URI))
+		if !known || previous.online {
+			events = append(events, controllerEvent{
+				Type:         ControllerOffline,
+				ControllerID: cntl.ID,
+				UserID:       cntl.UserID,
+				Error:        err.Error(),
+				Time:         now,
+			})
+		}
+		return events
+	}
+
+	if known && !previous.online {
+		events = append(events, controllerEvent{
+			Type:         ControllerOnline,
+			ControllerID: cntl.ID,
+			UserID:       cntl.UserID,
+			Time:         now,
+		})
+	}
+
+	// Первый успешный опрос только запоминает состояние
+	if !known || previous.devices == nil {
+		return events
+	}
+
+	for _, event := range diffDevices(previous.devices, devices) {
+		event.ControllerID = cntl.ID
+		event.UserID = cntl.UserID
+		event.Time = now
+		events = append(events, event)
+	}
+
+	return events
+}
+
+// apply применяет изменения, присланные контроллером, к последнему снимку и возвращает события.
+// Пришедшее изменение означает, что контроллер на связи. Пока снимка нет, изменения пропускаются:
+// в них только часть устройств, и следующий опрос принял бы остальные за новые
+func (p *poller) apply(cntl controllerRow, changed []deviceSmartHome) []controllerEvent {
+	p.mutex.Lock()
+	previous, known := p.snapshots[cntl.ID]
+	var current []deviceSmartHome
+	if previous.devices != nil {
+		current = mergeDevices(previous.devices, changed)
+	}
+	p.snapshots[cntl.ID] = controllerSnapshot{online: true, devices: current}
+	p.mutex.Unlock()
+
+	now := time.Now()
+	events := make([]controllerEvent, 0)
+
+	if known && !previous.online {
+		events = append(events, controllerEvent{
+			Type:         ControllerOnline,
+			ControllerID: cntl.ID,
+			UserID:       cntl.UserID,
+			Time:         now,
+		})
+	}
+
+	if !known || previous.devices == nil {
+		return events
+	}
+
+	for _, event := range diffDevices(previous.devices, current) {
+		event.ControllerID = cntl.ID
+		event.UserID = cntl.UserID
+		event.Time = now
+		events = append(events, event)
+	}
+
+	return events
+}
+
+// mergeDevices заменяет в снимке устройства с теми же id, новые устройства добавляются в конец
+func mergeDevices(devices []deviceSmartHome, changed []deviceSmartHome) []deviceSmartHome {
+	result := append(make([]deviceSmartHome, 0, len(devices)+len(changed)), devices...)
+
+	index := make(map[int]int, len(result))
+	for i, device := range result {
+		index[device.ID] = i
+	}
+
+	for _, device := range changed {
+		if i, ok := index[device.ID]; ok {
+			result[i] = device
+			continue
+		}
+		index[device.ID] = len(result)
+		result = append(result, device)
+	}
+
+	return result
+}
+
+// lastDevices возвращает устройства контроллера из последнего удачного опроса
+func (p *poller) lastDevices(controllerID int) []deviceSmartHome {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return append([]deviceSmartHome{}, p.snapshots[controllerID].devices...)
+}
+
+// forget удаляет снимки контроллеров, которых больше нет в базе
+func (p *poller) forget(controllers []controllerRow) {
+	existing := make(map[int]bool, len(controllers))
+	for _, cntl := range controllers {
+		existing[cntl.ID] = true
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for id := range p.snapshots {
+		if !existing[id] {
+			delete(p.snapshots, id)
+		}
+	}
+}
+
+// diffDevices сравнивает два снимка одного контроллера. Устройства сопоставляются по id контроллера,
+// т.к. guid у штор повторяется на двух линиях
+func diffDevices(previous []deviceSmartHome, current []deviceSmartHome) []controllerEvent {
+	events := make([]controllerEvent, 0)
+
+	before := make(map[int]deviceSmartHome, len(previous))
+	for _, device := range previous {
+		before[device.ID] = device
+	}
+
+	after := make(map[int]bool, len(current))
+	for _, device := range current {
+		device := device
+		after[device.ID] = true
+
+		old, ok := before[device.ID]
+		if !ok {
+			events = append(events, controllerEvent{Type: DeviceAdded, Device: &device})
+			continue
+		}
+
+		if old.TurnOn != device.TurnOn || old.DimmingValue != device.DimmingValue || old.Active != device.Active {
+			events = append(events, controllerEvent{Type: DeviceStateChanged, Device: &device, Previous: &old})
+		}
+	}
+
+	for _, device := range previous {
+		device := device
+		if !after[device.ID] {
+			events = append(events, controllerEvent{Type: DeviceRemoved, Device: &device})
+		}
+	}
+
+	return events
+}
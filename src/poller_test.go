@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffDevices(t *testing.T) {
+	previous := []deviceSmartHome{
+		{ID: 1, Guid: "{A}", TurnOn: 0},
+		{ID: 2, Guid: "{B}", TurnOn: 1, DimmingValue: 50},
+		{ID: 3, Guid: "{C}"},
+	}
+	current := []deviceSmartHome{
+		{ID: 1, Guid: "{A}", TurnOn: 0},
+		{ID: 2, Guid: "{B}", TurnOn: 1, DimmingValue: 80},
+		{ID: 4, Guid: "{D}"},
+	}
+
+	events := diffDevices(previous, current)
+	assert.Equal(t, 3, len(events))
+
+	assert.Equal(t, DeviceStateChanged, events[0].Type)
+	assert.Equal(t, 2, events[0].Device.ID)
+	assert.Equal(t, 50, events[0].Previous.DimmingValue)
+	assert.Equal(t, 80, events[0].Device.DimmingValue)
+
+	assert.Equal(t, DeviceAdded, events[1].Type)
+	assert.Equal(t, 4, events[1].Device.ID)
+
+	assert.Equal(t, DeviceRemoved, events[2].Type)
+	assert.Equal(t, 3, events[2].Device.ID)
+
+	assert.Equal(t, 0, len(diffDevices(current, current)))
+}
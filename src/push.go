@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// pushBodyLimit - максимальный размер зашифрованного тела push запроса контроллера
+const pushBodyLimit = 1 << 20
+
+// pushWindow - насколько время push запроса может отличаться от времени сервера.
+// Одноразовые nonce помнятся столько же, более старый запрос отклоняется по времени
+const pushWindow = 5 * time.Minute
+
+var (
+	errPushCredentials = errors.New("invalid controller credentials")
+	errPushReplay      = errors.New("push request is stale or replayed")
+)
+
+var pushNonces = newNonceCache()
+
+// controllerPush - тело push запроса после расшифровки. Формат устройств как в ответе getalldevices,
+// контроллер присылает только изменившиеся устройства. Nonce и время в секундах Unix защищают
+// от повторной отправки перехваченного тела
+type controllerPush struct {
+	Login     string            `json:"login"`
+	Password  string            `json:"password"`
+	Nonce     string            `json:"nonce"`
+	Timestamp int64             `json:"ts"`
+	Devices   []deviceSmartHome `json:"devices"`
+}
+
+// nonceCache помнит nonce принятых push запросов в пределах pushWindow
+type nonceCache struct {
+	mutex  sync.Mutex
+	nonces map[string]time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{nonces: make(map[string]time.Time)}
+}
+
+// check принимает запрос контроллера controllerID, если его время в пределах окна и nonce еще не встречался
+func (n *nonceCache) check(controllerID int, push controllerPush, now time.Time) error {
+	sent := time.Unix(push.Timestamp, 0)
+	if push.Nonce == "" || sent.Before(now.Add(-pushWindow)) || sent.After(now.Add(pushWindow)) {
+		return errPushReplay
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for key, expires := range n.nonces {
+		if now.After(expires) {
+			delete(n.nonces, key)
+		}
+	}
+
+	key := strconv.Itoa(controllerID) + ":" + push.Nonce
+	if _, ok := n.nonces[key]; ok {
+		return errPushReplay
+	}
+	n.nonces[key] = sent.Add(pushWindow)
+
+	return nil
+}
+
+// pushControllerState принимает от контроллера изменения состояния устройств.
+// Тело зашифровано кодеком контроллера, логин и пароль внутри тела проверяются так же,
+// как контроллер проверяет их в getalldevices. Неизвестный id отклоняется как неверные
+// учетные данные, чтобы по ответам нельзя было перебрать id контроллеров
+func pushControllerState(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+
+	id, err := toInt(vars, "id")
+	if err != nil {
+		msu.Warn(ctx, err, zap.Any("vars", vars))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, pushBodyLimit))
+	if err != nil {
+		msu.Warn(ctx, err, zap.Int("controller", id))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	cntl, err := store.controller(ctx, id)
+	if err != nil && err != errNotFound {
+		msu.Error(ctx, err, zap.Any("uri", r.RequestURI))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var push controllerPush
+	if err == errNotFound {
+		err = errPushCredentials
+	} else if push, err = decodeControllerPush(cntl, strings.TrimSpace(string(body))); err == nil {
+		err = pushNonces.check(id, push, time.Now())
+	}
+	if err != nil {
+		msu.Warn(ctx, err, zap.Int("controller", id), zap.String("remote", r.RemoteAddr))
+		result, _ := json.Marshal(struct {
+			Error string `json:"error"`
+		}{Error: err.Error()})
+		if errors.Is(err, errPushCredentials) || errors.Is(err, errPushReplay) {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		fmt.Fprint(w, string(result))
+		return
+	}
+
+	devices := push.Devices
+	events := make([]controllerEvent, 0)
+	if controllerPoller != nil {
+		events = controllerPoller.apply(cntl, devices)
+		controllerPoller.publish(events)
+	}
+
+	if debug {
+		msu.Info(ctx, zap.String("push", "controller"), zap.Int("controller", id), zap.Any("devices", devices))
+	}
+
+	result, err := json.Marshal(struct {
+		Devices int `json:"devices"`
+		Events  int `json:"events"`
+	}{
+		Devices: len(devices),
+		Events:  len(events),
+	})
+	if err != nil {
+		msu.Error(ctx, err, zap.Any("uri", r.RequestURI))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(result))
+}
+
+// decodeControllerPush расшифровывает тело push запроса и проверяет логин и пароль контроллера.
+// Неверный ключ и неверные логин и пароль не различаются
+func decodeControllerPush(cntl controllerRow, body string) (controllerPush, error) {
+	var push controllerPush
+	if cntl.Driver != "" && cntl.Driver != driverHTTP {
+		return push, fmt.Errorf("controller driver %s does not push state", cntl.Driver)
+	}
+
+	codec, err := controllerCodecFor(cntl.CodecVersion, cntl.CodecKey, cntl.PreviousKey, cntl.RotatedAt)
+	if err != nil {
+		return push, err
+	}
+
+	decoded, err := codec.decode(body)
+	if err != nil {
+		return push, errPushCredentials
+	}
+
+	if err = json.Unmarshal([]byte(decoded), &push); err != nil {
+		return push, errPushCredentials
+	}
+
+	if subtle.ConstantTimeCompare([]byte(push.Login), []byte(cntl.Name)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(push.Password), []byte(cntl.Password)) != 1 {
+		return controllerPush{}, errPushCredentials
+	}
+
+	driver := httpDriver{id: cntl.ID, name: cntl.Name, password: cntl.Password, uri: cntl.URI, codec: codec}
+	for index := range push.Devices {
+		push.Devices[index].host = cntl.URI
+		push.Devices[index].username = cntl.Name
+		push.Devices[index].password = cntl.Password
+		push.Devices[index].codec = codec
+		push.Devices[index].driver = driver
+	}
+
+	return push, nil
+}
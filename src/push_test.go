@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+)
+
+func TestPushControllerState(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	path := t.TempDir() + "/users.db"
+	assert.NoError(t, initializeDB(context.Background(), path))
+
+	var err error
+	db, err = sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	defer db.Close()
+	store = newSQLiteStorage(db, nil, nil)
+
+	_, err = db.Exec(`INSERT INTO controllers (id, user_id, name, password, uri) VALUES (1, 1, '11', '11', 'http://127.0.0.1:1')`)
+	assert.NoError(t, err)
+
+	controllerPoller = newPoller(time.Minute, 1)
+	defer func() { controllerPoller = nil }()
+
+	var events []controllerEvent
+	controllerPoller.subscribe(func(event controllerEvent) { events = append(events, event) })
+
+	router := mux.NewRouter()
+	router.HandleFunc("/controllers/{id}/state", pushControllerState).Methods(http.MethodPost)
+
+	pushAt := func(id string, login string, password string, nonce string, sent time.Time, devices []deviceSmartHome) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(controllerPush{Login: login, Password: password, Nonce: nonce, Timestamp: sent.Unix(), Devices: devices})
+		body, err := legacyCodec{key: encryptKey}.encode(string(payload))
+		assert.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/controllers/"+id+"/state", strings.NewReader(body)))
+		return recorder
+	}
+	push := func(id string, login string, password string, devices []deviceSmartHome) *httptest.ResponseRecorder {
+		return pushAt(id, login, password, generateUUID(), time.Now(), devices)
+	}
+
+	// Без снимка частичное изменение не запоминается
+	assert.Equal(t, http.StatusOK, push("1", "11", "11", []deviceSmartHome{{ID: 1, Guid: "{A}"}}).Code)
+	assert.Empty(t, controllerPoller.lastDevices(1))
+
+	// Снимок из опроса
+	controllerPoller.snapshots[1] = controllerSnapshot{online: true, devices: []deviceSmartHome{{ID: 1, Guid: "{A}"}, {ID: 2, Guid: "{B}", TurnOn: 1}}}
+
+	assert.Equal(t, http.StatusUnauthorized, push("1", "11", "wrong", []deviceSmartHome{{ID: 1, TurnOn: 1}}).Code)
+	assert.Equal(t, http.StatusUnauthorized, push("2", "11", "11", []deviceSmartHome{{ID: 1, TurnOn: 1}}).Code)
+	assert.Equal(t, http.StatusUnauthorized, pushAt("1", "11", "11", generateUUID(), time.Now().Add(-time.Hour), []deviceSmartHome{{ID: 1, TurnOn: 1}}).Code)
+	assert.Equal(t, http.StatusUnauthorized, pushAt("1", "11", "11", "", time.Now(), []deviceSmartHome{{ID: 1, TurnOn: 1}}).Code)
+	assert.Empty(t, events)
+
+	recorder := pushAt("1", "11", "11", "once", time.Now(), []deviceSmartHome{{ID: 1, Guid: "{A}", TurnOn: 1}})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"devices":1,"events":1}`, recorder.Body.String())
+
+	// Повтор того же тела отклоняется
+	assert.Equal(t, http.StatusUnauthorized, pushAt("1", "11", "11", "once", time.Now(), []deviceSmartHome{{ID: 1, Guid: "{A}", TurnOn: 1}}).Code)
+
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, DeviceStateChanged, events[0].Type)
+	assert.Equal(t, 1, events[0].Device.ID)
+	assert.Equal(t, 0, events[0].Previous.TurnOn)
+
+	devices := controllerPoller.lastDevices(1)
+	assert.Equal(t, 2, len(devices))
+	assert.Equal(t, 1, devices[0].TurnOn)
+	assert.Equal(t, 1, devices[1].TurnOn)
+	assert.NotNil(t, devices[0].driver)
+}
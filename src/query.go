@@ -2,11 +2,11 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"errors"
+	"time"
 
-	"github.com/jackc/pgtype"
+	"go.uber.org/zap"
 )
 
 type deviceQueryRequest struct {
@@ -37,36 +37,37 @@ func deviceQuery(c context.Context, requestID string, token string, body []byte)
 	ctx := c
 
 	devices := make([]deviceSmartHome, 0)
-	rows, err := db.QueryContext(ctx, `SELECT name, password, uri FROM controllers WHERE user_id = (SELECT id FROM users WHERE yandex_token = $1)`, token)
+	user, err := store.userByAccessToken(ctx, token, time.Now())
+	if err == errNotFound {
+		return "", errors.New("account_linking_error")
+	}
 	if err != nil {
 		return "", err
 	}
-	defer rows.Close()
-	count := 0
-	for rows.Next() {
-		var name, password, uri pgtype.Varchar
 
-		if err = rows.Scan(&name, &password, &uri); err != nil {
-			return "", err
+	controllers, err := store.userControllers(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+
+	for _, cntl := range controllers {
+		driver, err := cntl.driver()
+		if err != nil {
+			msu.Error(ctx, err, zap.String("controller", cntl.URI))
+			continue
 		}
 
-		temp, err := getUserDevicesFromSmartHome(ctx, name.String, password.String, uri.String)
+		temp, err := driver.devices(ctx)
 		if err != nil {
 			msu.Error(ctx, err)
 			// return "", err
 		}
 
-		devices = append(devices, temp...)
-		count++
-	}
-
-	if count == 0 {
-		var id int
-		if err = db.QueryRowContext(ctx, `SELECT id FROM users WHERE yandex_token = $1`, token).Scan(&id); err != nil {
-			if err == sql.ErrNoRows {
-				return "", errors.New("account_linking_error")
-			}
+		if err = assignDeviceIDs(ctx, cntl.ID, temp); err != nil {
+			return "", err
 		}
+
+		devices = append(devices, temp...)
 	}
 
 	// devices, err := getUserDevicesFromSmartHome(ctx, "", "", "http://185.180.125.234:9010")
@@ -84,7 +85,7 @@ func deviceQuery(c context.Context, requestID string, token string, body []byte)
 
 	for _, requestedDevice := range requestedDevices.Devices {
 		for _, device := range devices {
-			if device.Guid == requestedDevice.ID {
+			if device.externalID == requestedDevice.ID {
 				typeYandexID, err := typeYandex(device.DeviceTypeID)
 				if err != nil {
 					continue
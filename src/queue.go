@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+var (
+	// commandTTL - сколько команда для недоступного контроллера ждет доставки
+	commandTTL = 10 * time.Minute
+	// commandQueueInterval - как часто проверяется очередь
+	commandQueueInterval   = time.Second
+	commandRetryBackoff    = 2 * time.Second
+	commandRetryMaxBackoff = 2 * time.Minute
+)
+
+// commandTimeLayout - время в очереди хранится в UTC с миллисекундами фиксированной длины,
+// чтобы строки сравнивались в SQL как время
+const commandTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+var errCommandQueued = errors.New("command is queued for delivery")
+
+// queuedError - ошибка отправки команды, после которой команда поставлена в очередь.
+// errors.Is находит и errCommandQueued, и исходную ошибку
+type queuedError struct {
+	err error
+}
+
+func (e queuedError) Error() string {
+	return errCommandQueued.Error() + ": " + e.err.Error()
+}
+
+func (e queuedError) Unwrap() error {
+	return e.err
+}
+
+func (e queuedError) Is(target error) bool {
+	return target == errCommandQueued
+}
+
+type queuedCommand struct {
+	ID            int                   `json:"id"`
+	ControllerID  int                   `json:"controller_id"`
+	DeviceID      int                   `json:"device_id"`
+	Command       deviceActionSmartHome `json:"command"`
+	Attempts      int                   `json:"attempts"`
+	LastError     string                `json:"last_error,omitempty"`
+	CreatedAt     string                `json:"created_at"`
+	NextAttemptAt string                `json:"next_attempt_at"`
+	ExpiresAt     string                `json:"expires_at"`
+}
+
+// isTransportError - контроллер не получил команду: нет соединения, цепь разомкнута или
+// контроллер не ответил за время автомата. Отмена и дедлайн вызывающего к ним не относятся:
+// url.Error с context.DeadlineExceeded тоже реализует net.Error
+func isTransportError(err error) bool {
+	if errors.Is(err, errControllerTimeout) || errors.Is(err, errControllerUnreachable) || errors.Is(err, errTunnelOffline) {
+		return true
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var netError net.Error
+	return errors.As(err, &netError)
+}
+
+// enqueueCommands ставит команды в очередь. Более ранняя команда тому же устройству заменяется
+func enqueueCommands(c context.Context, controllerID int, actions []deviceActionSmartHome, reason error) error {
+	ctx := c
+	now := time.Now().UTC()
+
+	for _, act := range actions {
+		act.Login = ""
+		act.Password = ""
+
+		if err := store.enqueueCommand(ctx, queuedCommand{
+			ControllerID:  controllerID,
+			DeviceID:      act.ID,
+			Command:       act,
+			LastError:     reason.Error(),
+			CreatedAt:     now.Format(commandTimeLayout),
+			NextAttemptAt: now.Add(commandRetryBackoff).Format(commandTimeLayout),
+			ExpiresAt:     now.Add(commandTTL).Format(commandTimeLayout),
+		}); err != nil {
+			return err
+		}
+
+		msu.Info(ctx, zap.String("queue", "enqueued"), zap.Int("controller", controllerID), zap.Int("device", act.ID))
+	}
+
+	return nil
+}
+
+// dropQueuedCommands удаляет из очереди команды устройствам, которым только что доставлена новая команда
+func dropQueuedCommands(c context.Context, controllerID int, actions []deviceActionSmartHome) error {
+	ctx := c
+
+	for _, act := range actions {
+		if err := store.dropDeviceCommand(ctx, controllerID, act.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runCommandQueue доставляет команды из очереди, пока не отменен ctx
+func runCommandQueue(c context.Context, interval time.Duration) {
+	ctx := c
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := deliverQueuedCommands(ctx); err != nil {
+			msu.Error(ctx, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type pendingDelivery struct {
+	command queuedCommand
+	uri     string
+	driver  controllerDriver
+}
+
+func deliverQueuedCommands(c context.Context) error {
+	ctx := c
+	now := time.Now()
+
+	count, err := store.expireCommands(ctx, now)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		msu.Warn(ctx, errors.New("queued commands expired"), zap.Int("count", count))
+	}
+
+	commands, err := store.dueCommands(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	for _, command := range commands {
+		cntl, err := store.controller(ctx, command.ControllerID)
+		if err != nil {
+			msu.Error(ctx, err, zap.Int("controller", command.ControllerID))
+			continue
+		}
+
+		driver, err := cntl.driver()
+		if err != nil {
+			msu.Error(ctx, err, zap.Int("controller", command.ControllerID))
+			continue
+		}
+
+		deliverQueuedCommand(ctx, pendingDelivery{command: command, uri: cntl.URI, driver: driver})
+	}
+
+	return nil
+}
+
+// deliverQueuedCommand отправляет одну команду. Условие по created_at не дает удалить
+// или отложить команду, которую за время отправки заменили новой
+// Время отправки ограничивает автомат контроллера
+func deliverQueuedCommand(c context.Context, d pendingDelivery) {
+	ctx := c
+
+	actions := []deviceActionSmartHome{d.command.Command}
+	_, err := requestActionToSmartHome(ctx, actions, d.command.ControllerID, d.uri, d.driver)
+
+	if err != nil && isTransportError(err) {
+		next := time.Now().Add(commandBackoff(d.command.Attempts + 1))
+		if e := store.retryCommand(ctx, d.command, err.Error(), next); e != nil {
+			msu.Error(ctx, e, zap.Int("command", d.command.ID))
+		}
+		return
+	}
+
+	if err != nil {
+		msu.Error(ctx, err, zap.Int("command", d.command.ID), zap.Int("controller", d.command.ControllerID))
+	} else {
+		msu.Info(ctx, zap.String("queue", "delivered"), zap.Int("command", d.command.ID), zap.Int("attempts", d.command.Attempts+1))
+	}
+
+	if e := store.completeCommand(ctx, d.command); e != nil {
+		msu.Error(ctx, e, zap.Int("command", d.command.ID))
+	}
+}
+
+// commandBackoff - пауза перед попыткой attempt: удваивается от commandRetryBackoff до commandRetryMaxBackoff
+func commandBackoff(attempt int) time.Duration {
+	backoff := commandRetryBackoff
+	for i := 1; i < attempt && backoff < commandRetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > commandRetryMaxBackoff {
+		backoff = commandRetryMaxBackoff
+	}
+
+	return backoff
+}
+
+// getCommands возвращает команды пользователя, ожидающие доставки
+func getCommands(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var token string
+	tokenInfo := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(tokenInfo) == 2 {
+		token = tokenInfo[1]
+	} else {
+		msu.Error(ctx,
+			errors.New("invalid AuthHeader len"),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := store.userByAppToken(ctx, token)
+	if err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	commands, err := store.userCommands(ctx, user.ID, time.Now())
+	if err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var result []byte
+
+	if result, err = json.Marshal(commands); err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, string(result))
+}
+
+// cancelCommand удаляет команду из очереди
+func cancelCommand(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var token string
+	tokenInfo := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(tokenInfo) == 2 {
+		token = tokenInfo[1]
+	} else {
+		msu.Error(ctx,
+			errors.New("invalid AuthHeader len"),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := store.userByAppToken(ctx, token)
+	if err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	id, err := toInt(vars, "id")
+	if err != nil {
+		msu.Warn(ctx, err, zap.Any("vars", vars))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = store.cancelUserCommand(ctx, user.ID, id)
+	if err == errNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		msu.Error(ctx,
+			err,
+			zap.Any("uri", r.RequestURI),
+			zap.Any("query", r.URL.Query()),
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
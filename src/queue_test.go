@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+)
+
+func TestCommandQueue(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	path := t.TempDir() + "/users.db"
+	assert.NoError(t, initializeDB(context.Background(), path))
+
+	var err error
+	db, err = sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	defer db.Close()
+	store = newSQLiteStorage(db, nil, nil)
+
+	fake, err := loadFakeController("testdata/fakecontroller.json", "11", "11")
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	_, err = db.Exec(`INSERT INTO controllers (id, user_id, name, password, uri) VALUES (1, 1, '11', '11', $1)`, server.URL)
+	assert.NoError(t, err)
+
+	codec := legacyCodec{key: encryptKey}
+	devices, err := getUserDevicesFromSmartHome(context.Background(), 1, "11", "11", server.URL, codec)
+	assert.NoError(t, err)
+	devices[0].controllerID = 1
+
+	var action deviceActionRequestYandex
+	action.ID = devices[0].Guid
+	action.Capabilities = append(action.Capabilities, struct {
+		Type  string `json:"type"`
+		State struct {
+			Instance string      `json:"instance"`
+			Value    interface{} `json:"value"`
+			Relative bool        `json:"relative,omitempty"`
+		} `json:"state"`
+	}{Type: "devices.capabilities.on_off"})
+	action.Capabilities[0].State.Instance = "on"
+
+	// Обе команды не доходят до контроллера, в очереди остается последняя
+	fake.FailNext(10, 0)
+	action.Capabilities[0].State.Value = false
+	err = actionToSmartHome(context.Background(), devices[:1], action)
+	assert.ErrorIs(t, err, errCommandQueued)
+
+	action.Capabilities[0].State.Value = true
+	err = actionToSmartHome(context.Background(), devices[:1], action)
+	assert.ErrorIs(t, err, errCommandQueued)
+
+	count := 0
+	assert.NoError(t, db.QueryRow(`SELECT count(id) FROM commands`).Scan(&count))
+	assert.Equal(t, 1, count)
+
+	fake.FailNext(0, 0)
+	_, err = db.Exec(`UPDATE commands SET next_attempt_at = $1`, time.Now().UTC().Format(commandTimeLayout))
+	assert.NoError(t, err)
+	assert.NoError(t, deliverQueuedCommands(context.Background()))
+
+	assert.NoError(t, db.QueryRow(`SELECT count(id) FROM commands`).Scan(&count))
+	assert.Equal(t, 0, count)
+	assert.Equal(t, 1, fake.State()[0].TurnOn)
+	assert.Equal(t, 1, len(fake.Received()))
+
+	// Просроченная команда удаляется без отправки
+	commandTTL = -time.Second
+	defer func() { commandTTL = 10 * time.Minute }()
+	assert.NoError(t, enqueueCommands(context.Background(), 1, []deviceActionSmartHome{{ID: devices[0].ID}}, errTunnelOffline))
+	assert.NoError(t, deliverQueuedCommands(context.Background()))
+	assert.NoError(t, db.QueryRow(`SELECT count(id) FROM commands`).Scan(&count))
+	assert.Equal(t, 0, count)
+	assert.Equal(t, 1, len(fake.Received()))
+
+	assert.Equal(t, 2*time.Second, commandBackoff(1))
+	assert.Equal(t, 8*time.Second, commandBackoff(3))
+	assert.Equal(t, commandRetryMaxBackoff, commandBackoff(20))
+}
+
+// partialDriver доставляет команды всем устройствам, кроме fail
+type partialDriver struct {
+	fail int
+}
+
+func (d partialDriver) devices(ctx context.Context) ([]deviceSmartHome, error) { return nil, nil }
+
+func (d partialDriver) state(ctx context.Context, ids []int) ([]deviceSmartHome, error) {
+	return nil, nil
+}
+
+func (d partialDriver) execute(ctx context.Context, act deviceActionSmartHome) error {
+	if act.ID == d.fail {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	return nil
+}
+
+func TestPartialActionQueue(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	path := t.TempDir() + "/users.db"
+	assert.NoError(t, initializeDB(context.Background(), path))
+
+	var err error
+	db, err = sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	defer db.Close()
+	store = newSQLiteStorage(db, nil, nil)
+
+	// Штора - пара команд двум линиям, до контроллера дошла только первая
+	driver := partialDriver{fail: 2}
+	devices := []deviceSmartHome{
+		{ID: 1, host: "partial", driver: driver, controllerID: 3},
+		{ID: 2, host: "partial", driver: driver, controllerID: 3},
+	}
+
+	var action deviceActionRequestYandex
+	action.Capabilities = append(action.Capabilities, struct {
+		Type  string `json:"type"`
+		State struct {
+			Instance string      `json:"instance"`
+			Value    interface{} `json:"value"`
+			Relative bool        `json:"relative,omitempty"`
+		} `json:"state"`
+	}{Type: "devices.capabilities.on_off"})
+	action.Capabilities[0].State.Instance = "on"
+	action.Capabilities[0].State.Value = true
+
+	err = actionToSmartHome(context.Background(), devices, action)
+	assert.ErrorIs(t, err, errCommandQueued)
+
+	var ids []int
+	rows, err := db.Query(`SELECT device_id FROM commands WHERE controller_id = 3`)
+	assert.NoError(t, err)
+	for rows.Next() {
+		var id int
+		assert.NoError(t, rows.Scan(&id))
+		ids = append(ids, id)
+	}
+	rows.Close()
+	assert.Equal(t, []int{2}, ids)
+}
+
+func TestIsTransportError(t *testing.T) {
+	assert.True(t, isTransportError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.True(t, isTransportError(fmt.Errorf("%w: %v", errControllerTimeout, context.DeadlineExceeded)))
+	assert.True(t, isTransportError(errTunnelOffline))
+
+	// Дедлайн и отмена вызывающего не говорят о том, что контроллер недоступен
+	assert.False(t, isTransportError(&url.Error{Op: "Get", URL: "http://controller", Err: context.DeadlineExceeded}))
+	assert.False(t, isTransportError(&url.Error{Op: "Get", URL: "http://controller", Err: context.Canceled}))
+	assert.False(t, isTransportError(errControllerResponse))
+}
+
+func TestCommandStorage(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	for name, newStore := range testStorages() {
+		t.Run(name, func(t *testing.T) {
+			store = newStore(t)
+			ctx := context.Background()
+			now := time.Now()
+
+			userID, err := store.createUser(ctx, "user", "secret")
+			assert.NoError(t, err)
+			id, err := store.createController(ctx, controllerRow{UserID: userID, Name: "11", Password: "11", URI: "http://127.0.0.1:1"})
+			assert.NoError(t, err)
+
+			// Вторая команда тому же устройству заменяет первую
+			assert.NoError(t, enqueueCommands(ctx, id, []deviceActionSmartHome{{ID: 1, TurnOn: 0}, {ID: 2}}, errTunnelOffline))
+			assert.NoError(t, enqueueCommands(ctx, id, []deviceActionSmartHome{{ID: 1, TurnOn: 1, Password: "11"}}, errTunnelOffline))
+
+			commands, err := store.userCommands(ctx, userID, now)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, len(commands))
+			assert.Equal(t, 1, commands[0].Command.TurnOn)
+			assert.Empty(t, commands[0].Command.Password)
+
+			due, err := store.dueCommands(ctx, now.Add(commandRetryBackoff+time.Second))
+			assert.NoError(t, err)
+			assert.Equal(t, 2, len(due))
+
+			// Замененная команда не откладывается и не удаляется по устаревшей копии
+			stale := due[0]
+			stale.CreatedAt = "2000-01-01T00:00:00.000Z"
+			assert.NoError(t, store.retryCommand(ctx, stale, "timeout", now.Add(time.Hour)))
+			assert.NoError(t, store.completeCommand(ctx, stale))
+			assert.NoError(t, store.retryCommand(ctx, due[1], "timeout", now.Add(time.Hour)))
+
+			due, err = store.dueCommands(ctx, now.Add(commandRetryBackoff+time.Second))
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(due))
+			assert.Equal(t, 1, due[0].DeviceID)
+
+			assert.NoError(t, store.completeCommand(ctx, due[0]))
+			assert.Equal(t, errNotFound, store.cancelUserCommand(ctx, userID+1, commands[1].ID))
+			assert.NoError(t, store.cancelUserCommand(ctx, userID, commands[1].ID))
+			assert.Equal(t, errNotFound, store.cancelUserCommand(ctx, userID, commands[1].ID))
+
+			assert.NoError(t, enqueueCommands(ctx, id, []deviceActionSmartHome{{ID: 3}}, errTunnelOffline))
+			count, err := store.expireCommands(ctx, now.Add(commandTTL+time.Minute))
+			assert.NoError(t, err)
+			assert.Equal(t, 1, count)
+
+			// Нечитаемая команда удаляется при первом чтении, а не остается в очереди навсегда
+			if name == "sqlite" {
+				at := now.UTC().Format(commandTimeLayout)
+				_, err = db.Exec(`INSERT INTO commands (controller_id, device_id, payload, created_at, next_attempt_at, expires_at)
+					VALUES ($1, 4, 'not json', $2, $2, $3)`, id, at, now.Add(time.Hour).UTC().Format(commandTimeLayout))
+				assert.NoError(t, err)
+				due, err = store.dueCommands(ctx, now.Add(time.Second))
+				assert.NoError(t, err)
+				assert.Empty(t, due)
+				left := 0
+				assert.NoError(t, db.QueryRow(`SELECT count(*) FROM commands`).Scan(&left))
+				assert.Equal(t, 0, left)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// secretPrefix - префикс зашифрованного значения в базе:
+// enc:v1:<id мастер-ключа>:<ключ данных, зашифрованный мастер-ключом>:<значение, зашифрованное ключом данных>
+const secretPrefix = "enc:v1:"
+
+var errSecretKey = errors.New("controller secret is encrypted with an unknown master key")
+
+// secretKeys - мастер-ключи секретов контроллеров из настроек controllers.secrets_key и secrets_previous_keys
+var secretKeys *secretKeyring
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// secretKeyring шифрует секреты текущим мастер-ключом, а расшифровывает текущим или одним из предыдущих.
+// Без ключей (nil) значения хранятся открытым текстом
+type secretKeyring struct {
+	current  masterKey
+	previous map[string]masterKey
+}
+
+// newMasterKey разбирает мастер-ключ: 32 байта в hex, как ключи AES-GCM контроллеров
+func newMasterKey(key string) (masterKey, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(raw) != 32 {
+		return masterKey{}, errors.New("master key must be 32 bytes in hex")
+	}
+
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return masterKey{}, err
+	}
+
+	sum := sha256.Sum256(raw)
+	return masterKey{id: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+func newSecretKeyring(current string, previous []string) (*secretKeyring, error) {
+	key, err := newMasterKey(current)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &secretKeyring{current: key, previous: make(map[string]masterKey)}
+	for _, value := range previous {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		old, err := newMasterKey(value)
+		if err != nil {
+			return nil, err
+		}
+		keys.previous[old.id] = old
+	}
+
+	return keys, nil
+}
+
+// loadSecretKeyring возвращает мастер-ключи из настроек, без текущего ключа возвращает nil
+func loadSecretKeyring() (*secretKeyring, error) {
+	if secretsKey == "" {
+		return nil, nil
+	}
+
+	return newSecretKeyring(secretsKey, secretsPreviousKeys)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func sealWith(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openWith(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+// seal шифрует значение новым ключом данных, который шифруется текущим мастер-ключом.
+// Пустое значение не шифруется
+func (k *secretKeyring) seal(value string) (string, error) {
+	if k == nil || value == "" {
+		return value, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := sealWith(aead, []byte(value))
+	if err != nil {
+		return "", err
+	}
+
+	return k.wrap(dataKey, sealed)
+}
+
+func (k *secretKeyring) wrap(dataKey []byte, sealed []byte) (string, error) {
+	wrapped, err := sealWith(k.current.aead, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return secretPrefix + k.current.id + ":" +
+		base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// unwrap разбирает зашифрованное значение и расшифровывает ключ данных
+func (k *secretKeyring) unwrap(value string) (keyID string, dataKey []byte, sealed []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(value, secretPrefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, errors.New("invalid encrypted controller secret")
+	}
+	if k == nil {
+		return "", nil, nil, errSecretKey
+	}
+
+	key := k.current
+	if parts[0] != key.id {
+		var ok bool
+		if key, ok = k.previous[parts[0]]; !ok {
+			return "", nil, nil, errSecretKey
+		}
+	}
+
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if sealed, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return "", nil, nil, err
+	}
+	if dataKey, err = openWith(key.aead, wrapped); err != nil {
+		return "", nil, nil, err
+	}
+
+	return parts[0], dataKey, sealed, nil
+}
+
+// open расшифровывает значение из базы. Значения без префикса, записанные до включения
+// шифрования, возвращаются как есть
+func (k *secretKeyring) open(value string) (string, error) {
+	if !strings.HasPrefix(value, secretPrefix) {
+		return value, nil
+	}
+
+	_, dataKey, sealed, err := k.unwrap(value)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := openWith(aead, sealed)
+	return string(plaintext), err
+}
+
+// rewrap перешифровывает ключ данных текущим мастер-ключом, само значение не меняется.
+// Открытый текст шифруется. changed = false, если значение уже под текущим ключом
+func (k *secretKeyring) rewrap(value string) (result string, changed bool, err error) {
+	if value == "" {
+		return value, false, nil
+	}
+	if !strings.HasPrefix(value, secretPrefix) {
+		result, err = k.seal(value)
+		return result, err == nil, err
+	}
+
+	keyID, dataKey, sealed, err := k.unwrap(value)
+	if err != nil || keyID == k.current.id {
+		return value, false, err
+	}
+
+	result, err = k.wrap(dataKey, sealed)
+	return result, err == nil, err
+}
+
+// rewrapControllerSecrets шифрует текущим мастер-ключом пароли и ключи всех контроллеров:
+// открытый текст и значения под предыдущими ключами. Возвращает число измененных контроллеров
+func rewrapControllerSecrets(c context.Context, database *sql.DB, keys *secretKeyring) (int, error) {
+	ctx := c
+
+	if keys == nil {
+		return 0, errors.New("CONTROLLER_SECRETS_KEY is not set")
+	}
+
+	tx, err := database.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, password, codec_key, codec_previous_key, codec_pending_key FROM controllers`)
+	if err != nil {
+		return 0, err
+	}
+
+	type secrets struct {
+		id     int
+		values [4]sql.NullString
+	}
+	updates := make([]secrets, 0)
+	for rows.Next() {
+		var row secrets
+		if err = rows.Scan(&row.id, &row.values[0], &row.values[1], &row.values[2], &row.values[3]); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		changed := false
+		for index, value := range row.values {
+			rewrapped, ok, err := keys.rewrap(value.String)
+			if err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("controller %d: %w", row.id, err)
+			}
+			if ok {
+				row.values[index] = sql.NullString{String: rewrapped, Valid: true}
+				changed = true
+			}
+		}
+		if changed {
+			updates = append(updates, row)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, row := range updates {
+		if _, err = tx.ExecContext(ctx,
+			`UPDATE controllers SET password = $1, codec_key = $2, codec_previous_key = $3, codec_pending_key = $4 WHERE id = $5`,
+			row.values[0], row.values[1], row.values[2], row.values[3], row.id); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(updates), tx.Commit()
+}
+
+// sealedControllers возвращает число контроллеров с секретами, зашифрованными мастер-ключом.
+// Без ключа такие контроллеры не работают, поэтому сервер с ними без ключа не запускается
+func sealedControllers(c context.Context, database *sql.DB) (int, error) {
+	ctx := c
+
+	cnt := 0
+	err := database.QueryRowContext(ctx, `SELECT count(id) FROM controllers WHERE password LIKE $1 OR codec_key LIKE $1
+		OR codec_previous_key LIKE $1 OR codec_pending_key LIKE $1`, secretPrefix+"%").Scan(&cnt)
+	return cnt, err
+}
+
+// runSecrets - команда secrets rotate: перешифровывает секреты контроллеров новым мастер-ключом.
+// Новый ключ задается в CONTROLLER_SECRETS_KEY, старые - в CONTROLLER_SECRETS_PREVIOUS_KEYS через запятую
+func runSecrets(args []string) error {
+	ctx := context.Background()
+
+	flags := flag.NewFlagSet("secrets", flag.ContinueOnError)
+	dbPath := flags.String("db", databaseDirectory+"/users.db", "database file")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || flags.Arg(0) != "rotate" {
+		return errors.New("usage: secrets [-db path] rotate")
+	}
+
+	keys, err := loadSecretKeyring()
+	if err != nil {
+		return err
+	}
+
+	database, err := sql.Open("sqlite3", *dbPath)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	count, err := rewrapControllerSecrets(ctx, database, keys)
+	if err != nil {
+		return err
+	}
+
+	msu.Info(ctx, zap.String("secrets", "rotate"), zap.String("key", keys.current.id), zap.Int("controllers", count))
+	return nil
+}
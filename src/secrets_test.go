@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+)
+
+const (
+	testMasterKey    = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testNewMasterKey = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func TestSecretKeyring(t *testing.T) {
+	keys, err := newSecretKeyring(testMasterKey, nil)
+	require.NoError(t, err)
+
+	sealed, err := keys.seal("secret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sealed, secretPrefix))
+	assert.NotContains(t, sealed, "secret")
+
+	other, err := keys.seal("secret")
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed, other)
+
+	opened, err := keys.open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", opened)
+
+	// Значения, записанные до включения шифрования
+	opened, err = keys.open("plain")
+	require.NoError(t, err)
+	assert.Equal(t, "plain", opened)
+
+	empty, err := keys.seal("")
+	require.NoError(t, err)
+	assert.Equal(t, "", empty)
+
+	// Смена мастер-ключа: старый ключ нужен только до перешифровки
+	rotated, err := newSecretKeyring(testNewMasterKey, []string{testMasterKey})
+	require.NoError(t, err)
+	opened, err = rotated.open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", opened)
+
+	rewrapped, changed, err := rotated.rewrap(sealed)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	_, changed, err = rotated.rewrap(rewrapped)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	onlyNew, err := newSecretKeyring(testNewMasterKey, nil)
+	require.NoError(t, err)
+	_, err = onlyNew.open(sealed)
+	assert.Equal(t, errSecretKey, err)
+	opened, err = onlyNew.open(rewrapped)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", opened)
+
+	var none *secretKeyring
+	_, err = none.open(sealed)
+	assert.Equal(t, errSecretKey, err)
+
+	_, err = newSecretKeyring("short", nil)
+	assert.Error(t, err)
+}
+
+func TestSQLiteStorageSecrets(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	path := t.TempDir() + "/users.db"
+	require.NoError(t, initializeDB(context.Background(), path))
+
+	var err error
+	db, err = sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec(`INSERT INTO controllers (id, user_id, name, password, uri, codec_key) VALUES (1, 1, '11', 'legacy', 'http://127.0.0.1:1', 'legacykey')`)
+	require.NoError(t, err)
+
+	keys, err := newSecretKeyring(testMasterKey, nil)
+	require.NoError(t, err)
+	storage := newSQLiteStorage(db, keys, nil)
+
+	id, err := storage.createController(context.Background(), controllerRow{UserID: 1, Name: "22", Password: "secret", URI: "http://127.0.0.1:2", CodecVersion: codecAESGCM, CodecKey: "key"})
+	require.NoError(t, err)
+
+	var password, codecKey string
+	require.NoError(t, db.QueryRow(`SELECT password, codec_key FROM controllers WHERE id = $1`, id).Scan(&password, &codecKey))
+	assert.True(t, strings.HasPrefix(password, secretPrefix))
+	assert.True(t, strings.HasPrefix(codecKey, secretPrefix))
+
+	cntl, err := storage.controller(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", cntl.Password)
+	assert.Equal(t, "key", cntl.CodecKey)
+
+	// Открытый текст шифруется при перешифровке, повторный запуск ничего не меняет
+	count, err := rewrapControllerSecrets(context.Background(), db, keys)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	require.NoError(t, db.QueryRow(`SELECT password FROM controllers WHERE id = 1`).Scan(&password))
+	assert.True(t, strings.HasPrefix(password, secretPrefix))
+
+	count, err = rewrapControllerSecrets(context.Background(), db, keys)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	rotated, err := newSecretKeyring(testNewMasterKey, []string{testMasterKey})
+	require.NoError(t, err)
+	count, err = rewrapControllerSecrets(context.Background(), db, rotated)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	onlyNew, err := newSecretKeyring(testNewMasterKey, nil)
+	require.NoError(t, err)
+	controllers, err := newSQLiteStorage(db, onlyNew, nil).controllers(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(controllers))
+	assert.Equal(t, "legacy", controllers[0].Password)
+	assert.Equal(t, "legacykey", controllers[0].CodecKey)
+	assert.Equal(t, "secret", controllers[1].Password)
+
+	_, err = newSQLiteStorage(db, keys, nil).controllers(context.Background())
+	assert.Error(t, err)
+
+	// Без ключа сервер не запускается, пока в базе есть зашифрованные секреты
+	sealed, err := sealedControllers(context.Background(), db)
+	require.NoError(t, err)
+	assert.Equal(t, 2, sealed)
+}
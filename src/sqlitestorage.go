@@ -0,0 +1,786 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sqliteStorage хранит пароли и ключи контроллеров зашифрованными ключами keys,
+// а токены - только хэшами с ключом tokenKey
+type sqliteStorage struct {
+	db       *sql.DB
+	keys     *secretKeyring
+	tokenKey []byte
+}
+
+func newSQLiteStorage(db *sql.DB, keys *secretKeyring, tokenKey []byte) *sqliteStorage {
+	return &sqliteStorage{db: db, keys: keys, tokenKey: tokenKey}
+}
+
+func (s *sqliteStorage) hashToken(token string) string {
+	return hashToken(s.tokenKey, token)
+}
+
+// affected возвращает errNotFound, если запрос не изменил ни одной строки
+func affected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if i, err := result.RowsAffected(); err != nil {
+		return err
+	} else if i == 0 {
+		return errNotFound
+	}
+
+	return nil
+}
+
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+
+	return err
+}
+
+func (s *sqliteStorage) createUser(c context.Context, name string, password string) (int, error) {
+	ctx := c
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	count := 0
+	if err = tx.QueryRowContext(ctx, `SELECT count(*) FROM users WHERE name = $1`, name).Scan(&count); err != nil {
+		return 0, err
+	}
+	if count != 0 {
+		return 0, errUserExists
+	}
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO users (name, password) VALUES ($1, $2)`, name, password)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), tx.Commit()
+}
+
+func (s *sqliteStorage) user(c context.Context, where string, value string) (userRow, error) {
+	ctx := c
+
+	var user userRow
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT id, name, password FROM users WHERE `+where+` = $1`, value).
+		Scan(&user.ID, &user.Name, &user.Password); err != nil {
+		return user, notFound(err)
+	}
+
+	return user, nil
+}
+
+func (s *sqliteStorage) userByName(ctx context.Context, name string) (userRow, error) {
+	return s.user(ctx, "name", name)
+}
+
+func (s *sqliteStorage) userByAppToken(ctx context.Context, token string) (userRow, error) {
+	return s.user(ctx, "app_token", s.hashToken(token))
+}
+
+func (s *sqliteStorage) userByAccessToken(c context.Context, token string, now time.Time) (userRow, error) {
+	ctx := c
+
+	var user userRow
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT users.id, users.name, users.password FROM oauth_tokens JOIN users ON users.id = oauth_tokens.user_id
+		WHERE access_token = $1 AND rotated_at IS NULL AND revoked_at IS NULL AND julianday(access_expires_at) > julianday($2)`,
+		s.hashToken(token), now.UTC().Format(time.RFC3339Nano)).
+		Scan(&user.ID, &user.Name, &user.Password); err != nil {
+		return user, notFound(err)
+	}
+
+	return user, nil
+}
+
+func (s *sqliteStorage) setAppToken(ctx context.Context, userID int, token string) error {
+	return affected(s.db.ExecContext(ctx, `UPDATE users SET app_token = $1 WHERE id = $2`, s.hashToken(token), userID))
+}
+
+func (s *sqliteStorage) setPassword(ctx context.Context, userID int, password string) error {
+	return affected(s.db.ExecContext(ctx, `UPDATE users SET password = $1 WHERE id = $2`, password, userID))
+}
+
+func (s *sqliteStorage) legacyPasswordUsers(c context.Context) ([]string, int, error) {
+	ctx := c
+
+	rows, err := s.db.QueryContext(ctx, `SELECT name, password FROM users ORDER BY name`)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	names := make([]string, 0)
+	total := 0
+	for rows.Next() {
+		var name, password string
+		if err = rows.Scan(&name, &password); err != nil {
+			return nil, 0, err
+		}
+		if isLegacyPasswordHash(password) {
+			names = append(names, name)
+		}
+		total++
+	}
+
+	return names, total, rows.Err()
+}
+
+// execer - *sql.DB или *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertTokens сохраняет пару, токены записываются хэшами
+func (s *sqliteStorage) insertTokens(ctx context.Context, db execer, tokens tokenRow) error {
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO oauth_tokens (family, user_id, client_id, access_token, refresh_token, scope, access_expires_at, refresh_expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		tokens.Family, tokens.UserID, tokens.ClientID, s.hashToken(tokens.AccessToken), s.hashToken(tokens.RefreshToken), tokens.Scope,
+		tokens.AccessExpiresAt.UTC().Format(time.RFC3339Nano), tokens.RefreshExpiresAt.UTC().Format(time.RFC3339Nano),
+		tokens.CreatedAt.UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+func (s *sqliteStorage) createTokens(ctx context.Context, tokens tokenRow) error {
+	return s.insertTokens(ctx, s.db, tokens)
+}
+
+func (s *sqliteStorage) rotateRefreshToken(c context.Context, refreshToken string, clientID string, next tokenRow, now time.Time) (tokenRow, error) {
+	ctx := c
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return tokenRow{}, err
+	}
+	defer tx.Rollback()
+
+	var previous tokenRow
+	var expires string
+	var rotated, revoked sql.NullString
+	if err = tx.QueryRowContext(ctx,
+		`SELECT family, user_id, client_id, scope, refresh_expires_at, rotated_at, revoked_at FROM oauth_tokens WHERE refresh_token = $1`, s.hashToken(refreshToken)).
+		Scan(&previous.Family, &previous.UserID, &previous.ClientID, &previous.Scope, &expires, &rotated, &revoked); err != nil {
+		return tokenRow{}, notFound(err)
+	}
+	if revoked.Valid || previous.ClientID != clientID {
+		return tokenRow{}, errNotFound
+	}
+
+	// Обмененный токен мог быть украден: отзываются и вор, и владелец, платформа связывает аккаунт заново
+	reused := func() (tokenRow, error) {
+		if _, err := tx.ExecContext(ctx, `UPDATE oauth_tokens SET revoked_at = $1 WHERE family = $2 AND revoked_at IS NULL`,
+			now.UTC().Format(time.RFC3339Nano), previous.Family); err != nil {
+			return tokenRow{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return tokenRow{}, err
+		}
+		return tokenRow{}, errTokenReused
+	}
+	if rotated.Valid {
+		return reused()
+	}
+
+	if expiresAt, err := time.Parse(time.RFC3339Nano, expires); err != nil || !expiresAt.After(now) {
+		return tokenRow{}, errNotFound
+	}
+
+	// Параллельный обмен того же токена успел первым: это тоже повторное предъявление
+	rotatedRows, err := count(tx.ExecContext(ctx, `UPDATE oauth_tokens SET rotated_at = $1 WHERE refresh_token = $2 AND rotated_at IS NULL`,
+		now.UTC().Format(time.RFC3339Nano), s.hashToken(refreshToken)))
+	if err != nil {
+		return tokenRow{}, err
+	}
+	if rotatedRows != 1 {
+		return reused()
+	}
+
+	next.Family = previous.Family
+	next.UserID = previous.UserID
+	next.ClientID = clientID
+	next.Scope = previous.Scope
+	if err = s.insertTokens(ctx, tx, next); err != nil {
+		return tokenRow{}, err
+	}
+
+	return next, tx.Commit()
+}
+
+// revokeTokenFamily не отличает чужой токен от неизвестного: в обоих случаях errNotFound
+func (s *sqliteStorage) revokeTokenFamily(ctx context.Context, token string, clientID string, now time.Time) error {
+	return affected(s.db.ExecContext(ctx,
+		`UPDATE oauth_tokens SET revoked_at = $1 WHERE revoked_at IS NULL AND family IN (
+			SELECT family FROM oauth_tokens WHERE (access_token = $2 OR refresh_token = $2) AND ($3 = '' OR client_id = $3))`,
+		now.UTC().Format(time.RFC3339Nano), s.hashToken(token), clientID))
+}
+
+func (s *sqliteStorage) revokeClientTokens(ctx context.Context, clientID string, now time.Time) (int, error) {
+	return count(s.db.ExecContext(ctx, `UPDATE oauth_tokens SET revoked_at = $1 WHERE client_id = $2 AND revoked_at IS NULL`,
+		now.UTC().Format(time.RFC3339Nano), clientID))
+}
+
+func (s *sqliteStorage) expireTokens(ctx context.Context, before time.Time) (int, error) {
+	return count(s.db.ExecContext(ctx,
+		`DELETE FROM oauth_tokens WHERE julianday(refresh_expires_at) IS NULL OR julianday(refresh_expires_at) < julianday($1)`,
+		before.UTC().Format(time.RFC3339Nano)))
+}
+
+func (s *sqliteStorage) createAuthRequest(ctx context.Context, id string, query string, created time.Time) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO auth_requests (id, request, dt) VALUES ($1, $2, $3)`, id, query, created.UTC().Format(time.RFC3339))
+	return err
+}
+
+func (s *sqliteStorage) authRequest(ctx context.Context, id string) (string, time.Time, error) {
+	var query string
+	var dt sql.NullString
+	if err := s.db.QueryRowContext(ctx, `SELECT request, dt FROM auth_requests WHERE id = $1`, id).Scan(&query, &dt); err != nil {
+		return "", time.Time{}, notFound(err)
+	}
+
+	// Запрос с нечитаемым временем считается просроченным
+	created, err := time.Parse(time.RFC3339, dt.String)
+	if err != nil {
+		return query, time.Time{}, nil
+	}
+
+	return query, created, nil
+}
+
+func (s *sqliteStorage) completeAuthRequest(c context.Context, id string, code authCode) error {
+	ctx := c
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx,
+		`INSERT INTO oauth_codes (code, user_id, client_id, redirect_uri, scope, code_challenge, code_challenge_method, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		s.hashToken(code.Code), code.UserID, code.ClientID, code.RedirectURI, code.Scope, code.Challenge, code.ChallengeMethod,
+		code.IssuedAt.UTC().Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	if err = affected(tx.ExecContext(ctx, `DELETE FROM auth_requests WHERE id = $1`, id)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStorage) consumeAuthCode(c context.Context, code string) (authCode, error) {
+	ctx := c
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return authCode{}, err
+	}
+	defer tx.Rollback()
+
+	row := authCode{Code: code}
+	issued := ""
+	if err = tx.QueryRowContext(ctx,
+		`SELECT user_id, client_id, redirect_uri, scope, code_challenge, code_challenge_method, created_at FROM oauth_codes WHERE code = $1`, s.hashToken(code)).
+		Scan(&row.UserID, &row.ClientID, &row.RedirectURI, &row.Scope, &row.Challenge, &row.ChallengeMethod, &issued); err != nil {
+		return authCode{}, notFound(err)
+	}
+	// Код с нечитаемым временем считается просроченным
+	row.IssuedAt, _ = time.Parse(time.RFC3339Nano, issued)
+
+	if err = affected(tx.ExecContext(ctx, `DELETE FROM oauth_codes WHERE code = $1`, s.hashToken(code))); err != nil {
+		return authCode{}, err
+	}
+
+	return row, tx.Commit()
+}
+
+// count возвращает число измененных строк
+func count(result sql.Result, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+
+	i, err := result.RowsAffected()
+	return int(i), err
+}
+
+// expireAuthRequests сравнивает время через julianday: старые строки записаны в локальной зоне,
+// строки без читаемого времени тоже удаляются
+func (s *sqliteStorage) expireAuthRequests(ctx context.Context, before time.Time) (int, error) {
+	return count(s.db.ExecContext(ctx,
+		`DELETE FROM auth_requests WHERE julianday(dt) IS NULL OR julianday(dt) < julianday($1)`,
+		before.UTC().Format(time.RFC3339Nano)))
+}
+
+func (s *sqliteStorage) expireAuthCodes(ctx context.Context, before time.Time) (int, error) {
+	return count(s.db.ExecContext(ctx,
+		`DELETE FROM oauth_codes WHERE julianday(created_at) IS NULL OR julianday(created_at) < julianday($1)`,
+		before.UTC().Format(time.RFC3339Nano)))
+}
+
+func (s *sqliteStorage) createOAuthClient(c context.Context, client oauthClient) error {
+	ctx := c
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	exists := 0
+	if err = tx.QueryRowContext(ctx, `SELECT count(*) FROM oauth_clients WHERE id = $1`, client.ID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists != 0 {
+		return errClientExists
+	}
+
+	if _, err = tx.ExecContext(ctx, `INSERT INTO oauth_clients (id, name, secret, redirect_uris, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		client.ID, client.Name, client.SecretHash, strings.Join(client.RedirectURIs, "\n"), client.CreatedAt.UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStorage) updateOAuthClient(ctx context.Context, client oauthClient) error {
+	return affected(s.db.ExecContext(ctx, `UPDATE oauth_clients SET name = $1, secret = $2, redirect_uris = $3 WHERE id = $4`,
+		client.Name, client.SecretHash, strings.Join(client.RedirectURIs, "\n"), client.ID))
+}
+
+func (s *sqliteStorage) queryOAuthClients(c context.Context, where string, args ...interface{}) ([]oauthClient, error) {
+	ctx := c
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, name, secret, redirect_uris, created_at FROM oauth_clients`+where+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := make([]oauthClient, 0)
+	for rows.Next() {
+		var client oauthClient
+		var redirectURIs, created string
+		if err = rows.Scan(&client.ID, &client.Name, &client.SecretHash, &redirectURIs, &created); err != nil {
+			return nil, err
+		}
+		client.RedirectURIs = strings.Split(redirectURIs, "\n")
+		client.CreatedAt, _ = time.Parse(time.RFC3339, created)
+		clients = append(clients, client)
+	}
+
+	return clients, rows.Err()
+}
+
+func (s *sqliteStorage) oauthClient(ctx context.Context, id string) (oauthClient, error) {
+	clients, err := s.queryOAuthClients(ctx, ` WHERE id = $1`, id)
+	if err != nil {
+		return oauthClient{}, err
+	}
+	if len(clients) == 0 {
+		return oauthClient{}, errNotFound
+	}
+
+	return clients[0], nil
+}
+
+func (s *sqliteStorage) oauthClients(ctx context.Context) ([]oauthClient, error) {
+	return s.queryOAuthClients(ctx, ``)
+}
+
+func (s *sqliteStorage) deleteOAuthClient(c context.Context, id string) error {
+	ctx := c
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM oauth_codes WHERE client_id = $1`, id); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM oauth_tokens WHERE client_id = $1`, id); err != nil {
+		return err
+	}
+	if err = affected(tx.ExecContext(ctx, `DELETE FROM oauth_clients WHERE id = $1`, id)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStorage) queryControllers(c context.Context, where string, args ...interface{}) ([]controllerRow, error) {
+	ctx := c
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+controllerColumns+` FROM controllers`+where+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	controllers := make([]controllerRow, 0)
+	for rows.Next() {
+		cntl, err := scanController(rows)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.openSecrets(&cntl); err != nil {
+			return nil, fmt.Errorf("controller %d: %w", cntl.ID, err)
+		}
+
+		controllers = append(controllers, cntl)
+	}
+
+	return controllers, rows.Err()
+}
+
+func (s *sqliteStorage) controllers(ctx context.Context) ([]controllerRow, error) {
+	return s.queryControllers(ctx, "")
+}
+
+func (s *sqliteStorage) userControllers(ctx context.Context, userID int) ([]controllerRow, error) {
+	return s.queryControllers(ctx, ` WHERE user_id = $1`, userID)
+}
+
+func (s *sqliteStorage) controller(ctx context.Context, id int) (controllerRow, error) {
+	controllers, err := s.queryControllers(ctx, ` WHERE id = $1`, id)
+	if err != nil {
+		return controllerRow{}, err
+	}
+	if len(controllers) == 0 {
+		return controllerRow{}, errNotFound
+	}
+
+	return controllers[0], nil
+}
+
+func (s *sqliteStorage) userController(ctx context.Context, userID int, id int) (controllerRow, error) {
+	controllers, err := s.queryControllers(ctx, ` WHERE user_id = $1 AND id = $2`, userID, id)
+	if err != nil {
+		return controllerRow{}, err
+	}
+	if len(controllers) == 0 {
+		return controllerRow{}, errNotFound
+	}
+
+	return controllers[0], nil
+}
+
+// openSecrets расшифровывает пароль и ключи контроллера, прочитанные из базы
+func (s *sqliteStorage) openSecrets(cntl *controllerRow) error {
+	var err error
+	if cntl.Password, err = s.keys.open(cntl.Password); err != nil {
+		return err
+	}
+	if cntl.CodecKey, err = s.keys.open(cntl.CodecKey); err != nil {
+		return err
+	}
+	if cntl.PreviousKey, err = s.keys.open(cntl.PreviousKey); err != nil {
+		return err
+	}
+	cntl.PendingKey, err = s.keys.open(cntl.PendingKey)
+	return err
+}
+
+// sealSecrets шифрует пароль и ключ контроллера для записи в базу
+func (s *sqliteStorage) sealSecrets(cntl *controllerRow) error {
+	var err error
+	if cntl.Password, err = s.keys.seal(cntl.Password); err != nil {
+		return err
+	}
+	cntl.CodecKey, err = s.keys.seal(cntl.CodecKey)
+	return err
+}
+
+func (s *sqliteStorage) createController(c context.Context, cntl controllerRow) (int, error) {
+	ctx := c
+
+	if err := s.sealSecrets(&cntl); err != nil {
+		return 0, err
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO controllers (user_id, name, password, uri, codec_version, codec_key, driver, driver_config, verified) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		cntl.UserID, cntl.Name, cntl.Password, cntl.URI, cntl.CodecVersion, cntl.CodecKey, cntl.Driver, nullString(cntl.DriverConfig), cntl.Verified)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (s *sqliteStorage) updateController(ctx context.Context, cntl controllerRow) error {
+	if err := s.sealSecrets(&cntl); err != nil {
+		return err
+	}
+
+	return affected(s.db.ExecContext(ctx,
+		`UPDATE controllers SET name = $1, password = $2, uri = $3, codec_version = $4, codec_key = $5, driver = $6, driver_config = $7, verified = $8 WHERE id = $9 AND user_id = $10`,
+		cntl.Name, cntl.Password, cntl.URI, cntl.CodecVersion, cntl.CodecKey, cntl.Driver, nullString(cntl.DriverConfig), cntl.Verified, cntl.ID, cntl.UserID))
+}
+
+func (s *sqliteStorage) deleteController(c context.Context, userID int, id int) error {
+	ctx := c
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = affected(tx.ExecContext(ctx, `DELETE FROM controllers WHERE id = $1 AND user_id = $2`, id, userID)); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM commands WHERE controller_id = $1`, id); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM device_ids WHERE controller_id = $1`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStorage) setControllerVerified(ctx context.Context, id int, verified bool) error {
+	return affected(s.db.ExecContext(ctx, `UPDATE controllers SET verified = $1 WHERE id = $2`, verified, id))
+}
+
+func (s *sqliteStorage) setPendingControllerKey(ctx context.Context, id int, key string) error {
+	key, err := s.keys.seal(key)
+	if err != nil {
+		return err
+	}
+
+	return affected(s.db.ExecContext(ctx,
+		`UPDATE controllers SET codec_pending_key = $1 WHERE id = $2`, nullString(key), id))
+}
+
+func (s *sqliteStorage) commitControllerKey(ctx context.Context, id int, rotated time.Time) error {
+	// В SET справа используются значения строки до обновления
+	return affected(s.db.ExecContext(ctx,
+		`UPDATE controllers SET codec_previous_key = codec_key, codec_key = codec_pending_key, codec_pending_key = NULL, key_rotated_at = $1
+		WHERE id = $2 AND codec_pending_key IS NOT NULL`,
+		rotated.Format(time.RFC3339), id))
+}
+
+func (s *sqliteStorage) setControllerTunnel(ctx context.Context, userID int, id int, uri string, token string) error {
+	return affected(s.db.ExecContext(ctx,
+		`UPDATE controllers SET uri = $1, tunnel_token = $2, verified = 0 WHERE id = $3 AND user_id = $4`,
+		uri, s.hashToken(token), id, userID))
+}
+
+func (s *sqliteStorage) checkTunnelToken(c context.Context, id int, token string) (bool, error) {
+	ctx := c
+
+	cnt := 0
+	err := s.db.QueryRowContext(ctx, `SELECT count(id) FROM controllers WHERE id = $1 AND tunnel_token = $2`, id, s.hashToken(token)).Scan(&cnt)
+	return cnt > 0, err
+}
+
+func (s *sqliteStorage) deviceIDs(c context.Context, controllerID int) ([]deviceID, error) {
+	ctx := c
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, controller_id, guid, created_at FROM device_ids WHERE controller_id = $1 ORDER BY created_at, guid`, controllerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]deviceID, 0)
+	for rows.Next() {
+		var device deviceID
+		if err = rows.Scan(&device.ID, &device.ControllerID, &device.Guid, &device.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, device)
+	}
+
+	return ids, rows.Err()
+}
+
+func (s *sqliteStorage) assignDeviceID(c context.Context, controllerID int, guid string, id string) (string, error) {
+	ctx := c
+
+	// Параллельный запрос мог выдать id раньше, тогда берется его id. Если пара не появилась,
+	// вставку остановил id другой пары
+	if _, err := s.db.ExecContext(ctx,
+		`INSERT INTO device_ids (id, controller_id, guid, created_at) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`,
+		id, controllerID, guid, time.Now().UTC().Format(commandTimeLayout)); err != nil {
+		return "", err
+	}
+
+	var assigned string
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM device_ids WHERE controller_id = $1 AND guid = $2`, controllerID, guid).Scan(&assigned)
+	if err == sql.ErrNoRows {
+		return "", errDeviceIDTaken
+	}
+	return assigned, err
+}
+
+func (s *sqliteStorage) rebindDeviceID(c context.Context, userID int, controllerID int, id string, guid string) (deviceID, error) {
+	ctx := c
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return deviceID{}, err
+	}
+	defer tx.Rollback()
+
+	device := deviceID{Guid: guid}
+	if err = tx.QueryRowContext(ctx,
+		`SELECT id, controller_id, created_at FROM device_ids WHERE id = $1 AND controller_id IN (SELECT id FROM controllers WHERE id = $2 AND user_id = $3)`,
+		id, controllerID, userID).Scan(&device.ID, &device.ControllerID, &device.CreatedAt); err != nil {
+		return deviceID{}, notFound(err)
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM device_ids WHERE controller_id = $1 AND guid = $2 AND id != $3`, controllerID, guid, id); err != nil {
+		return deviceID{}, err
+	}
+	if _, err = tx.ExecContext(ctx, `UPDATE device_ids SET guid = $1 WHERE id = $2`, guid, id); err != nil {
+		return deviceID{}, err
+	}
+
+	return device, tx.Commit()
+}
+
+func (s *sqliteStorage) enqueueCommand(c context.Context, command queuedCommand) error {
+	ctx := c
+
+	payload, err := json.Marshal(command.Command)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, `INSERT INTO commands (controller_id, device_id, payload, attempts, last_error, created_at, next_attempt_at, expires_at)
+		VALUES ($1, $2, $3, 0, $4, $5, $6, $7)
+		ON CONFLICT(controller_id, device_id) DO UPDATE SET
+			payload = excluded.payload,
+			attempts = 0,
+			last_error = excluded.last_error,
+			created_at = excluded.created_at,
+			next_attempt_at = excluded.next_attempt_at,
+			expires_at = excluded.expires_at`,
+		command.ControllerID, command.DeviceID, string(payload), command.LastError,
+		command.CreatedAt, command.NextAttemptAt, command.ExpiresAt)
+	return err
+}
+
+func (s *sqliteStorage) dropDeviceCommand(ctx context.Context, controllerID int, deviceID int) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM commands WHERE controller_id = $1 AND device_id = $2`, controllerID, deviceID)
+	return err
+}
+
+func (s *sqliteStorage) expireCommands(ctx context.Context, now time.Time) (int, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM commands WHERE expires_at <= $1`, now.UTC().Format(commandTimeLayout))
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := result.RowsAffected()
+	return int(count), err
+}
+
+func (s *sqliteStorage) dueCommands(ctx context.Context, now time.Time) ([]queuedCommand, error) {
+	return s.queryCommands(ctx, `WHERE next_attempt_at <= $1`, now.UTC().Format(commandTimeLayout))
+}
+
+func (s *sqliteStorage) retryCommand(ctx context.Context, command queuedCommand, lastError string, next time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE commands SET attempts = attempts + 1, last_error = $1, next_attempt_at = $2 WHERE id = $3 AND created_at = $4`,
+		lastError, next.UTC().Format(commandTimeLayout), command.ID, command.CreatedAt)
+	return err
+}
+
+func (s *sqliteStorage) completeCommand(ctx context.Context, command queuedCommand) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM commands WHERE id = $1 AND created_at = $2`, command.ID, command.CreatedAt)
+	return err
+}
+
+func (s *sqliteStorage) userCommands(ctx context.Context, userID int, now time.Time) ([]queuedCommand, error) {
+	return s.queryCommands(ctx, `WHERE controller_id IN (SELECT id FROM controllers WHERE user_id = $1) AND expires_at > $2`,
+		userID, now.UTC().Format(commandTimeLayout))
+}
+
+func (s *sqliteStorage) cancelUserCommand(ctx context.Context, userID int, id int) error {
+	return affected(s.db.ExecContext(ctx,
+		`DELETE FROM commands WHERE id = $1 AND controller_id IN (SELECT id FROM controllers WHERE user_id = $2)`, id, userID))
+}
+
+// queryCommands читает команды по условию where в порядке постановки. Команды с испорченным
+// содержимым пропускаются, чтобы не останавливать очередь
+func (s *sqliteStorage) queryCommands(c context.Context, where string, args ...interface{}) ([]queuedCommand, error) {
+	ctx := c
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, controller_id, device_id, payload, attempts, last_error, created_at, next_attempt_at, expires_at
+		FROM commands `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	commands := make([]queuedCommand, 0)
+	broken := make([]int, 0)
+	for rows.Next() {
+		var command queuedCommand
+		var payload string
+		var lastError sql.NullString
+
+		if err = rows.Scan(&command.ID, &command.ControllerID, &command.DeviceID, &payload, &command.Attempts, &lastError,
+			&command.CreatedAt, &command.NextAttemptAt, &command.ExpiresAt); err != nil {
+			return nil, err
+		}
+		command.LastError = lastError.String
+
+		if err = json.Unmarshal([]byte(payload), &command.Command); err != nil {
+			msu.Error(ctx, err, zap.Int("command", command.ID), zap.Int("controller", command.ControllerID))
+			broken = append(broken, command.ID)
+			continue
+		}
+
+		commands = append(commands, command)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// Команду, которую нельзя прочитать, нельзя и доставить: она удаляется, иначе читалась бы при каждом опросе
+	for _, id := range broken {
+		if _, err = s.db.ExecContext(ctx, `DELETE FROM commands WHERE id = $1`, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return commands, nil
+}
+
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// errNotFound - записи нет или она принадлежит другому пользователю
+	errNotFound = errors.New("not found")
+	// errUserExists - пользователь с таким именем уже есть
+	errUserExists = errors.New("user already exists")
+	// errDeviceIDTaken - внешний id уже выдан устройству другого контроллера
+	errDeviceIDTaken = errors.New("device id is already taken")
+)
+
+// store - хранилище пользователей, токенов, контроллеров, очереди команд, клиентов OAuth и запросов авторизации.
+// В работе это sqliteStorage, в тестах можно подставить memoryStorage
+var store storage
+
+type userRow struct {
+	ID       int
+	Name     string
+	Password string
+}
+
+type storage interface {
+	// createUser создает пользователя, password - уже хэш пароля
+	createUser(ctx context.Context, name string, password string) (int, error)
+	userByName(ctx context.Context, name string) (userRow, error)
+	userByAppToken(ctx context.Context, token string) (userRow, error)
+	// userByAccessToken возвращает владельца токена доступа, который в now не истек, не обменян и не отозван
+	userByAccessToken(ctx context.Context, token string, now time.Time) (userRow, error)
+
+	setAppToken(ctx context.Context, userID int, token string) error
+	// setPassword заменяет хэш пароля пользователя
+	setPassword(ctx context.Context, userID int, password string) error
+	// legacyPasswordUsers возвращает логины пользователей с паролем в md5 и общее число пользователей
+	legacyPasswordUsers(ctx context.Context) ([]string, int, error)
+
+	createTokens(ctx context.Context, tokens tokenRow) error
+	// rotateRefreshToken обменивает действующий токен обновления клиента на пару next того же семейства
+	// и возвращает ее. Повторно предъявленный обмененный токен отзывает семейство: errTokenReused
+	rotateRefreshToken(ctx context.Context, refreshToken string, clientID string, next tokenRow, now time.Time) (tokenRow, error)
+	// revokeTokenFamily отзывает семейство токена доступа или обновления. Непустой clientID
+	// ограничивает отзыв токенами этого клиента
+	revokeTokenFamily(ctx context.Context, token string, clientID string, now time.Time) error
+	revokeClientTokens(ctx context.Context, clientID string, now time.Time) (int, error)
+	// expireTokens удаляет пары, токен обновления которых истек раньше before
+	expireTokens(ctx context.Context, before time.Time) (int, error)
+
+	createAuthRequest(ctx context.Context, id string, query string, created time.Time) error
+	// authRequest возвращает параметры запроса авторизации и время его создания
+	authRequest(ctx context.Context, id string) (string, time.Time, error)
+	// completeAuthRequest сохраняет код авторизации и удаляет запрос
+	completeAuthRequest(ctx context.Context, id string, code authCode) error
+	// consumeAuthCode возвращает и удаляет код авторизации: код обменивается на токен один раз
+	consumeAuthCode(ctx context.Context, code string) (authCode, error)
+	// expireAuthRequests удаляет запросы авторизации, созданные раньше before
+	expireAuthRequests(ctx context.Context, before time.Time) (int, error)
+	// expireAuthCodes удаляет коды авторизации, выданные раньше before
+	expireAuthCodes(ctx context.Context, before time.Time) (int, error)
+
+	// createOAuthClient регистрирует клиента, errClientExists - если id занят
+	createOAuthClient(ctx context.Context, client oauthClient) error
+	// updateOAuthClient меняет название, секрет и адреса возврата клиента, errNotFound - если клиента нет
+	updateOAuthClient(ctx context.Context, client oauthClient) error
+	oauthClient(ctx context.Context, id string) (oauthClient, error)
+	oauthClients(ctx context.Context) ([]oauthClient, error)
+	// deleteOAuthClient удаляет клиента вместе с его неиспользованными кодами и токенами
+	deleteOAuthClient(ctx context.Context, id string) error
+
+	controllers(ctx context.Context) ([]controllerRow, error)
+	userControllers(ctx context.Context, userID int) ([]controllerRow, error)
+	controller(ctx context.Context, id int) (controllerRow, error)
+	// userController возвращает контроллер, только если он принадлежит пользователю
+	userController(ctx context.Context, userID int, id int) (controllerRow, error)
+	createController(ctx context.Context, cntl controllerRow) (int, error)
+	// updateController сохраняет настройки связи контроллера cntl.ID пользователя cntl.UserID
+	updateController(ctx context.Context, cntl controllerRow) error
+	// deleteController удаляет контроллер вместе с его очередью команд и id устройств
+	deleteController(ctx context.Context, userID int, id int) error
+	setControllerVerified(ctx context.Context, id int, verified bool) error
+	// setPendingControllerKey сохраняет ключ, который еще не передан контроллеру, "" - удаляет его
+	setPendingControllerKey(ctx context.Context, id int, key string) error
+	// commitControllerKey делает ожидающий ключ текущим, а текущий - предыдущим.
+	// errNotFound - ожидающего ключа нет
+	commitControllerKey(ctx context.Context, id int, rotated time.Time) error
+	setControllerTunnel(ctx context.Context, userID int, id int, uri string, token string) error
+	checkTunnelToken(ctx context.Context, id int, token string) (bool, error)
+
+	deviceIDs(ctx context.Context, controllerID int) ([]deviceID, error)
+	// assignDeviceID возвращает id пары контроллер + guid, сохраняя id, если пары еще нет.
+	// Если id уже выдан другой паре, возвращает errDeviceIDTaken
+	assignDeviceID(ctx context.Context, controllerID int, guid string, id string) (string, error)
+	// rebindDeviceID привязывает id к guid, удаляя id, ранее выданный этому guid
+	rebindDeviceID(ctx context.Context, userID int, controllerID int, id string, guid string) (deviceID, error)
+
+	// enqueueCommand ставит команду в очередь, заменяя команду тому же устройству контроллера
+	enqueueCommand(ctx context.Context, command queuedCommand) error
+	// dropDeviceCommand удаляет из очереди команду устройству
+	dropDeviceCommand(ctx context.Context, controllerID int, deviceID int) error
+	// expireCommands удаляет команды, срок которых истек к now
+	expireCommands(ctx context.Context, now time.Time) (int, error)
+	// dueCommands возвращает команды, очередная попытка которых наступила к now
+	dueCommands(ctx context.Context, now time.Time) ([]queuedCommand, error)
+	// retryCommand откладывает команду до next. Команду, которую заменили новой, не меняет
+	retryCommand(ctx context.Context, command queuedCommand, lastError string, next time.Time) error
+	// completeCommand удаляет отправленную команду. Команду, которую заменили новой, не удаляет
+	completeCommand(ctx context.Context, command queuedCommand) error
+	// userCommands возвращает еще не истекшие команды контроллеров пользователя
+	userCommands(ctx context.Context, userID int, now time.Time) ([]queuedCommand, error)
+	// cancelUserCommand удаляет команду контроллера пользователя
+	cancelUserCommand(ctx context.Context, userID int, id int) error
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+)
+
+// testStorages - реализации хранилища, на которых проверяются обработчики
+func testStorages() map[string]func(t *testing.T) storage {
+	return map[string]func(t *testing.T) storage{
+		"memory": func(t *testing.T) storage {
+			return newMemoryStorage()
+		},
+		"sqlite": func(t *testing.T) storage {
+			path := t.TempDir() + "/users.db"
+			require.NoError(t, initializeDB(context.Background(), path))
+
+			var err error
+			db, err = sql.Open("sqlite3", path)
+			require.NoError(t, err)
+			t.Cleanup(func() { db.Close() })
+
+			return newSQLiteStorage(db, nil, []byte(testTokenKey))
+		},
+	}
+}
+
+func TestStorageHandlers(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	for name, newStore := range testStorages() {
+		t.Run(name, func(t *testing.T) {
+			store = newStore(t)
+			router := handlers()
+
+			request := func(method string, uri string, token string, body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, uri, strings.NewReader(body))
+				if strings.HasPrefix(uri, "/auth/") {
+					req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				}
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				recorder := httptest.NewRecorder()
+				router.ServeHTTP(recorder, req)
+				return recorder
+			}
+
+			register := `{"auth_login":"root","auth_pass":"azaza","user_login":"user","user_pass":"secret"}`
+			assert.Equal(t, http.StatusCreated, request(http.MethodPost, "/users/register", "", register).Code)
+			assert.Equal(t, http.StatusConflict, request(http.MethodPost, "/users/register", "", register).Code)
+			assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/users/auth?login=user&password=wrong", "", "").Code)
+
+			recorder := request(http.MethodPost, "/users/auth?login=user&password=secret", "", "")
+			require.Equal(t, http.StatusOK, recorder.Code)
+			appToken := recorder.Body.String()
+
+			assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/controllers", "unknown", "").Code)
+
+			cntl := `{"name":"11","password":"11","uri":"http://127.0.0.1:1","codec_version":1}`
+			assert.Equal(t, http.StatusCreated, request(http.MethodPost, "/controllers?unverified=true", appToken, cntl).Code)
+
+			recorder = request(http.MethodGet, "/controllers", appToken, "")
+			require.Equal(t, http.StatusOK, recorder.Code)
+			var controllers []controller
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &controllers))
+			require.Equal(t, 1, len(controllers))
+			assert.Equal(t, "http://127.0.0.1:1", controllers[0].URI)
+			assert.False(t, controllers[0].Verified)
+			assert.True(t, controllers[0].PasswordSet)
+			assert.NotContains(t, recorder.Body.String(), `"password":`)
+
+			id := "/controllers/" + strconv.Itoa(controllers[0].ID)
+			updated := `{"name":"22","uri":"http://127.0.0.1:2","codec_version":1}`
+			assert.Equal(t, http.StatusOK, request(http.MethodPut, id+"?unverified=true", appToken, updated).Code)
+			assert.Equal(t, http.StatusNotFound, request(http.MethodPut, "/controllers/100?unverified=true", appToken, updated).Code)
+
+			recorder = request(http.MethodGet, id, appToken, "")
+			require.Equal(t, http.StatusOK, recorder.Code)
+			var single controller
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &single))
+			assert.Equal(t, "22", single.Name)
+			assert.Empty(t, single.Password)
+
+			// Пароль не передан при обновлении и остался прежним
+			row, err := store.controller(context.Background(), controllers[0].ID)
+			require.NoError(t, err)
+			assert.Equal(t, "11", row.Password)
+
+			// tunnel:// задается только переводом на туннель и сохраняется при обновлении
+			tunnel := `{"name":"22","uri":"tunnel://` + strconv.Itoa(controllers[0].ID) + `","codec_version":1}`
+			assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/controllers?unverified=true", appToken, tunnel).Code)
+			assert.Equal(t, http.StatusBadRequest, request(http.MethodPut, id+"?unverified=true", appToken, tunnel).Code)
+			require.Equal(t, http.StatusOK, request(http.MethodPost, id+"/tunnel", appToken, "").Code)
+			assert.Equal(t, http.StatusOK, request(http.MethodPut, id+"?unverified=true", appToken, tunnel).Code)
+			other := `{"name":"22","uri":"tunnel://` + strconv.Itoa(controllers[0].ID+1) + `","codec_version":1}`
+			assert.Equal(t, http.StatusBadRequest, request(http.MethodPut, id+"?unverified=true", appToken, other).Code)
+
+			// Связка аккаунта Яндекса: authorize -> login -> token
+			registerTestClient(t)
+			recorder = request(http.MethodGet, "/auth/authorize?response_type=code&client_id=yandex&state=xyz", "", "")
+			require.Equal(t, http.StatusOK, recorder.Code)
+			requestID := recorder.Header().Get("X-Request-Id")
+
+			recorder = request(http.MethodPost, "/auth/login", "", "username=user&password=secret&rid="+requestID)
+			require.Equal(t, http.StatusFound, recorder.Code)
+			location, err := url.Parse(recorder.Header().Get("Location"))
+			require.NoError(t, err)
+			assert.Equal(t, testRedirectURI, location.Scheme+"://"+location.Host+location.Path)
+			assert.Equal(t, "xyz", location.Query().Get("state"))
+			code := location.Query().Get("code")
+
+			client := "&client_id=yandex&client_secret=" + testClientSecret
+			assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/auth/token", "", "grant_type=authorization_code&code=unknown"+client).Code)
+			recorder = request(http.MethodPost, "/auth/token", "", "grant_type=authorization_code&code="+code+client)
+			require.Equal(t, http.StatusOK, recorder.Code)
+			var tokens struct {
+				AccessToken string `json:"access_token"`
+			}
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &tokens))
+
+			user, err := store.userByAccessToken(context.Background(), tokens.AccessToken, time.Now())
+			require.NoError(t, err)
+			assert.Equal(t, "user", user.Name)
+
+			assert.Equal(t, http.StatusOK, request(http.MethodPost, "/api/v1.0/user/unlink", tokens.AccessToken, "").Code)
+			_, err = store.userByAccessToken(context.Background(), tokens.AccessToken, time.Now())
+			assert.Equal(t, errNotFound, err)
+
+			assert.Equal(t, http.StatusOK, request(http.MethodDelete, id, appToken, "").Code)
+			assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, id, appToken, "").Code)
+		})
+	}
+}
+
+func TestRotateControllerKey(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	key := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	aead, err := newCodec(codecAESGCM, key)
+	require.NoError(t, err)
+
+	for name, newStore := range testStorages() {
+		t.Run(name, func(t *testing.T) {
+			store = newStore(t)
+			ctx := context.Background()
+
+			fake, err := loadFakeController("testdata/fakecontroller.json", "11", "11")
+			require.NoError(t, err)
+			fake.SetCodec(fakeCodec{aead}, false)
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			userID, err := store.createUser(ctx, "user", "secret")
+			require.NoError(t, err)
+			require.NoError(t, store.setAppToken(ctx, userID, "rotate-token"))
+
+			id, err := store.createController(ctx, controllerRow{UserID: userID, Name: "11", Password: "11", URI: server.URL,
+				CodecVersion: codecAESGCM, CodecKey: key, Driver: driverHTTP, Verified: true})
+			require.NoError(t, err)
+
+			rotate := func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodPost, "/controllers/"+strconv.Itoa(id)+"/rotate-key", nil)
+				req.Header.Set("Authorization", "Bearer rotate-token")
+				recorder := httptest.NewRecorder()
+				handlers().ServeHTTP(recorder, req)
+				return recorder
+			}
+
+			require.Equal(t, http.StatusOK, rotate().Code)
+			row, err := store.controller(ctx, id)
+			require.NoError(t, err)
+			assert.Equal(t, key, row.PreviousKey)
+			assert.NotEqual(t, key, row.CodecKey)
+			assert.Empty(t, row.PendingKey)
+
+			// Повторная смена выбросила бы еще действующий предыдущий ключ
+			assert.Equal(t, http.StatusConflict, rotate().Code)
+
+			// Контроллер принял ключ, но подтверждение потерялось: ключ остался ожидающим
+			// и повторный запрос завершает смену без новой команды
+			current := row.CodecKey
+			pending, err := generateCodecKey(codecAESGCM)
+			require.NoError(t, err)
+			next, err := newCodec(codecAESGCM, pending)
+			require.NoError(t, err)
+			require.NoError(t, store.setPendingControllerKey(ctx, id, pending))
+			fake.SetCodec(fakeCodec{next}, false)
+
+			require.Equal(t, http.StatusOK, rotate().Code)
+			row, err = store.controller(ctx, id)
+			require.NoError(t, err)
+			assert.Equal(t, pending, row.CodecKey)
+			assert.Equal(t, current, row.PreviousKey)
+			assert.Empty(t, row.PendingKey)
+			assert.Equal(t, errNotFound, store.commitControllerKey(ctx, id, time.Now()))
+		})
+	}
+}
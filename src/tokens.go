@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tokenHashPrefix - префикс хэша токена в базе. Значения без префикса записаны до хэширования
+const tokenHashPrefix = "hmac:"
+
+var (
+	// accessTokenTTL - сколько действует токен доступа, с которым платформа вызывает /api/v1.0
+	accessTokenTTL = 24 * time.Hour
+	// refreshTokenTTL - сколько действует токен обновления, каждое обновление выдает новый
+	refreshTokenTTL = 90 * 24 * time.Hour
+
+	// errTokenReused - обмененный токен обновления предъявлен повторно, семейство отозвано
+	errTokenReused = errors.New("refresh token reused, token family revoked")
+
+	// tokenHashKey - ключ хэшей токенов в базе, 32 байта в hex. Без ключа в настройках он создается
+	// в <backupDir()>/token.key рядом с копиями базы, сохранять его нужно вместе с ними.
+	// Смена ключа отзывает все токены
+	tokenHashKey = ""
+
+	tokensExpired prometheus.Counter
+)
+
+// tokenRow - пара токенов доступа и обновления. Пары, полученные обновлением из одного кода
+// авторизации, составляют семейство Family и отзываются вместе
+type tokenRow struct {
+	Family string
+	UserID int
+	// ClientID - клиент, которому выдана пара, только он может ее обновить или отозвать
+	ClientID         string
+	AccessToken      string
+	RefreshToken     string
+	Scope            string
+	AccessExpiresAt  time.Time
+	RefreshExpiresAt time.Time
+	CreatedAt        time.Time
+}
+
+// newTokenPair создает пару токенов, выданную в now. Семейство, пользователя и клиента
+// заполняет вызывающий или хранилище при обновлении
+func newTokenPair(now time.Time) tokenRow {
+	return tokenRow{
+		AccessToken:      generateUUID(),
+		RefreshToken:     generateUUID(),
+		AccessExpiresAt:  now.Add(accessTokenTTL),
+		RefreshExpiresAt: now.Add(refreshTokenTTL),
+		CreatedAt:        now,
+	}
+}
+
+// hashToken возвращает хэш токена для хранения и поиска в базе. Пустой токен остается пустым
+func hashToken(key []byte, token string) string {
+	if token == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token))
+	return tokenHashPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func parseTokenKey(key string) ([]byte, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("token key must be 32 bytes in hex")
+	}
+
+	return raw, nil
+}
+
+// loadTokenKey возвращает ключ хэшей токенов из настроек или из файла path, создавая файл при первом запуске.
+// Новый ключ не создается, если в базе уже есть хэши: с ним ни один сохраненный токен не подойдет
+func loadTokenKey(c context.Context, database *sql.DB, path string) ([]byte, error) {
+	ctx := c
+
+	if tokenHashKey != "" {
+		return parseTokenKey(tokenHashKey)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return parseTokenKey(string(data))
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	hashed, err := hashedTokens(ctx, database)
+	if err != nil {
+		return nil, err
+	}
+	if hashed > 0 {
+		return nil, fmt.Errorf("TOKEN_HASH_KEY is not set and %s does not exist, but %d tokens are already hashed: restore the key or set TOKEN_HASH_KEY", path, hashed)
+	}
+
+	key := make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// hashedTokenColumns - столбцы с токенами, которые хранятся только хэшами
+var hashedTokenColumns = []struct {
+	table  string
+	column string
+}{
+	{"users", "app_token"},
+	{"oauth_tokens", "access_token"},
+	{"oauth_tokens", "refresh_token"},
+	{"oauth_codes", "code"},
+	{"controllers", "tunnel_token"},
+}
+
+// hashedTokens - число токенов в базе, которые уже хранятся хэшами
+func hashedTokens(c context.Context, database *sql.DB) (int, error) {
+	ctx := c
+
+	total := 0
+	for _, target := range hashedTokenColumns {
+		count := 0
+		if err := database.QueryRowContext(ctx, fmt.Sprintf(`SELECT count(*) FROM %s WHERE substr(%s, 1, $1) = $2`, target.table, target.column),
+			len(tokenHashPrefix), tokenHashPrefix).Scan(&count); err != nil {
+			return 0, err
+		}
+		total += count
+	}
+
+	return total, nil
+}
+
+// hashStoredTokens заменяет хэшами токены, записанные открытым текстом до хэширования,
+// чтобы пользователям не пришлось заново связывать аккаунты. Возвращает число замененных значений
+func hashStoredTokens(c context.Context, database *sql.DB, key []byte) (int, error) {
+	ctx := c
+
+	tx, err := database.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	hashed := 0
+	for _, target := range hashedTokenColumns {
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf(
+			`SELECT rowid, %[1]s FROM %[2]s WHERE %[1]s IS NOT NULL AND %[1]s != '' AND substr(%[1]s, 1, $1) != $2`,
+			target.column, target.table), len(tokenHashPrefix), tokenHashPrefix)
+		if err != nil {
+			return 0, err
+		}
+
+		values := make(map[int64]string)
+		for rows.Next() {
+			var id int64
+			var value string
+			if err = rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			values[id] = value
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return 0, err
+		}
+
+		for id, value := range values {
+			if _, err = tx.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET %s = $1 WHERE rowid = $2`, target.table, target.column),
+				hashToken(key, value), id); err != nil {
+				return 0, fmt.Errorf("%s.%s: %w", target.table, target.column, err)
+			}
+		}
+		hashed += len(values)
+	}
+
+	return hashed, tx.Commit()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+)
+
+func TestTokenRotation(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	for name, newStore := range testStorages() {
+		t.Run(name, func(t *testing.T) {
+			store = newStore(t)
+			ctx := context.Background()
+			now := time.Now()
+
+			userID, err := store.createUser(ctx, "user", fmt.Sprintf("%x", md5.Sum([]byte("secret"))))
+			require.NoError(t, err)
+
+			issue := func(family string, clientID string) tokenRow {
+				tokens := newTokenPair(now)
+				tokens.Family = family
+				tokens.UserID = userID
+				tokens.ClientID = clientID
+				require.NoError(t, store.createTokens(ctx, tokens))
+				return tokens
+			}
+			valid := func(token string, at time.Time) bool {
+				_, err := store.userByAccessToken(ctx, token, at)
+				return err == nil
+			}
+
+			first := issue("first", "yandex")
+			second := issue("second", "yandex")
+			assert.True(t, valid(first.AccessToken, now))
+			assert.False(t, valid(first.RefreshToken, now))
+			assert.False(t, valid(first.AccessToken, now.Add(accessTokenTTL)))
+
+			// Обмен выдает новую пару, старый токен доступа больше не действует
+			_, err = store.rotateRefreshToken(ctx, first.RefreshToken, "other", newTokenPair(now), now)
+			assert.Equal(t, errNotFound, err)
+			rotated, err := store.rotateRefreshToken(ctx, first.RefreshToken, "yandex", newTokenPair(now), now)
+			require.NoError(t, err)
+			assert.Equal(t, "first", rotated.Family)
+			assert.Equal(t, userID, rotated.UserID)
+			assert.False(t, valid(first.AccessToken, now))
+			assert.True(t, valid(rotated.AccessToken, now))
+
+			// Повторный обмен отзывает все семейство, другие семейства не затронуты
+			_, err = store.rotateRefreshToken(ctx, first.RefreshToken, "yandex", newTokenPair(now), now)
+			assert.Equal(t, errTokenReused, err)
+			assert.False(t, valid(rotated.AccessToken, now))
+			_, err = store.rotateRefreshToken(ctx, rotated.RefreshToken, "yandex", newTokenPair(now), now)
+			assert.Equal(t, errNotFound, err)
+			assert.True(t, valid(second.AccessToken, now))
+
+			// Истекший токен обновления не обменивается
+			_, err = store.rotateRefreshToken(ctx, second.RefreshToken, "yandex", newTokenPair(now), now.Add(refreshTokenTTL))
+			assert.Equal(t, errNotFound, err)
+
+			// Отзыв по клиенту
+			other := issue("other", "other")
+			assert.Equal(t, errNotFound, store.revokeTokenFamily(ctx, other.AccessToken, "yandex", now))
+			revoked, err := store.revokeClientTokens(ctx, "yandex", now)
+			require.NoError(t, err)
+			assert.Equal(t, 1, revoked)
+			assert.False(t, valid(second.AccessToken, now))
+			assert.True(t, valid(other.AccessToken, now))
+			assert.NoError(t, store.revokeTokenFamily(ctx, other.RefreshToken, "other", now))
+			assert.False(t, valid(other.AccessToken, now))
+
+			expired, err := store.expireTokens(ctx, now.Add(refreshTokenTTL+time.Minute))
+			require.NoError(t, err)
+			assert.Equal(t, 4, expired)
+
+			// Параллельные обмены одного токена: новую пару получает не больше одного
+			race := issue("race", "yandex")
+			results := make(chan error, 8)
+			for i := 0; i < cap(results); i++ {
+				go func() {
+					_, err := store.rotateRefreshToken(ctx, race.RefreshToken, "yandex", newTokenPair(now), now)
+					results <- err
+				}()
+			}
+			succeeded := 0
+			for i := 0; i < cap(results); i++ {
+				if <-results == nil {
+					succeeded++
+				}
+			}
+			assert.LessOrEqual(t, succeeded, 1)
+		})
+	}
+}
+
+func TestTokenRevokeEndpoint(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+	store = newMemoryStorage()
+	ctx := context.Background()
+	router := handlers()
+	registerTestClient(t)
+
+	userID, err := store.createUser(ctx, "user", fmt.Sprintf("%x", md5.Sum([]byte("secret"))))
+	require.NoError(t, err)
+	tokens := newTokenPair(time.Now())
+	tokens.Family = "family"
+	tokens.UserID = userID
+	tokens.ClientID = "yandex"
+	require.NoError(t, store.createTokens(ctx, tokens))
+
+	post := func(uri string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, uri, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("yandex", testClientSecret)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// Неизвестный токен тоже отзывается успешно
+	assert.Equal(t, http.StatusOK, post("/auth/revoke", url.Values{"token": {"unknown"}}).Code)
+	assert.Equal(t, http.StatusBadRequest, post("/auth/revoke", url.Values{}).Code)
+
+	assert.Equal(t, http.StatusOK, post("/auth/revoke", url.Values{"token": {tokens.RefreshToken}, "token_type_hint": {"refresh_token"}}).Code)
+	_, err = store.userByAccessToken(ctx, tokens.AccessToken, time.Now())
+	assert.Equal(t, errNotFound, err)
+
+	recorder := post("/auth/token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}})
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	var response oauthError
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "invalid_grant", response.Code)
+}
+
+// testTokenKey - ключ хэшей токенов в тестах с SQLite
+const testTokenKey = "test token key"
+
+func TestHashStoredTokens(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+	ctx := context.Background()
+
+	path := t.TempDir() + "/users.db"
+	require.NoError(t, initializeDB(ctx, path))
+	database, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer database.Close()
+
+	// Токены, записанные до хэширования
+	_, err = database.Exec(`INSERT INTO users (name, password, app_token) VALUES ('user', '', 'app-token');
+		INSERT INTO controllers (user_id, name, password, uri, tunnel_token) VALUES (1, 'c', 'p', 'http://c', 'tunnel-token');
+		INSERT INTO oauth_tokens (family, user_id, client_id, access_token, refresh_token, scope, access_expires_at, refresh_expires_at, created_at)
+		VALUES ('f', 1, 'yandex', 'access-token', 'refresh-token', '', '2999-01-01T00:00:00Z', '2999-01-01T00:00:00Z', '2020-01-01T00:00:00Z')`)
+	require.NoError(t, err)
+
+	hashed, err := hashStoredTokens(ctx, database, []byte(testTokenKey))
+	require.NoError(t, err)
+	assert.Equal(t, 4, hashed)
+	hashed, err = hashStoredTokens(ctx, database, []byte(testTokenKey))
+	require.NoError(t, err)
+	assert.Equal(t, 0, hashed)
+
+	storage := newSQLiteStorage(database, nil, []byte(testTokenKey))
+	user, err := storage.userByAppToken(ctx, "app-token")
+	require.NoError(t, err)
+	assert.Equal(t, "user", user.Name)
+	_, err = storage.userByAccessToken(ctx, "access-token", time.Now())
+	assert.NoError(t, err)
+	ok, err := storage.checkTunnelToken(ctx, 1, "tunnel-token")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// С другим ключом токены не находятся
+	_, err = newSQLiteStorage(database, nil, []byte("other key")).userByAppToken(ctx, "app-token")
+	assert.Equal(t, errNotFound, err)
+
+	// Новые токены тоже пишутся только хэшами
+	require.NoError(t, storage.setAppToken(ctx, user.ID, "new-app-token"))
+	code := authCode{Code: "code", UserID: user.ID, ClientID: "yandex", IssuedAt: time.Now()}
+	require.NoError(t, storage.createAuthRequest(ctx, "request", "", time.Now()))
+	require.NoError(t, storage.completeAuthRequest(ctx, "request", code))
+
+	var dump string
+	require.NoError(t, database.QueryRow(`SELECT group_concat(app_token) || (SELECT group_concat(access_token || refresh_token) FROM oauth_tokens) ||
+		(SELECT group_concat(code) FROM oauth_codes) || (SELECT group_concat(tunnel_token) FROM controllers) FROM users`).Scan(&dump))
+	for _, token := range []string{"app-token", "access-token", "refresh-token", "tunnel-token", "code"} {
+		assert.NotContains(t, dump, token)
+	}
+
+	consumed, err := storage.consumeAuthCode(ctx, "code")
+	require.NoError(t, err)
+	assert.Equal(t, "code", consumed.Code)
+}
+
+func TestLoadTokenKey(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	require.NoError(t, initializeDB(ctx, dir+"/users.db"))
+	database, err := sql.Open("sqlite3", dir+"/users.db")
+	require.NoError(t, err)
+	defer database.Close()
+	path := dir + "/backups/token.key"
+
+	key, err := loadTokenKey(ctx, database, path)
+	require.NoError(t, err)
+	assert.Len(t, key, 32)
+
+	// Созданный ключ сохраняется между запусками
+	again, err := loadTokenKey(ctx, database, path)
+	require.NoError(t, err)
+	assert.Equal(t, key, again)
+
+	tokenHashKey = testMasterKey
+	configured, err := loadTokenKey(ctx, database, path)
+	tokenHashKey = ""
+	require.NoError(t, err)
+	assert.NotEqual(t, key, configured)
+
+	// Без файла ключа хэши в базе нельзя проверить: новый ключ не создается
+	_, err = database.Exec(`INSERT INTO users (name, password, app_token) VALUES ('user', '', $1)`, tokenHashPrefix+"abc")
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(path))
+	_, err = loadTokenKey(ctx, database, path)
+	assert.Error(t, err)
+	assert.NoFileExists(t, path)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+// Контроллер за NAT регистрируется с uri tunnel://<id контроллера>. Агент в локальной сети
+// держит исходящее websocket соединение с /tunnel, а запросы к контроллеру идут через него
+const tunnelScheme = "tunnel"
+
+var errTunnelOffline = errors.New("controller tunnel is not connected")
+
+// tunnelURI - uri контроллера id, переведенного на связь через агента
+func tunnelURI(id int) string {
+	return tunnelScheme + "://" + strconv.Itoa(id)
+}
+
+var tunnels = newTunnelRegistry()
+
+// controllerTransport - транспорт запросов к контроллерам, uri tunnel:// уходят в туннель агента
+var controllerTransport = func() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.RegisterProtocol(tunnelScheme, tunnelTransport{})
+	return transport
+}()
+
+func controllerClient() *http.Client {
+	return &http.Client{Transport: controllerTransport}
+}
+
+type tunnelRequest struct {
+	ID    uint64 `json:"id"`
+	Query string `json:"query"`
+}
+
+type tunnelResponse struct {
+	ID     uint64            `json:"id"`
+	Status int               `json:"status"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   string            `json:"body"`
+	Error  string            `json:"error,omitempty"`
+}
+
+type tunnelSession struct {
+	conn      *websocket.Conn
+	sendMutex sync.Mutex
+
+	mutex   sync.Mutex
+	next    uint64
+	pending map[uint64]chan tunnelResponse
+	done    chan struct{}
+}
+
+func newTunnelSession(conn *websocket.Conn) *tunnelSession {
+	return &tunnelSession{
+		conn:    conn,
+		pending: make(map[uint64]chan tunnelResponse),
+		done:    make(chan struct{}),
+	}
+}
+
+// do отправляет агенту строку запроса к контроллеру и ждет ответ
+func (s *tunnelSession) do(c context.Context, query string) (tunnelResponse, error) {
+	ctx := c
+	reply := make(chan tunnelResponse, 1)
+
+	s.mutex.Lock()
+	s.next++
+	id := s.next
+	s.pending[id] = reply
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.pending, id)
+		s.mutex.Unlock()
+	}()
+
+	s.sendMutex.Lock()
+	err := websocket.JSON.Send(s.conn, tunnelRequest{ID: id, Query: query})
+	s.sendMutex.Unlock()
+	if err != nil {
+		return tunnelResponse{}, err
+	}
+
+	select {
+	case resp := <-reply:
+		if resp.Error != "" {
+			// Агент не достучался до контроллера: для автомата и очереди это недоступность, а не ответ контроллера
+			return resp, fmt.Errorf("%w: %s", errControllerUnreachable, resp.Error)
+		}
+		return resp, nil
+	case <-s.done:
+		return tunnelResponse{}, errTunnelOffline
+	case <-ctx.Done():
+		return tunnelResponse{}, ctx.Err()
+	}
+}
+
+// serve читает ответы агента до закрытия соединения
+func (s *tunnelSession) serve() {
+	defer close(s.done)
+
+	for {
+		var resp tunnelResponse
+		if err := websocket.JSON.Receive(s.conn, &resp); err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		reply, ok := s.pending[resp.ID]
+		s.mutex.Unlock()
+
+		if ok {
+			reply <- resp
+		}
+	}
+}
+
+type tunnelRegistry struct {
+	mutex    sync.Mutex
+	sessions map[int]*tunnelSession
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{sessions: make(map[int]*tunnelSession)}
+}
+
+// register подключает агента контроллера, предыдущее соединение закрывается
+func (r *tunnelRegistry) register(id int, session *tunnelSession) {
+	r.mutex.Lock()
+	previous, ok := r.sessions[id]
+	r.sessions[id] = session
+	r.mutex.Unlock()
+
+	if ok {
+		previous.conn.Close()
+	}
+}
+
+func (r *tunnelRegistry) unregister(id int, session *tunnelSession) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.sessions[id] == session {
+		delete(r.sessions, id)
+	}
+}
+
+func (r *tunnelRegistry) get(id int) *tunnelSession {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.sessions[id]
+}
+
+type tunnelTransport struct{}
+
+func (t tunnelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id, err := strconv.Atoi(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	session := tunnels.get(id)
+	if session == nil {
+		return nil, errTunnelOffline
+	}
+
+	resp, err := session.do(req.Context(), req.URL.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header)
+	for key, val := range resp.Header {
+		header.Set(key, val)
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(resp.Status) + " " + http.StatusText(resp.Status),
+		StatusCode:    resp.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(resp.Body)),
+		ContentLength: int64(len(resp.Body)),
+		Request:       req,
+	}, nil
+}
+
+// tunnelHandler принимает соединения агентов. Агент передает id контроллера в X-Controller-Id
+// и токен туннеля в Authorization
+func tunnelHandler() http.Handler {
+	return websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			return authorizeTunnel(r)
+		},
+		Handler: serveTunnel,
+	}
+}
+
+// serveTunnel регистрирует соединение агента и держит его до разрыва. Токен уже проверен в Handshake
+func serveTunnel(conn *websocket.Conn) {
+	r := conn.Request()
+	ctx := r.Context()
+
+	id, err := strconv.Atoi(r.Header.Get("X-Controller-Id"))
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	session := newTunnelSession(conn)
+	tunnels.register(id, session)
+	msu.Info(ctx, zap.String("tunnel", "connected"), zap.Int("controller", id), zap.String("remote", r.RemoteAddr))
+
+	session.serve()
+
+	tunnels.unregister(id, session)
+	msu.Info(ctx, zap.String("tunnel", "disconnected"), zap.Int("controller", id))
+}
+
+func authorizeTunnel(r *http.Request) error {
+	ctx := r.Context()
+
+	id, err := strconv.Atoi(r.Header.Get("X-Controller-Id"))
+	if err != nil {
+		return errors.New("invalid X-Controller-Id")
+	}
+
+	tokenInfo := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(tokenInfo) != 2 || tokenInfo[1] == "" {
+		return errors.New("invalid AuthHeader len")
+	}
+
+	ok, err := store.checkTunnelToken(ctx, id, tokenInfo[1])
+	if err != nil {
+		msu.Error(ctx, err, zap.Int("controller", id))
+		return err
+	}
+
+	if !ok {
+		err = errors.New("invalid tunnel token")
+		msu.Warn(ctx, err, zap.Int("controller", id), zap.String("remote", r.RemoteAddr))
+		return err
+	}
+
+	return nil
+}
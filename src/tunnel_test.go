@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+func TestTunnel(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	fake, err := loadFakeController("testdata/fakecontroller.json", "11", "11")
+	assert.NoError(t, err)
+
+	controller := httptest.NewServer(fake)
+	defer controller.Close()
+
+	backend := httptest.NewServer(websocket.Server{Handler: serveTunnel})
+	defer backend.Close()
+
+	host := tunnelScheme + "://7"
+
+	_, err = getUserDevicesFromSmartHome(context.Background(), 7, "11", "11", host, legacyCodec{key: encryptKey})
+	assert.Error(t, err)
+	breakers.reset(7)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveAgent(ctx, "ws"+strings.TrimPrefix(backend.URL, "http"), 7, "token", controller.URL)
+
+	assert.Eventually(t, func() bool { return tunnels.get(7) != nil }, time.Second, 10*time.Millisecond)
+
+	devices, err := getUserDevicesFromSmartHome(context.Background(), 7, "11", "11", host, legacyCodec{key: encryptKey})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(devices))
+	assert.Equal(t, host, devices[0].host)
+
+	// Агент не достучался до контроллера: ошибка - недоступность, как у контроллеров по http
+	controller.Close()
+	_, err = getUserDevicesFromSmartHome(context.Background(), 7, "11", "11", host, legacyCodec{key: encryptKey})
+	assert.ErrorIs(t, err, errControllerUnreachable)
+	assert.True(t, isTransportError(err))
+	breakers.reset(7)
+}
@@ -1,14 +1,11 @@
 package main
 
 import (
-	"crypto/md5"
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"sync"
 
 	_ "github.com/mattn/go-sqlite3"
 	"go.uber.org/zap"
@@ -36,85 +33,50 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	msu.Info(ctx,
-		zap.String("request", "yandex"),
-		zap.Any("uri", r.RequestURI),
-		zap.Any("query", r.URL.Query()),
-		zap.Any("AuthHeader", r.Header.Get("Authorization")),
-		zap.Any("body", string(body)))
-
+	// Тело запроса содержит пароли открытым текстом и в лог не попадает
 	var request appCreateUserRequest
 	if err = json.Unmarshal(body, &request); err != nil {
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
 			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
+			zap.Any("AuthHeader", r.Header.Get("Authorization")))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	msu.Info(ctx,
+		zap.String("request", "yandex"),
+		zap.Any("uri", r.RequestURI),
+		zap.String("user", request.UserLogin))
+
 	if request.AuthLogin != "root" || request.AuthPassword != "azaza" {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	count := 0
-	if err = db.QueryRowContext(ctx, `SELECT count(*) FROM users WHERE name = $1`, request.UserLogin).Scan(&count); err != nil {
-		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	if count != 0 {
-		w.WriteHeader(http.StatusConflict)
+	password, err := hashPassword(request.UserPassword)
+	if err == errPasswordTooLong {
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-
-	mutex := sync.Mutex{}
-
-	mutex.Lock()
-	defer mutex.Unlock()
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{})
 	if err != nil {
-		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
+		msu.Error(ctx, err, zap.Any("uri", r.RequestURI))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx,
-		`INSERT INTO users (name, password) VALUES ($1, $2)`,
-		request.UserLogin,
-		fmt.Sprintf("%x", md5.Sum([]byte(request.UserPassword)))); err != nil {
-		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	if err = tx.Commit(); err != nil {
+	if _, err = store.createUser(ctx, request.UserLogin, password); err != nil {
+		if err == errUserExists {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
 		msu.Error(ctx,
 			err,
 			zap.Any("uri", r.RequestURI),
 			zap.Any("query", r.URL.Query()),
 			zap.Any("AuthHeader", r.Header.Get("Authorization")),
-			zap.Any("body", string(body)))
+			zap.String("user", request.UserLogin))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -124,92 +86,49 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 
 func loginUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	var err error
 
+	// Пароль передается в запросе, поэтому в лог попадают только путь и логин
 	login := r.URL.Query().Get("login")
 	password := r.URL.Query().Get("password")
 
 	if login == "" || password == "" {
 		msu.Error(ctx,
 			errors.New("login or password not set"),
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
+			zap.Any("uri", r.URL.Path),
+			zap.String("login", login),
 			zap.Any("AuthHeader", r.Header.Get("Authorization")))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	var rows *sql.Rows
-	if rows, err = db.QueryContext(ctx,
-		`SELECT id FROM users WHERE name = $1 AND password = $2`,
-		login,
-		fmt.Sprintf("%x", md5.Sum([]byte(password)))); err != nil {
+	user, err := authenticateUser(ctx, login, password)
+	if err != nil && err != errNotFound {
 		msu.Error(ctx,
 			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
+			zap.Any("uri", r.URL.Path),
+			zap.String("login", login),
 			zap.Any("AuthHeader", r.Header.Get("Authorization")))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	id := 0
-	if rows.Next() {
-		if err = rows.Scan(&id); err != nil {
-			msu.Error(ctx,
-				err,
-				zap.Any("uri", r.RequestURI),
-				zap.Any("query", r.URL.Query()),
-				zap.Any("AuthHeader", r.Header.Get("Authorization")))
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-	} else {
+	if err == errNotFound {
 		msu.Error(ctx,
 			errors.New("invalid login or password"),
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
+			zap.Any("uri", r.URL.Path),
+			zap.String("login", login),
 			zap.Any("AuthHeader", r.Header.Get("Authorization")))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	rows.Close()
 
 	token := generateUUID()
 
-	mutex := sync.Mutex{}
-
-	mutex.Lock()
-	defer mutex.Unlock()
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{})
-	if err != nil {
+	if err = store.setAppToken(ctx, user.ID, token); err != nil {
 		msu.Error(ctx,
 			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer tx.Rollback()
-
-	if _, err = tx.ExecContext(ctx,
-		`UPDATE users SET app_token = $1 WHERE id = $2`,
-		token,
-		id); err != nil {
-		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
-			zap.Any("AuthHeader", r.Header.Get("Authorization")))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	if err = tx.Commit(); err != nil {
-		msu.Error(ctx,
-			err,
-			zap.Any("uri", r.RequestURI),
-			zap.Any("query", r.URL.Query()),
+			zap.Any("uri", r.URL.Path),
+			zap.String("login", login),
 			zap.Any("AuthHeader", r.Header.Get("Authorization")))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
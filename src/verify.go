@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// verifyActions включает проверку команд: после setcommandalice состояние линий перечитывается
+	verifyActions = false
+	// verifyWindow - сколько ждать, пока контроллер применит команду
+	verifyWindow = 3 * time.Second
+	// verifyInterval - пауза между повторными чтениями состояния
+	verifyInterval = 300 * time.Millisecond
+)
+
+var errActionNotApplied = errors.New("controller did not apply the command")
+
+// verifyActionsApplied перечитывает устройства контроллера, пока их состояние не совпадет
+// с отправленными командами или не истечет verifyWindow. Запросы идут мимо circuit breaker:
+// команда уже принята, и неудачная проверка не должна размыкать цепь
+func verifyActionsApplied(c context.Context, actions []deviceActionSmartHome, driver controllerDriver) error {
+	ctx, cancel := context.WithTimeout(c, verifyWindow)
+	defer cancel()
+
+	ids := make([]int, 0, len(actions))
+	for _, act := range actions {
+		ids = append(ids, act.ID)
+	}
+
+	var mismatch []string
+	for {
+		devices, err := driver.state(ctx, ids)
+		if err == nil {
+			if mismatch = compareActions(actions, devices); len(mismatch) == 0 {
+				return nil
+			}
+		} else if ctx.Err() == nil {
+			msu.Warn(ctx, err, zap.String("verify", "controller"))
+		}
+
+		select {
+		case <-ctx.Done():
+			if mismatch == nil {
+				return fmt.Errorf("%w: state is unknown", errActionNotApplied)
+			}
+			return fmt.Errorf("%w: %s", errActionNotApplied, strings.Join(mismatch, ", "))
+		case <-time.After(verifyInterval):
+		}
+	}
+}
+
+// compareActions возвращает устройства, состояние которых не совпадает с командами.
+// Яркость сравнивается, только если команда ее меняла
+func compareActions(actions []deviceActionSmartHome, devices []deviceSmartHome) []string {
+	state := make(map[int]deviceSmartHome, len(devices))
+	for _, device := range devices {
+		state[device.ID] = device
+	}
+
+	mismatch := make([]string, 0)
+	for _, act := range actions {
+		device, ok := state[act.ID]
+		switch {
+		case !ok:
+			mismatch = append(mismatch, fmt.Sprintf("device %d not found", act.ID))
+		case device.TurnOn != act.TurnOn:
+			mismatch = append(mismatch, fmt.Sprintf("device %d idStatus %d, expected %d", act.ID, device.TurnOn, act.TurnOn))
+		case act.ChangeDimming == 1 && device.DimmingValue != act.DimmingValue:
+			mismatch = append(mismatch, fmt.Sprintf("device %d dimmingValue %d, expected %d", act.ID, device.DimmingValue, act.DimmingValue))
+		}
+	}
+
+	return mismatch
+}
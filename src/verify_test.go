@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/ms-ural/airport/core/logger.git"
+	"go.uber.org/zap"
+)
+
+func TestVerifyActions(t *testing.T) {
+	msu = logger.NewMsuLogger(zap.NewNop(), Product, Component)
+
+	actions, window, interval := verifyActions, verifyWindow, verifyInterval
+	t.Cleanup(func() { verifyActions, verifyWindow, verifyInterval = actions, window, interval })
+	verifyActions = true
+	verifyWindow = 200 * time.Millisecond
+	verifyInterval = 20 * time.Millisecond
+
+	fake, err := loadFakeController("testdata/fakecontroller.json", "11", "11")
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	codec := legacyCodec{key: encryptKey}
+	devices, err := getUserDevicesFromSmartHome(context.Background(), 102, "11", "11", server.URL, codec)
+	assert.NoError(t, err)
+
+	var action deviceActionRequestYandex
+	action.ID = devices[0].Guid
+	action.Capabilities = append(action.Capabilities, struct {
+		Type  string `json:"type"`
+		State struct {
+			Instance string      `json:"instance"`
+			Value    interface{} `json:"value"`
+			Relative bool        `json:"relative,omitempty"`
+		} `json:"state"`
+	}{Type: "devices.capabilities.on_off"})
+	action.Capabilities[0].State.Instance = "on"
+
+	action.Capabilities[0].State.Value = true
+	assert.NoError(t, actionToSmartHome(context.Background(), devices[:1], action))
+
+	fake.SetStuck(true)
+	action.Capabilities[0].State.Value = false
+	err = actionToSmartHome(context.Background(), devices[:1], action)
+	assert.ErrorIs(t, err, errActionNotApplied)
+	assert.Equal(t, 1, fake.State()[0].TurnOn)
+
+	// Неудачная проверка не размыкает circuit breaker
+	assert.Equal(t, breakerClosed, breakers.state(102))
+
+	assert.Equal(t, []string{"device 5 not found"}, compareActions([]deviceActionSmartHome{{ID: 5}}, devices))
+}
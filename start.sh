@@ -26,6 +26,7 @@ docker run \
         -p 80:8080 \
         --name bsh-backend \
         -v ~/ssl:/opt/certs \
+        -v ~/bsh-backups:/opt/backups \
         --log-opt max-size=300m \
 	--log-opt max-file=10 \
         --label name=bsh-backend \